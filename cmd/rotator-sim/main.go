@@ -0,0 +1,288 @@
+// Command rotator-sim replays requests through filter pipeline and selectors of the rotator
+// and compares expected revenue, fill and exploration of selection strategies.
+//
+// Requests are read from request events written by file event sink, e.g.
+// -event_sinks request_events=file:/tmp/request_events.ndjson, or generated from a synthetic distribution.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/message_format"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/request_context"
+)
+
+const maxRequestLineBytes = 1 << 20
+
+// syntheticSpec describes generated requests, every distribution maps values to their weights
+type syntheticSpec struct {
+	Requests      int                `json:"requests"`
+	IntervalMS    int64              `json:"interval_ms"`
+	Links         map[string]float64 `json:"links"`
+	ResponseTypes map[string]float64 `json:"response_types"`
+	Countries     map[string]float64 `json:"countries"`
+	Domains       map[string]float64 `json:"domains"`
+	DeviceTypes   map[string]float64 `json:"device_types"`
+}
+
+func main() {
+	var (
+		servingDataFile = flag.String("serving_data", "", "Serving data snapshot file (SyncData JSON)")
+		requestsFile    = flag.String("requests", "", "Request events file, one JSON event per line")
+		syntheticFile   = flag.String("synthetic", "", "Synthetic request distribution file, used if there is no requests file")
+		domainListsFile = flag.String("domain_lists", "", "Domain lists file: {\"domains:<id>\": {\"<domain>\": \"white|black\"}}, domains are in no list without it")
+		strategies      = flag.String("strategies", "", "Comma separated selectors to compare, all registered selectors by default")
+		params          = flag.String("params", "", "Optimization params overriding publisher link ones, e.g. max_ad_tags=5,prior_weight=0.5")
+		seed            = flag.Int64("seed", 1, "Random seed, the same seed gives the same results")
+		feedbackSync    = flag.Duration("feedback_sync", 10*time.Second, "Live feedback sync interval in simulated time")
+		topAdTags       = flag.Int("top", 10, "Number of ad tags in traffic distribution of every strategy, 0 for all")
+		format          = flag.String("format", "text", "Report format: text or json")
+	)
+	flag.Parse()
+
+	if err := run(*servingDataFile, *requestsFile, *syntheticFile, *domainListsFile, *strategies, *params,
+		*seed, *feedbackSync, *topAdTags, *format); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(
+	servingDataFile, requestsFile, syntheticFile, domainListsFile, strategies, params string,
+	seed int64, feedbackSync time.Duration, topAdTags int, format string,
+) error {
+	if servingDataFile == "" {
+		return errors.New("serving data file is not set")
+	}
+	source, err := data.NewServingDataSource("file", servingDataFile)
+	if err != nil {
+		return err
+	}
+	data.ServingData = data.NewParsedServingData(source, time.Hour)
+	defer data.ServingData.StopRefresh()
+	if err = data.ServingData.Init(); err != nil {
+		return err
+	}
+
+	rotator.DomainsListLookup, err = loadDomainLists(domainListsFile)
+	if err != nil {
+		return err
+	}
+
+	var requests []rotator.SimulatedRequest
+	switch {
+	case requestsFile != "":
+		requests, err = loadRequests(requestsFile)
+	case syntheticFile != "":
+		requests, err = generateRequests(syntheticFile, seed)
+	default:
+		err = errors.New("requests or synthetic file is not set")
+	}
+	if err != nil {
+		return err
+	}
+
+	overrides, err := parseParams(params)
+	if err != nil {
+		return err
+	}
+
+	names := rotator.SelectorNames()
+	if strategies != "" {
+		names = strings.Split(strategies, ",")
+	}
+
+	var reports []rotator.SimulationReport
+	for _, name := range names {
+		simulation, err := rotator.NewSimulation(strings.TrimSpace(name), overrides, seed)
+		if err != nil {
+			return err
+		}
+		simulation.FeedbackSync = feedbackSync
+		for _, request := range requests {
+			if err := simulation.Replay(request); err != nil {
+				return err
+			}
+		}
+		reports = append(reports, simulation.Report())
+	}
+
+	if format == "json" {
+		output, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(output))
+		return nil
+	}
+	printReports(reports, topAdTags)
+	return nil
+}
+
+// loadRequests reads request events of targeting v2 handler, requests rejected before selection are skipped
+func loadRequests(path string) ([]rotator.SimulatedRequest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var requests []rotator.SimulatedRequest
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxRequestLineBytes)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var event message_format.RequestEvent
+		if err := message_format.Decode(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		if event.Endpoint != "/rotator/target/v2" || event.Outcome == request_context.OutcomeRejected {
+			continue
+		}
+		requests = append(requests, rotator.SimulatedRequest{
+			Timestamp:    time.Unix(event.Timestamp, 0),
+			TargetingID:  event.TargetingID,
+			ResponseType: event.ResponseType,
+			Domain:       event.Domain,
+			Country:      event.GeoCountry,
+			DeviceType:   event.DeviceType,
+			Price:        event.PublisherPrice,
+		})
+	}
+	return requests, scanner.Err()
+}
+
+func generateRequests(path string, seed int64) ([]rotator.SimulatedRequest, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var spec syntheticSpec
+	if err = json.Unmarshal(raw, &spec); err != nil {
+		return nil, err
+	}
+	if spec.Requests <= 0 || len(spec.Links) == 0 {
+		return nil, errors.New("synthetic distribution needs requests and links")
+	}
+	if spec.IntervalMS <= 0 {
+		spec.IntervalMS = 100
+	}
+	if len(spec.ResponseTypes) == 0 {
+		spec.ResponseTypes = map[string]float64{"vast": 1}
+	}
+
+	random := request_context.NewRandom(seed)
+	pick := func(weights map[string]float64) string {
+		values := make([]string, 0, len(weights))
+		var total float64
+		for value, weight := range weights {
+			values = append(values, value)
+			total += weight
+		}
+		// Values are sorted, so the same seed gives the same requests
+		sort.Strings(values)
+		point := random.Float64() * total
+		for _, value := range values {
+			point -= weights[value]
+			if point < 0 {
+				return value
+			}
+		}
+		if len(values) == 0 {
+			return ""
+		}
+		return values[len(values)-1]
+	}
+
+	start := time.Unix(0, 0).UTC()
+	requests := make([]rotator.SimulatedRequest, spec.Requests)
+	for i := range requests {
+		requests[i] = rotator.SimulatedRequest{
+			Timestamp:    start.Add(time.Duration(int64(i)*spec.IntervalMS) * time.Millisecond),
+			TargetingID:  pick(spec.Links),
+			ResponseType: pick(spec.ResponseTypes),
+			Country:      pick(spec.Countries),
+			Domain:       pick(spec.Domains),
+			DeviceType:   pick(spec.DeviceTypes),
+		}
+	}
+	return requests, nil
+}
+
+func loadDomainLists(path string) (func(listKey, domain string) (string, error), error) {
+	lists := make(map[string]map[string]string)
+	if path != "" {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(raw, &lists); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(listKey, domain string) (string, error) {
+		listType, exists := lists[listKey][domain]
+		if !exists {
+			return "", errors.New("domain is not in the list")
+		}
+		return listType, nil
+	}, nil
+}
+
+func parseParams(params string) (map[string]float64, error) {
+	if params == "" {
+		return nil, nil
+	}
+	result := make(map[string]float64)
+	for _, param := range strings.Split(params, ",") {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid param %q", param)
+		}
+		value, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid param %q: %s", param, err)
+		}
+		result[strings.TrimSpace(parts[0])] = value
+	}
+	return result, nil
+}
+
+func printReports(reports []rotator.SimulationReport, topAdTags int) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(writer, "strategy\trequests\trejected\tno_fill\tfallback\timpressions\tfill_rate\trevenue\terpr\texploration\t")
+	for _, report := range reports {
+		fmt.Fprintf(writer, "%s\t%d\t%d\t%d\t%d\t%.1f\t%.4f\t%.4f\t%.6f\t%.4f\t\n",
+			report.Strategy, report.Requests, report.Rejected, report.NoFill, report.Fallback,
+			report.Impressions, report.FillRate, report.Revenue, report.ERPR, report.ExplorationShare,
+		)
+	}
+	writer.Flush()
+
+	for _, report := range reports {
+		fmt.Printf("\n%s traffic by ad tag\n", report.Strategy)
+		writer = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(writer, "ad_tag\trequests\tshare\timpressions\trevenue\t")
+		for _, id := range report.TopAdTags(topAdTags) {
+			adTag := report.AdTags[id]
+			fmt.Fprintf(writer, "%s\t%.1f\t%.4f\t%.1f\t%.4f\t\n", id, adTag.Requests, adTag.Share, adTag.Impressions, adTag.Revenue)
+		}
+		writer.Flush()
+	}
+}
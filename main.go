@@ -1,8 +1,10 @@
 package main
 
 import (
-	"math/rand"
+	"context"
+	"errors"
 	"net/http"
+	"os/signal"
 	"syscall"
 
 	"time"
@@ -11,13 +13,17 @@ import (
 
 	"fmt"
 
-	"sync"
-
 	"os"
 
+	"strings"
+
 	"bitbucket.org/tapgerine/traffic_rotator/rotator"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/admin"
 	"bitbucket.org/tapgerine/traffic_rotator/rotator/config"
 	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/event_sink"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/message_format"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/metrics"
 	"bitbucket.org/tapgerine/traffic_rotator/rotator/redis_handler"
 	"bitbucket.org/tapgerine/traffic_rotator/rotator/request_context"
 	"github.com/Shopify/sarama"
@@ -27,8 +33,6 @@ import (
 )
 
 func init() {
-	rand.Seed(time.Now().UnixNano())
-
 	log.SetFormatter(&log.JSONFormatter{})
 	log.SetLevel(log.InfoLevel)
 	log.SetOutput(os.Stdout)
@@ -54,6 +58,29 @@ func main() {
 		geoDBFile                = flag.String("geo_file", "geo_db/GeoIP2-Country.mmdb", "Geo db file location")
 		rotatorDomain            = flag.String("rotator_domain", "pmp.tapgerine.com", "Rotator domain")
 		statsDomain              = flag.String("stats_domain", "pmp-stats.tapgerine.com", "Stats domain")
+		shutdownTimeout          = flag.Duration("shutdown_timeout", 15*time.Second, "Max time to wait for in-flight requests and kafka flush on shutdown")
+		adminPort                = flag.String("admin_port", "8082", "Admin API port")
+		adminToken               = flag.String("admin_token", "", "Admin API token, empty to disable admin API")
+		debugTraceKey            = flag.String("debug_trace_key", "", "Key signing debug_trace parameters and authorizing debug trace headers, empty to disable tracing")
+		kafkaBufferSize          = flag.Int("kafka_buffer_size", 10000, "Max kafka messages buffered before dropping")
+		kafkaSpoolDir            = flag.String("kafka_spool_dir", "/tmp/traffic_rotator_spool", "Directory to spool kafka messages during outages, empty to disable")
+		kafkaSpoolMaxBytes       = flag.Int64("kafka_spool_max_bytes", 1<<30, "Max size of kafka spool")
+		kafkaPartitionKeys       = flag.String("kafka_partition_keys", "default=request_id", "Kafka partition key strategy by topic: request_id, publisher_id, targeting_id, advertiser_id or none")
+		eventEncoding            = flag.String("event_encoding", "json", "Encoding of versioned event messages: json or protobuf, file and stdout sinks need json")
+		eventSinks               = flag.String("event_sinks", "default=kafka", "Event sinks by event type: kafka (one config for all types), file:<path>, stdout, discard, e.g. default=kafka,rtb_bid_requests=file:/tmp/bids.ndjson")
+		servingDataRefresh       = flag.Duration("serving_data_refresh", 60*time.Second, "Serving data refresh interval")
+		servingDataFullReload    = flag.Duration("serving_data_full_reload", 10*time.Minute, "Max interval between full serving data reloads when incremental updates are used")
+		servingDataSource        = flag.String("serving_data_source", "redis", "Serving data source: redis, file or http")
+		servingDataLocation      = flag.String("serving_data_location", "", "Serving data redis key, file path or url")
+		servingDataQuarantine    = flag.Float64("serving_data_max_quarantined", 0.25, "Max ratio of invalid ad tags before snapshot is rejected")
+		servingDataChannel       = flag.String("serving_data_channel", "serving_data_updates", "Redis pub/sub channel with serving data update notifications, empty to disable")
+		servingDataBackupFile    = flag.String("serving_data_backup", "/tmp/traffic_rotator_serving_data.json", "Last known good serving data file, empty to disable")
+		feedbackWindow           = flag.Duration("feedback_window", time.Hour, "Rolling window of live feedback counters")
+		feedbackBucket           = flag.Duration("feedback_bucket", 5*time.Minute, "Live feedback counters bucket size")
+		feedbackHalfLife         = flag.Duration("feedback_half_life", time.Hour, "Age at which live feedback counters weigh half, 0 to disable decay")
+		feedbackSync             = flag.Duration("feedback_sync", 10*time.Second, "Live feedback counters sync interval")
+		feedbackShared           = flag.Bool("feedback_shared", true, "Share live feedback counters with other instances through redis")
+		feedbackRecord           = flag.Bool("feedback_record", false, "Record requests for live feedback, enable only when player events are relayed to admin feedback API")
 	)
 	flag.Parse()
 
@@ -75,9 +102,6 @@ func main() {
 	}
 
 	rotator.EncryptionKey = []byte(*encryptionKey)
-	data.ServingData = &data.ParsedServingData{
-		DataWriteLock: sync.RWMutex{},
-	}
 
 	redis_handler.RedisConnection = redis.NewClient(&redis.Options{
 		Addr:     fmt.Sprintf("%s:6379", *redisHost),
@@ -85,37 +109,124 @@ func main() {
 		DB:       0,
 	})
 
-	brokers := []string{*kafkaBrokers}
-	//setup relevant config info
-	saramaConfig := sarama.NewConfig()
-	saramaConfig.Producer.Partitioner = sarama.NewRandomPartitioner
-	saramaConfig.Producer.RequiredAcks = sarama.WaitForAll
-	saramaConfig.Producer.Compression = sarama.CompressionSnappy
-	saramaConfig.Producer.Flush.Frequency = 10000 * time.Millisecond
-	rotator.KafkaProducer, err = sarama.NewAsyncProducer(brokers, saramaConfig)
+	sinkFactories := event_sink.DefaultFactories()
+	// Kafka producer, delivery and partition keys are process wide, so all routes have to share one kafka sink
+	var isKafkaSinkCreated bool
+	sinkFactories["kafka"] = func(location string) (event_sink.EventSink, error) {
+		if isKafkaSinkCreated {
+			return nil, errors.New("only one kafka sink is supported, use the same kafka config for all event types")
+		}
+		brokers := []string{*kafkaBrokers}
+		if location != "" {
+			brokers = strings.Split(location, ";")
+		}
+		//setup relevant config info
+		saramaConfig := sarama.NewConfig()
+		saramaConfig.Producer.Partitioner = sarama.NewHashPartitioner
+		saramaConfig.Producer.RequiredAcks = sarama.WaitForAll
+		saramaConfig.Producer.Compression = sarama.CompressionSnappy
+		saramaConfig.Producer.Flush.Frequency = 10000 * time.Millisecond
+		saramaConfig.Producer.Return.Successes = true
+		producer, err := sarama.NewAsyncProducer(brokers, saramaConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		rotator.KafkaPartitionKeys, err = rotator.ParseKafkaPartitionKeys(*kafkaPartitionKeys)
+		if err != nil {
+			producer.Close()
+			return nil, err
+		}
+
+		var spool *event_sink.Spool
+		if *kafkaSpoolDir != "" {
+			spool, err = event_sink.OpenSpool(*kafkaSpoolDir, *kafkaSpoolMaxBytes)
+			if err != nil {
+				producer.Close()
+				return nil, err
+			}
+			if pending := spool.Pending(); pending > 0 {
+				log.WithField("pending", pending).Info("Kafka spool has messages from previous run")
+			}
+		}
 
+		rotator.KafkaProducer = producer
+		rotator.StartKafkaDelivery(*kafkaBufferSize, saramaConfig.Producer.Return.Successes, spool)
+		isKafkaSinkCreated = true
+		return rotator.KafkaSink{}, nil
+	}
+	rotator.EventEncoding, err = message_format.ParseEncoding(*eventEncoding)
+	if err != nil {
+		log.WithError(err).Warn()
+		panic(err)
+	}
+	rotator.Events, err = event_sink.ParseRouter(*eventSinks, sinkFactories, rotator.EventEncoding == message_format.EncodingProtobuf)
 	if err != nil {
 		log.WithError(err).Warn()
 		panic(err)
 	}
 
-	defer func() {
-		if err := rotator.KafkaProducer.Close(); err != nil {
-			log.WithError(err).Warn()
-			panic(err)
-		}
-	}()
+	source, err := data.NewServingDataSource(*servingDataSource, *servingDataLocation)
+	if err != nil {
+		log.WithError(err).Warn()
+		panic(err)
+	}
+	data.ServingData = data.NewParsedServingData(source, *servingDataRefresh)
+	data.ServingData.Validator.MaxQuarantinedRatio = *servingDataQuarantine
+	data.ServingData.Validator.KnownFilters = rotator.FilterNames()
+	data.ServingData.Validator.KnownSelectors = rotator.SelectorNames()
+	data.ServingData.FullReloadInterval = *servingDataFullReload
+	data.ServingData.OnChange = rotator.SendServingDataDiffToKafka
+	if *servingDataBackupFile != "" {
+		data.ServingData.Backup = &data.BackupStore{Path: *servingDataBackupFile}
+	}
+	if *servingDataChannel != "" {
+		data.ServingData.Notifier = data.NewRedisNotifier(*servingDataChannel)
+	}
+	if err = data.ServingData.Init(); err != nil {
+		log.WithError(err).Warn("No serving data available")
+	}
+	data.ServingData.StartRefresh()
+
+	rotator.Feedback.Window = *feedbackWindow
+	rotator.Feedback.BucketSize = *feedbackBucket
+	rotator.Feedback.HalfLife = *feedbackHalfLife
+	rotator.IsFeedbackRecorded = *feedbackRecord
+	if *feedbackShared {
+		rotator.Feedback.Redis = redis_handler.RedisConnection
+	}
+	rotator.Feedback.StartSync(*feedbackSync)
 
 	request_context.GeoDatabase, err = maxminddb.Open(*geoDBFile)
 	if err != nil {
 		log.WithError(err).Warn()
 		panic(err)
 	}
-	defer request_context.GeoDatabase.Close()
 
 	config.RotatorDomain = *rotatorDomain
 	config.StatsDomain = *statsDomain
 
+	rotator.DebugTraceKey = []byte(*debugTraceKey)
+
+	var adminServer *http.Server
+	if *adminToken != "" {
+		adminHandler := admin.NewHandler(*adminToken)
+		adminHandler.HandleFunc("/admin/kafka", rotator.KafkaDeliveryHealthHandler)
+		adminHandler.HandleFunc("/admin/debug_trace/sign", rotator.DebugTraceSignHandler)
+		adminHandler.HandleFunc("/admin/feedback", rotator.FeedbackHandler)
+		adminHandler.HandleFunc("/metrics", metrics.Handler)
+		adminServer = &http.Server{
+			Addr:    fmt.Sprintf(":%s", *adminPort),
+			Handler: adminHandler,
+		}
+		go func() {
+			log.Info(fmt.Sprintf("Admin API working on port %s", *adminPort))
+			if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.WithError(err).Warn("Admin API stopped")
+			}
+		}()
+	}
+
 	//runtime.GOMAXPROCS(runtime.NumCPU())
 	log.Info("Application working on port 8081")
 	//http.HandleFunc(agent.MeasureHandlerFunc("/rotator", rotator.AdRotationHandler))
@@ -130,5 +241,66 @@ func main() {
 	http.HandleFunc("/rotator/target/bidder_init", rotator.AdRotationOpenRTBInitHandler)
 	http.HandleFunc("/rotator/target/bidder_processor", rotator.AdRotationOpenRTBProcessorHandler)
 	http.HandleFunc("/single_page/get_data/", rotator.SinglePageUserData)
-	log.Fatal(http.ListenAndServe(":8081", nil))
+
+	server := &http.Server{Addr: ":8081"}
+	serverErrors := make(chan error, 1)
+	go func() {
+		serverErrors <- server.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case sig := <-signals:
+		log.WithField("signal", sig.String()).Info("Shutting down")
+	case err = <-serverErrors:
+		log.WithError(err).Warn("Server stopped, shutting down")
+	}
+
+	shutdown(*shutdownTimeout, server, adminServer)
+}
+
+// shutdown stops accepting connections, waits for in-flight requests and auctions,
+// then flushes event sinks and releases resources
+func shutdown(timeout time.Duration, servers ...*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, server := range servers {
+		if server == nil {
+			continue
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			log.WithError(err).WithField("addr", server.Addr).Warn("Server was not shut down gracefully")
+		}
+	}
+
+	if err := rotator.WaitForBidRequests(ctx); err != nil {
+		log.WithError(err).Warn("Not all bid requests finished")
+	}
+
+	data.ServingData.StopRefresh()
+	if data.ServingData.Notifier != nil {
+		data.ServingData.Notifier.Close()
+	}
+	if err := rotator.Feedback.StopSync(); err != nil {
+		log.WithError(err).Warn("Live feedback counters were not flushed")
+	}
+
+	sinksClosed := make(chan error, 1)
+	go func() {
+		sinksClosed <- rotator.Events.Close()
+	}()
+	select {
+	case err := <-sinksClosed:
+		if err != nil {
+			log.WithError(err).Warn("Event sinks closed with errors")
+		}
+	case <-ctx.Done():
+		log.Warn("Event sinks were not flushed in time")
+	}
+
+	request_context.GeoDatabase.Close()
+	log.Info("Shutdown completed")
 }
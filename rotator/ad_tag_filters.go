@@ -0,0 +1,156 @@
+package rotator
+
+import (
+	"fmt"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/request_context"
+	log "github.com/Sirupsen/logrus"
+)
+
+func init() {
+	RegisterFilter(priceFilter{})
+	RegisterFilter(deviceTypeFilter{})
+	RegisterFilter(requiredParametersFilter{})
+	RegisterFilter(domainListsFilter{})
+	RegisterFilter(geoFilter{})
+}
+
+// anyPlatform is embedded by filters used for every platform
+type anyPlatform struct{}
+
+func (anyPlatform) AppliesTo(platform string) bool {
+	return true
+}
+
+// priceFilter removes ad tags paying less than publisher price
+type priceFilter struct {
+	anyPlatform
+}
+
+func (priceFilter) Name() string {
+	return "price"
+}
+
+func (priceFilter) Evaluate(r request_context.RequestContext, adTag *AdTagContext) string {
+	if r.UseOriginPrice {
+		// If we use origin price - skip this check
+		return ""
+	}
+	if r.PublisherPrice == 0 {
+		// we do not pay publisher for traffic
+		return ""
+	}
+
+	if !(adTag.Data.Price > 0 && adTag.Data.Price >= r.PublisherPrice) {
+		return rejection(r, "price %.4f is below publisher price %.4f", adTag.Data.Price, r.PublisherPrice)
+	}
+	return ""
+}
+
+// deviceTypeFilter is used for desktop links only, other links are targeted by the platform itself
+type deviceTypeFilter struct{}
+
+func (deviceTypeFilter) Name() string {
+	return "device_type"
+}
+
+func (deviceTypeFilter) AppliesTo(platform string) bool {
+	return platform == "desktop"
+}
+
+func (deviceTypeFilter) Evaluate(r request_context.RequestContext, adTag *AdTagContext) string {
+	if r.User.UserAgent.DeviceType == "undefined" {
+		return ""
+	}
+
+	if adTag.Data.Targeting.DeviceType != r.User.UserAgent.DeviceType {
+		return rejection(r, "device type %s does not match %s", adTag.Data.Targeting.DeviceType, r.User.UserAgent.DeviceType)
+	}
+	return ""
+}
+
+// requiredParametersFilter removes ad tags requiring parameters which are not set in the request
+type requiredParametersFilter struct {
+	anyPlatform
+}
+
+func (requiredParametersFilter) Name() string {
+	return "required_parameters"
+}
+
+func (requiredParametersFilter) Evaluate(r request_context.RequestContext, adTag *AdTagContext) string {
+	parametersMapping, err := data.ServingData.GetParametersMapByID(adTag.Data.AdvertiserPlatformTypeID)
+	if err != nil {
+		log.WithField("ad_tag_id", adTag.ID).WithError(err).Warn()
+		return ""
+	}
+
+	for _, parameter := range parametersMapping {
+		if parameter[r.RequestPlatform].IsRequired {
+			valueFromRequest := r.Request.URL.Query().Get(parameter[r.RequestPlatform].OriginalShortcut)
+			if valueFromRequest == "" || valueFromRequest == parameter[r.RequestPlatform].OriginalMacros {
+				return rejection(r, "required parameter %s is not set", parameter[r.RequestPlatform].OriginalShortcut)
+			}
+		}
+	}
+	return ""
+}
+
+// domainListsFilter checks request domain against white or black list of the ad tag
+type domainListsFilter struct {
+	anyPlatform
+}
+
+func (domainListsFilter) Name() string {
+	return "domain_lists"
+}
+
+func (domainListsFilter) Evaluate(r request_context.RequestContext, adTag *AdTagContext) string {
+	if adTag.Data.DomainsListID == 0 {
+		return ""
+	}
+	if r.Domain == "" {
+		return rejection(r, "request has no domain for domains list %d", adTag.Data.DomainsListID)
+	}
+
+	domainsListItem, err := DomainsListLookup(fmt.Sprintf("domains:%d", adTag.Data.DomainsListID), r.Domain)
+
+	if adTag.Data.DomainsListType == "white" && !(err == nil && domainsListItem == "white") {
+		// White list activated. Domain is not in the list
+		return rejection(r, "domain %s is not in white list %d", r.Domain, adTag.Data.DomainsListID)
+	} else if adTag.Data.DomainsListType == "black" && err == nil && domainsListItem == "black" {
+		// Black list activated. Domain is in the list
+		return rejection(r, "domain %s is in black list %d", r.Domain, adTag.Data.DomainsListID)
+	}
+	return ""
+}
+
+// geoFilter removes ad tags which do not target user country, it is a fallback filter by default
+type geoFilter struct {
+	anyPlatform
+}
+
+func (geoFilter) Name() string {
+	return "geo"
+}
+
+func (geoFilter) Evaluate(r request_context.RequestContext, adTag *AdTagContext) string {
+	adTag.GeoConfig.IsSetUpGeo = false
+	for _, ISOCode := range adTag.Data.Targeting.Geo {
+		if ISOCode == "O1" {
+			// It means WW targeting
+			adTag.GeoConfig.IsWorldWide = true
+			break
+		}
+		if r.User.Geo.Country.ISOCode != "" && ISOCode == r.User.Geo.Country.ISOCode {
+			adTag.GeoConfig.IsSetUpGeo = true
+			break
+		}
+	}
+
+	if !adTag.GeoConfig.IsWorldWide && !adTag.GeoConfig.IsSetUpGeo {
+		return rejection(r, "country %q is not targeted", r.User.Geo.Country.ISOCode)
+	}
+	return ""
+}
@@ -0,0 +1,248 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+	log "github.com/Sirupsen/logrus"
+)
+
+const servingDataPath = "/admin/serving_data"
+
+type snapshotMetadata struct {
+	Version    uint64                `json:"version"`
+	Source     string                `json:"source"`
+	LoadedAt   time.Time             `json:"loaded_at"`
+	FetchedAt  time.Time             `json:"fetched_at"`
+	AgeSeconds float64               `json:"age_seconds"`
+	FromBackup bool                  `json:"from_backup"`
+	Counts     map[string]int        `json:"counts"`
+	Validation data.ValidationReport `json:"validation"`
+	Refresh    refreshStatus         `json:"refresh"`
+}
+
+type refreshStatus struct {
+	LastAttempt         time.Time `json:"last_attempt"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastFullLoad        time.Time `json:"last_full_load"`
+	LastError           string    `json:"last_error,omitempty"`
+	ConsecutiveFailures int64     `json:"consecutive_failures"`
+}
+
+type publisherLinkResponse struct {
+	PublisherLink data.PublisherLinkData `json:"publisher_link"`
+	PublisherID   uint64                 `json:"publisher_id"`
+	AdTagIDs      []string               `json:"ad_tag_ids"`
+}
+
+// Handler serves admin API. Every request must carry the token
+// either in "Authorization: Bearer <token>" or in "X-Admin-Token" header.
+type Handler struct {
+	token []byte
+	mux   *http.ServeMux
+}
+
+func NewHandler(token string) *Handler {
+	h := &Handler{
+		token: []byte(token),
+		mux:   http.NewServeMux(),
+	}
+	h.HandleFunc(servingDataPath, servingDataMetadataHandler)
+	h.HandleFunc(servingDataPath+"/reload", servingDataReloadHandler)
+	h.HandleFunc(servingDataPath+"/ad_tags/", adTagHandler)
+	h.HandleFunc(servingDataPath+"/publisher_links/", publisherLinkHandler)
+	h.HandleFunc(servingDataPath+"/advertisers/", advertiserHandler)
+	h.HandleFunc(servingDataPath+"/parameters_mapping/", parametersMappingHandler)
+	return h
+}
+
+// HandleFunc registers additional admin endpoint, it is protected by the same token
+func (h *Handler) HandleFunc(pattern string, handler http.HandlerFunc) {
+	h.mux.HandleFunc(pattern, handler)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !IsAuthorized(r, h.token) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// IsAuthorized checks admin token of the request
+func IsAuthorized(r *http.Request, token []byte) bool {
+	if len(token) == 0 {
+		return false
+	}
+
+	requestToken := r.Header.Get("X-Admin-Token")
+	if requestToken == "" {
+		requestToken = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+
+	return subtle.ConstantTimeCompare([]byte(requestToken), token) == 1
+}
+
+func servingDataMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot := data.ServingData.Snapshot()
+	if snapshot == nil {
+		writeError(w, http.StatusServiceUnavailable, data.ErrNotInitialized.Error())
+		return
+	}
+
+	status := data.ServingData.Status()
+	metadata := snapshotMetadata{
+		Version:    snapshot.Data.Version,
+		Source:     snapshot.Source,
+		LoadedAt:   snapshot.LoadedAt,
+		FetchedAt:  snapshot.FetchedAt,
+		AgeSeconds: snapshot.Age().Seconds(),
+		FromBackup: snapshot.FromBackup,
+		Counts: map[string]int{
+			"ad_tags":                   len(snapshot.Data.AdTags),
+			"publisher_links":           len(snapshot.Data.PublisherLinks),
+			"advertisers":               len(snapshot.Data.Advertisers),
+			"parameters_mapping":        len(snapshot.Data.ParametersMapping),
+			"publisher_targeting_ids":   len(snapshot.Data.PublisherTargetingIDMap),
+			"targeting_link_ad_tag_ids": len(snapshot.Data.TargetingLinkAdTagsIDs),
+		},
+		Validation: snapshot.Validation,
+		Refresh: refreshStatus{
+			LastAttempt:         status.LastAttempt,
+			LastSuccess:         status.LastSuccess,
+			LastFullLoad:        status.LastFullLoad,
+			ConsecutiveFailures: status.ConsecutiveFailures,
+		},
+	}
+	if status.LastError != nil {
+		metadata.Refresh.LastError = status.LastError.Error()
+	}
+
+	writeJSON(w, metadata)
+}
+
+func servingDataReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := data.ServingData.Load(); err != nil {
+		log.WithError(err).Warn("Forced serving data reload failed")
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	log.Info("Serving data reloaded by admin request")
+	servingDataMetadataHandler(w, r)
+}
+
+func adTagHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot, id, ok := lookupRequest(w, r, "/ad_tags/")
+	if !ok {
+		return
+	}
+
+	adTag, exists := snapshot.Data.AdTags[id]
+	if !exists {
+		writeError(w, http.StatusNotFound, "ad tag not found")
+		return
+	}
+	writeJSON(w, adTag)
+}
+
+func publisherLinkHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot, id, ok := lookupRequest(w, r, "/publisher_links/")
+	if !ok {
+		return
+	}
+
+	publisherLink, exists := snapshot.Data.PublisherLinks[id]
+	if !exists {
+		writeError(w, http.StatusNotFound, "publisher link not found")
+		return
+	}
+	writeJSON(w, publisherLinkResponse{
+		PublisherLink: publisherLink,
+		PublisherID:   snapshot.Data.PublisherTargetingIDMap[id],
+		AdTagIDs:      snapshot.Data.TargetingLinkAdTagsIDs[id],
+	})
+}
+
+func advertiserHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot, id, ok := lookupRequest(w, r, "/advertisers/")
+	if !ok {
+		return
+	}
+
+	advertiserID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid advertiser id")
+		return
+	}
+	advertiser, exists := snapshot.Data.Advertisers[advertiserID]
+	if !exists {
+		writeError(w, http.StatusNotFound, "advertiser not found")
+		return
+	}
+	writeJSON(w, advertiser)
+}
+
+func parametersMappingHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot, id, ok := lookupRequest(w, r, "/parameters_mapping/")
+	if !ok {
+		return
+	}
+
+	platformTypeID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid advertiser platform type id")
+		return
+	}
+	parametersMapping, exists := snapshot.Data.ParametersMapping[platformTypeID]
+	if !exists {
+		writeError(w, http.StatusNotFound, "parameters mapping not found")
+		return
+	}
+	writeJSON(w, parametersMapping)
+}
+
+func lookupRequest(w http.ResponseWriter, r *http.Request, prefix string) (*data.Snapshot, string, bool) {
+	id := strings.TrimPrefix(r.URL.Path, servingDataPath+prefix)
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "no id")
+		return nil, "", false
+	}
+
+	snapshot := data.ServingData.Snapshot()
+	if snapshot == nil {
+		writeError(w, http.StatusServiceUnavailable, data.ErrNotInitialized.Error())
+		return nil, "", false
+	}
+
+	return snapshot, id, true
+}
+
+func writeJSON(w http.ResponseWriter, response interface{}) {
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	responseJSON, _ := json.Marshal(map[string]string{"error": message})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(responseJSON)
+}
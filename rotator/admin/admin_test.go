@@ -0,0 +1,121 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+)
+
+type staticServingDataSource []byte
+
+func (s staticServingDataSource) Name() string {
+	return "static"
+}
+
+func (s staticServingDataSource) Fetch() ([]byte, error) {
+	return s, nil
+}
+
+func useServingData(t *testing.T, syncData data.SyncData) {
+	raw, err := json.Marshal(syncData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.ServingData = data.NewParsedServingData(staticServingDataSource(raw), time.Hour)
+	if err := data.ServingData.Init(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsAuthorized(t *testing.T) {
+	cases := []struct {
+		name    string
+		token   string
+		headers map[string]string
+		isValid bool
+	}{
+		{name: "empty token", token: "", headers: map[string]string{"X-Admin-Token": ""}, isValid: false},
+		{name: "empty token with bearer", token: "", headers: map[string]string{"Authorization": "Bearer "}, isValid: false},
+		{name: "no header", token: "secret", isValid: false},
+		{name: "wrong token", token: "secret", headers: map[string]string{"X-Admin-Token": "guess"}, isValid: false},
+		{name: "wrong bearer", token: "secret", headers: map[string]string{"Authorization": "Bearer guess"}, isValid: false},
+		{name: "token without bearer prefix", token: "secret", headers: map[string]string{"Authorization": "Basic secret"}, isValid: false},
+		{name: "admin token header", token: "secret", headers: map[string]string{"X-Admin-Token": "secret"}, isValid: true},
+		{name: "bearer", token: "secret", headers: map[string]string{"Authorization": "Bearer secret"}, isValid: true},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, servingDataPath, nil)
+		for name, value := range c.headers {
+			r.Header.Set(name, value)
+		}
+		if isAuthorized := IsAuthorized(r, []byte(c.token)); isAuthorized != c.isValid {
+			t.Errorf("%s: authorized is %v", c.name, isAuthorized)
+		}
+	}
+}
+
+func TestHandlerRequiresToken(t *testing.T) {
+	handler := NewHandler("secret")
+	for _, token := range []string{"", "guess"} {
+		r := httptest.NewRequest(http.MethodGet, servingDataPath+"/ad_tags/1", nil)
+		r.Header.Set("X-Admin-Token", token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: expected 401, got %d", token, w.Code)
+		}
+	}
+
+	// Disabled admin API does not accept anything
+	r := httptest.NewRequest(http.MethodGet, servingDataPath, nil)
+	w := httptest.NewRecorder()
+	NewHandler("").ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("handler without token: expected 401, got %d", w.Code)
+	}
+}
+
+func TestAdTagHandler(t *testing.T) {
+	defer func(servingData *data.ParsedServingData) { data.ServingData = servingData }(data.ServingData)
+	useServingData(t, data.SyncData{
+		Version: 1,
+		AdTags: map[string]data.AdTagData{
+			"1": {AdTagID: 1, URL: "http://ads.example.com/vast", Price: 2, AdvertiserPlatformTypeID: 1},
+		},
+		ParametersMapping: map[uint64]map[string]map[string]data.ParametersMapping{1: {}},
+	})
+	handler := NewHandler("secret")
+
+	cases := []struct {
+		path string
+		code int
+	}{
+		{path: servingDataPath + "/ad_tags/1", code: http.StatusOK},
+		{path: servingDataPath + "/ad_tags/2", code: http.StatusNotFound},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, c.path, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%s: expected %d, got %d", c.path, c.code, w.Code)
+			continue
+		}
+		if c.code != http.StatusOK {
+			continue
+		}
+
+		var adTag data.AdTagData
+		if err := json.Unmarshal(w.Body.Bytes(), &adTag); err != nil {
+			t.Fatal(err)
+		}
+		if adTag.AdTagID != 1 || adTag.Price != 2 {
+			t.Errorf("unexpected ad tag %+v", adTag)
+		}
+	}
+}
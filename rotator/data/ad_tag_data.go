@@ -4,18 +4,28 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"bitbucket.org/tapgerine/traffic_rotator/rotator/redis_handler"
-
 	log "github.com/Sirupsen/logrus"
 )
 
-//var DataWriteLock sync.RWMutex
 var ServingData *ParsedServingData
 
+var ErrNotInitialized = errors.New("serving data is not initialized")
+
+var ErrStaleServingData = errors.New("serving data is older than published snapshot")
+
+const (
+	defaultRetryInterval       = 5 * time.Second
+	defaultFullReloadInterval  = 10 * time.Minute
+	defaultMaxQuarantinedRatio = 0.25
+)
+
 type SyncData struct {
+	Version                      uint64                                             `json:"version"`
 	AdTags                       map[string]AdTagData                               `json:"ad_tags"`
 	ParametersMapping            map[uint64]map[string]map[string]ParametersMapping `json:"parameters_mapping"`
 	OurPlatformParametersMapping map[string]map[string]map[uint64]ParametersMapping `json:"our_platform_parameters_mapping"`
@@ -23,6 +33,7 @@ type SyncData struct {
 	TargetingLinkAdTagsIDs       map[string][]string                                `json:"targeting_link_ad_tags_i_ds"`
 	PublisherLinks               map[string]PublisherLinkData                       `json:"publisher_links"`
 	Advertisers                  map[uint64]AdvertiserData                          `json:"advertisers"`
+	Experiments                  map[string]ExperimentData                          `json:"experiments"`
 }
 
 type AdvertiserData struct {
@@ -43,10 +54,10 @@ type AdTagData struct {
 	PublisherTargetingID           string                         `json:"publisher_targeting_id"`
 	Price                          float64                        `json:"price"`
 	CouldBeUsedForTargeting        bool                           `json:"could_be_used_for_targeting"`
-	ERPRByGeoForLastWeek           map[string]ERPRData            `json:"erpr_by_geo_for_last_week"`
-	TotalStats                     TotalStatsForLastMonth         `json:"total_stats"`
-	ERPRByTargetingID              map[string]ERPRData            `json:"erpr_by_targeting_id"`
-	FillRateByTargetingIDAndDomain map[string]map[string]ERPRData `json:"fill_rate_by_domain"`
+	ERPRByGeoForLastWeek           map[string]ERPRData            `json:"erpr_by_geo_for_last_week" diff:"-"`
+	TotalStats                     TotalStatsForLastMonth         `json:"total_stats" diff:"-"`
+	ERPRByTargetingID              map[string]ERPRData            `json:"erpr_by_targeting_id" diff:"-"`
+	FillRateByTargetingIDAndDomain map[string]map[string]ERPRData `json:"fill_rate_by_domain" diff:"-"`
 	DomainsListID                  uint64                         `json:"domains_list_id"`
 	DomainsListType                string                         `json:"domains_list_type"`
 }
@@ -59,6 +70,98 @@ type PublisherLinkData struct {
 	Price           float64
 	Optimization    string
 	StudyRequests   int64
+	// OptimizationParams are parameters of Optimization selector
+	OptimizationParams map[string]float64
+	// Filters is the ad tag filter pipeline of the link in order, default pipeline is used if it is empty
+	Filters []FilterSettings
+	// Auction configures OpenRTB auction of the link, default settings are used if it is not set
+	Auction *AuctionSettings
+}
+
+// AuctionSettings configures OpenRTB auction, default is used for every setting which is not set
+type AuctionSettings struct {
+	// BidFloorMargin is added to publisher price to get bid floor
+	BidFloorMargin *float64 `json:"bid_floor_margin"`
+	// TimeoutMs limits time DSPs have to respond
+	TimeoutMs *int64 `json:"timeout_ms"`
+}
+
+// Override returns settings with set fields of other replacing these ones, settings are not modified
+func (s *AuctionSettings) Override(other *AuctionSettings) *AuctionSettings {
+	var result AuctionSettings
+	if s != nil {
+		result = *s
+	}
+	if other == nil {
+		return &result
+	}
+	if other.BidFloorMargin != nil {
+		result.BidFloorMargin = other.BidFloorMargin
+	}
+	if other.TimeoutMs != nil {
+		result.TimeoutMs = other.TimeoutMs
+	}
+	return &result
+}
+
+func (s *AuctionSettings) hasNegative() bool {
+	return s != nil && ((s.BidFloorMargin != nil && *s.BidFloorMargin < 0) || (s.TimeoutMs != nil && *s.TimeoutMs < 0))
+}
+
+// ExperimentData splits traffic of publisher links between arms by hash of request or user key.
+// Experiment without publisher links is global, it covers links which are not in an experiment of their own.
+type ExperimentData struct {
+	ID               string   `json:"id"`
+	PublisherLinkIDs []string `json:"publisher_link_ids"`
+	// SplitBy is "request" (default) or "user", user key is IP and user agent. OpenRTB requests are always split by user.
+	SplitBy string          `json:"split_by"`
+	Arms    []ExperimentArm `json:"arms"`
+}
+
+// ExperimentArm gets its weight share of experiment traffic and overrides settings of publisher links,
+// arm without overrides is a control one
+type ExperimentArm struct {
+	Name   string  `json:"name"`
+	Weight float64 `json:"weight"`
+	// Optimization replaces selector of the link, OptimizationParams are added to params of the link
+	Optimization       string             `json:"optimization"`
+	OptimizationParams map[string]float64 `json:"optimization_params"`
+	// Filters replace filter pipeline of the link if they are set
+	Filters []FilterSettings `json:"filters"`
+	// Auction settings which are set replace settings of the link
+	Auction *AuctionSettings `json:"auction"`
+}
+
+// Apply returns publisher link settings with overrides of the arm, the link is not modified
+func (a ExperimentArm) Apply(publisherLink PublisherLinkData) PublisherLinkData {
+	if a.Optimization != "" {
+		publisherLink.Optimization = a.Optimization
+	}
+	if len(a.OptimizationParams) > 0 {
+		params := make(map[string]float64, len(publisherLink.OptimizationParams)+len(a.OptimizationParams))
+		for name, value := range publisherLink.OptimizationParams {
+			params[name] = value
+		}
+		for name, value := range a.OptimizationParams {
+			params[name] = value
+		}
+		publisherLink.OptimizationParams = params
+	}
+	if len(a.Filters) > 0 {
+		publisherLink.Filters = a.Filters
+	}
+	if a.Auction != nil {
+		publisherLink.Auction = publisherLink.Auction.Override(a.Auction)
+	}
+	return publisherLink
+}
+
+// FilterSettings configures one stage of ad tag filter pipeline
+type FilterSettings struct {
+	Name     string
+	Disabled bool
+	// Policy is "reject" (default) or "fallback"
+	Policy string
 }
 
 type AdTagTargeting struct {
@@ -88,57 +191,404 @@ type TotalStatsForLastMonth struct {
 	Requests    int64
 }
 
+// Snapshot is an immutable view of the serving data. Once published it is never
+// modified, so handlers can read it without any locking.
+type Snapshot struct {
+	Data       SyncData
+	LoadedAt   time.Time
+	FetchedAt  time.Time
+	Source     string
+	FromBackup bool
+	Validation ValidationReport
+	Indexes    SnapshotIndexes
+
+	// base is serving data before validation, incremental updates are applied to it
+	base SyncData
+}
+
+// Age shows how old served data is. For snapshots restored from backup
+// it is counted from the moment data was fetched from the primary source.
+func (s *Snapshot) Age() time.Duration {
+	return time.Now().UTC().Sub(s.FetchedAt)
+}
+
+// RefreshStatus describes the outcome of the latest serving data refresh attempts
+type RefreshStatus struct {
+	LastAttempt         time.Time
+	LastSuccess         time.Time
+	LastFullLoad        time.Time
+	LastError           error
+	ConsecutiveFailures int64
+	LastValidation      ValidationReport
+}
+
 type ParsedServingData struct {
-	Data          SyncData
-	AdTagKeys     []string
-	Expiration    int64
-	IsInitialized bool
-	DataWriteLock sync.RWMutex
+	Source    ServingDataSource
+	Backup    *BackupStore
+	Validator *Validator
+	Notifier  ServingDataNotifier
+	// OnChange is called after refresh with the difference between previous and new snapshot
+	OnChange        func(diff SnapshotDiff)
+	RefreshInterval time.Duration
+	RetryInterval   time.Duration
+	// FullReloadInterval limits how long incremental updates are applied without full reload
+	FullReloadInterval time.Duration
+
+	snapshot atomic.Value
+	// refreshLock serializes loads, so snapshots are published in order of their versions
+	refreshLock sync.Mutex
+
+	statusLock sync.RWMutex
+	status     RefreshStatus
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	// refreshDone is closed when background refresh exits, it is nil if refresh was not started
+	refreshDone chan struct{}
+}
+
+func NewParsedServingData(source ServingDataSource, refreshInterval time.Duration) *ParsedServingData {
+	retryInterval := defaultRetryInterval
+	if refreshInterval < retryInterval {
+		retryInterval = refreshInterval
+	}
+	return &ParsedServingData{
+		Source:             source,
+		Validator:          &Validator{MaxQuarantinedRatio: defaultMaxQuarantinedRatio},
+		RefreshInterval:    refreshInterval,
+		RetryInterval:      retryInterval,
+		FullReloadInterval: defaultFullReloadInterval,
+		stop:               make(chan struct{}),
+	}
+}
+
+// Snapshot returns currently published snapshot or nil if data was never loaded
+func (p *ParsedServingData) Snapshot() *Snapshot {
+	snapshot, _ := p.snapshot.Load().(*Snapshot)
+	return snapshot
+}
+
+func (p *ParsedServingData) IsInitialized() bool {
+	return p.Snapshot() != nil
+}
+
+func (p *ParsedServingData) Status() RefreshStatus {
+	p.statusLock.RLock()
+	defer p.statusLock.RUnlock()
+	return p.status
 }
 
-func (p *ParsedServingData) IsExpired() bool {
-	return time.Now().UTC().Unix() >= p.Expiration
+func (p *ParsedServingData) current() (*Snapshot, error) {
+	snapshot := p.Snapshot()
+	if snapshot == nil {
+		return nil, ErrNotInitialized
+	}
+	return snapshot, nil
+}
+
+// Load fetches full serving data and publishes it as a new snapshot.
+// If anything goes wrong previous snapshot stays in place.
+// Older version is published too, so data could be rolled back.
+func (p *ParsedServingData) Load() error {
+	p.refreshLock.Lock()
+	defer p.refreshLock.Unlock()
+	return p.fullLoad(false)
 }
 
-func (p *ParsedServingData) GetNewExpirationTime() int64 {
-	// Default expiration is 59 sec
-	return time.Now().UTC().Unix() + 60
+// fullLoad must be called under refreshLock, older version is rejected if requireNewer is set
+func (p *ParsedServingData) fullLoad(requireNewer bool) error {
+	err := p.load(requireNewer)
+	p.recordAttempt(err, err == nil)
+	return err
 }
 
-func (p *ParsedServingData) CheckData() error {
-	p.DataWriteLock.Lock()
-	defer p.DataWriteLock.Unlock()
-	if !p.IsInitialized || p.IsExpired() {
-		data, err := redis_handler.RedisConnection.Get("serving_data").Bytes()
+// Refresh applies incremental updates when source supports them. Full reload is made
+// if there is no snapshot yet, there are no patches, versions do not line up
+// or FullReloadInterval has passed. Source without patches could still have its full data updated,
+// so finding no patches never counts as a successful refresh.
+func (p *ParsedServingData) Refresh() error {
+	return p.refresh(false)
+}
+
+// refresh is Refresh which rejects older full data if it was triggered by update notification,
+// notifications announce new versions only
+func (p *ParsedServingData) refresh(isNotified bool) error {
+	p.refreshLock.Lock()
+	defer p.refreshLock.Unlock()
+
+	incrementalSource, isIncremental := p.Source.(IncrementalServingDataSource)
+	snapshot := p.Snapshot()
+
+	if !isIncremental || snapshot == nil || time.Since(p.Status().LastFullLoad) >= p.FullReloadInterval {
+		return p.fullLoad(isNotified)
+	}
+
+	isApplied, err := p.applyPatches(incrementalSource, snapshot)
+	if err == nil && !isApplied {
+		return p.fullLoad(isNotified)
+	}
+	if err != nil {
+		log.WithError(err).WithField("version", snapshot.Data.Version).Warn(
+			"Incremental serving data update failed, making full reload",
+		)
+		return p.fullLoad(isNotified)
+	}
+
+	p.recordAttempt(nil, false)
+	return nil
+}
+
+func (p *ParsedServingData) recordAttempt(err error, isFullLoad bool) {
+	p.statusLock.Lock()
+	defer p.statusLock.Unlock()
+
+	p.status.LastAttempt = time.Now().UTC()
+	p.status.LastError = err
+	if err != nil {
+		p.status.ConsecutiveFailures++
+		return
+	}
+	p.status.ConsecutiveFailures = 0
+	p.status.LastSuccess = p.status.LastAttempt
+	if isFullLoad {
+		p.status.LastFullLoad = p.status.LastAttempt
+	}
+}
+
+// applyPatches publishes snapshot with patches applied, false is returned if there were no patches
+func (p *ParsedServingData) applyPatches(source IncrementalServingDataSource, snapshot *Snapshot) (bool, error) {
+	rawPatches, err := source.FetchPatches(snapshot.base.Version)
+	if err != nil {
+		return false, err
+	}
+	if len(rawPatches) == 0 {
+		return false, nil
+	}
+
+	patches := make([]ServingDataPatch, len(rawPatches))
+	for i, rawPatch := range rawPatches {
+		if err = json.Unmarshal(rawPatch, &patches[i]); err != nil {
+			return false, err
+		}
+	}
+	sort.Sort(sortedPatches(patches))
+
+	syncData := snapshot.base
+	for _, patch := range patches {
+		syncData, err = ApplyPatch(syncData, patch)
 		if err != nil {
-			log.Warn("No data in redis")
-			return err
+			return false, err
+		}
+	}
+
+	return true, p.publishSyncData(syncData, source.Name(), time.Now().UTC(), false, true)
+}
+
+func (p *ParsedServingData) load(requireNewer bool) error {
+	raw, err := p.Source.Fetch()
+	if err != nil {
+		return err
+	}
+
+	fetchedAt := time.Now().UTC()
+	if err = p.publish(raw, p.Source.Name(), fetchedAt, false, requireNewer); err != nil {
+		return err
+	}
+
+	if p.Backup != nil {
+		if err = p.Backup.Save(raw, p.Source.Name(), fetchedAt); err != nil {
+			log.WithError(err).WithField("file", p.Backup.Path).Warn("Can't save serving data backup")
+		}
+	}
+	return nil
+}
+
+// Init makes initial load of serving data. If primary source is unavailable
+// last known good data is restored from backup file.
+func (p *ParsedServingData) Init() error {
+	err := p.Load()
+	if err == nil {
+		return nil
+	}
+	log.WithError(err).WithField("source", p.Source.Name()).Warn("Initial serving data load failed")
+
+	if p.Backup == nil {
+		return err
+	}
+
+	p.refreshLock.Lock()
+	defer p.refreshLock.Unlock()
+	backup, err := p.Backup.Load()
+	if err != nil {
+		return err
+	}
+	if err = p.publish(backup.ServingData, backup.Source, backup.FetchedAt, true, false); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"file":       p.Backup.Path,
+		"fetched_at": backup.FetchedAt,
+		"data_age":   p.Snapshot().Age().String(),
+	}).Warn("Serving data restored from backup")
+	return nil
+}
+
+func (p *ParsedServingData) publish(raw []byte, source string, fetchedAt time.Time, fromBackup, requireNewer bool) error {
+	syncData := SyncData{}
+	if err := json.Unmarshal(raw, &syncData); err != nil {
+		return err
+	}
+
+	return p.publishSyncData(syncData, source, fetchedAt, fromBackup, requireNewer)
+}
+
+// publishSyncData must be called under refreshLock. Data older than published one is rejected
+// if requireNewer is set, otherwise it is published as a rollback.
+func (p *ParsedServingData) publishSyncData(
+	base SyncData, source string, fetchedAt time.Time, fromBackup, requireNewer bool,
+) error {
+	previous := p.Snapshot()
+	if previous != nil && base.Version < previous.base.Version {
+		if requireNewer {
+			return fmt.Errorf("%w: published %d, fetched %d", ErrStaleServingData, previous.base.Version, base.Version)
 		}
-		p.Data = SyncData{}
-		json.Unmarshal(data, &p.Data)
-		p.Expiration = p.GetNewExpirationTime()
-		p.IsInitialized = true
+		log.WithFields(log.Fields{
+			"source":            source,
+			"published_version": previous.base.Version,
+			"version":           base.Version,
+		}).Warn("Serving data version went back, publishing older snapshot")
+	}
 
-		//i := 0
-		//p.AdTagKeys = make([]string, len(p.Data))
-		//for key := range p.Data {
-		//	p.AdTagKeys[i] = key
-		//	i++
-		//}
+	syncData, report := p.Validator.Validate(base)
+	report.Source = source
+	logValidationReport(report)
+
+	p.statusLock.Lock()
+	p.status.LastValidation = report
+	p.statusLock.Unlock()
+
+	if report.Rejected {
+		return fmt.Errorf("serving data rejected: %s", report.RejectReason)
 	}
 
+	snapshot := &Snapshot{
+		Data:       syncData,
+		LoadedAt:   time.Now().UTC(),
+		FetchedAt:  fetchedAt,
+		Source:     source,
+		FromBackup: fromBackup,
+		Validation: report,
+		Indexes:    BuildIndexes(syncData),
+		base:       base,
+	}
+	p.snapshot.Store(snapshot)
+
+	if previous != nil {
+		p.notifyAboutChanges(previous, snapshot)
+	}
 	return nil
 }
 
+func (p *ParsedServingData) notifyAboutChanges(previous, current *Snapshot) {
+	diff := DiffSyncData(previous.Data, current.Data)
+	if diff.IsEmpty() {
+		return
+	}
+	diff.Source = current.Source
+	diff.PreviousLoadedAt = previous.LoadedAt
+	diff.LoadedAt = current.LoadedAt
+
+	log.WithField("serving_data_diff", diff).Info("Serving data changed")
+
+	if p.OnChange != nil {
+		p.OnChange(diff)
+	}
+}
+
+func logValidationReport(report ValidationReport) {
+	if !report.HasIssues() {
+		return
+	}
+
+	entry := log.WithField("validation_report", report)
+	if report.Rejected {
+		entry.Error("Serving data snapshot rejected")
+	} else {
+		entry.Warn("Serving data snapshot has invalid entities")
+	}
+}
+
+// StartRefresh reloads serving data in background every RefreshInterval
+// and whenever a watched source or notifier reports changes.
+// After a failed attempt next one is made in RetryInterval.
+func (p *ParsedServingData) StartRefresh() {
+	var changes, notifications <-chan struct{}
+	if watched, ok := p.Source.(WatchedServingDataSource); ok {
+		changes = watched.Changes()
+	}
+	if p.Notifier != nil {
+		notifications = p.Notifier.Notifications()
+	}
+
+	p.refreshDone = make(chan struct{})
+	go func() {
+		defer close(p.refreshDone)
+
+		interval := p.RefreshInterval
+		if p.Status().ConsecutiveFailures > 0 {
+			interval = p.RetryInterval
+		}
+		for {
+			var isNotified bool
+			select {
+			case <-p.stop:
+				return
+			case <-changes:
+			case <-notifications:
+				isNotified = true
+			case <-time.After(interval):
+			}
+
+			if err := p.refresh(isNotified); err != nil {
+				fields := log.Fields{
+					"source":               p.Source.Name(),
+					"consecutive_failures": p.Status().ConsecutiveFailures,
+				}
+				if snapshot := p.Snapshot(); snapshot != nil {
+					fields["data_age"] = snapshot.Age().String()
+					fields["from_backup"] = snapshot.FromBackup
+				}
+				log.WithError(err).WithFields(fields).Warn("Serving data refresh failed, keep serving last snapshot")
+				interval = p.RetryInterval
+			} else {
+				interval = p.RefreshInterval
+			}
+		}
+	}()
+}
+
+// StopRefresh stops background refresh and watching of the source,
+// it returns after refresh in progress is finished
+func (p *ParsedServingData) StopRefresh() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+		if watched, ok := p.Source.(WatchedServingDataSource); ok {
+			watched.Close()
+		}
+	})
+	if p.refreshDone != nil {
+		<-p.refreshDone
+	}
+}
+
 func (p *ParsedServingData) GetAdTagByID(id string) (AdTagData, error) {
-	err := p.CheckData()
+	snapshot, err := p.current()
 	if err != nil {
 		return AdTagData{}, err
 	}
 
-	p.DataWriteLock.RLock()
-	adTag, exists := p.Data.AdTags[id]
-	p.DataWriteLock.RUnlock()
+	adTag, exists := snapshot.Data.AdTags[id]
 
 	if exists {
 		return adTag, nil
@@ -149,28 +599,26 @@ func (p *ParsedServingData) GetAdTagByID(id string) (AdTagData, error) {
 }
 
 func (p *ParsedServingData) GetAllAdTags() (map[string]AdTagData, error) {
-	err := p.CheckData()
+	snapshot, err := p.current()
 	if err != nil {
 		return map[string]AdTagData{}, err
 	}
-	return p.Data.AdTags, nil
+	return snapshot.Data.AdTags, nil
 }
 
 func (p *ParsedServingData) GetAdTagsByIDs(ids []string) (map[string]AdTagData, error) {
 	var result map[string]AdTagData
-	var err error
 
-	err = p.CheckData()
+	snapshot, err := p.current()
 	if err != nil {
 		return result, err
 	}
 
 	result = make(map[string]AdTagData, len(ids))
 
-	var adTag AdTagData
 	for _, id := range ids {
-		adTag, err = p.GetAdTagByID(id)
-		if err == nil {
+		adTag, exists := snapshot.Data.AdTags[id]
+		if exists {
 			result[id] = adTag
 		}
 	}
@@ -181,15 +629,13 @@ func (p *ParsedServingData) GetAdTagsByIDs(ids []string) (map[string]AdTagData,
 func (p *ParsedServingData) GetParametersMapByID(id uint64) (map[string]map[string]ParametersMapping, error) {
 	var result map[string]map[string]ParametersMapping
 
-	err := p.CheckData()
+	snapshot, err := p.current()
 	if err != nil {
 		return result, err
 	}
 
-	p.DataWriteLock.RLock()
 	var exists bool
-	result, exists = p.Data.ParametersMapping[id]
-	p.DataWriteLock.RUnlock()
+	result, exists = snapshot.Data.ParametersMapping[id]
 
 	if !exists {
 		log.Warn(fmt.Sprintf("No data for parameter id %d", id))
@@ -202,25 +648,13 @@ func (p *ParsedServingData) GetParametersMapByID(id uint64) (map[string]map[stri
 func (p *ParsedServingData) GetOurPlatformParametersMapByNameAndID(parameterName string, id uint64, platform string) (ParametersMapping, error) {
 	var result ParametersMapping
 
-	err := p.CheckData()
+	snapshot, err := p.current()
 	if err != nil {
 		return result, err
 	}
 
 	var exists bool
-
-	p.DataWriteLock.RLock()
-	_, exists = p.Data.OurPlatformParametersMapping[parameterName]
-	p.DataWriteLock.RUnlock()
-
-	if !exists {
-		//log.Warn(fmt.Sprintf("No data for parameter name %s", parameterName))
-		return result, errors.New("no data")
-	}
-
-	p.DataWriteLock.RLock()
-	result, exists = p.Data.OurPlatformParametersMapping[parameterName][platform][id]
-	p.DataWriteLock.RUnlock()
+	result, exists = snapshot.Indexes.OurPlatformParameters[ourPlatformParameterKey{parameterName, platform, id}]
 
 	if !exists {
 		//log.Warn(fmt.Sprintf("No data for parameter name %s and platform id %d", parameterName, id))
@@ -232,15 +666,13 @@ func (p *ParsedServingData) GetOurPlatformParametersMapByNameAndID(parameterName
 
 func (p *ParsedServingData) GetPublisherIDByTargetingID(targetingID string) (uint64, error) {
 	var result uint64
-	err := p.CheckData()
+	snapshot, err := p.current()
 	if err != nil {
 		return result, err
 	}
 
-	p.DataWriteLock.RLock()
 	var exists bool
-	result, exists = p.Data.PublisherTargetingIDMap[targetingID]
-	p.DataWriteLock.RUnlock()
+	result, exists = snapshot.Data.PublisherTargetingIDMap[targetingID]
 
 	if !exists {
 		log.Warn(fmt.Sprintf("No data for targeting id %s", targetingID))
@@ -252,15 +684,13 @@ func (p *ParsedServingData) GetPublisherIDByTargetingID(targetingID string) (uin
 
 func (p *ParsedServingData) GetAdTagIDsForPublisherLink(linkID string) ([]string, error) {
 	var result []string
-	err := p.CheckData()
+	snapshot, err := p.current()
 	if err != nil {
 		return result, err
 	}
 
-	p.DataWriteLock.RLock()
 	var exists bool
-	result, exists = p.Data.TargetingLinkAdTagsIDs[linkID]
-	p.DataWriteLock.RUnlock()
+	result, exists = snapshot.Data.TargetingLinkAdTagsIDs[linkID]
 
 	if !exists {
 		log.Warn(fmt.Sprintf("No ad tag ids for publisher link id %s", linkID))
@@ -272,15 +702,13 @@ func (p *ParsedServingData) GetAdTagIDsForPublisherLink(linkID string) ([]string
 
 func (p *ParsedServingData) GetPublisherLinkDataByID(linkID string) (PublisherLinkData, error) {
 	var result PublisherLinkData
-	err := p.CheckData()
+	snapshot, err := p.current()
 	if err != nil {
 		return result, err
 	}
 
-	p.DataWriteLock.RLock()
 	var exists bool
-	result, exists = p.Data.PublisherLinks[linkID]
-	p.DataWriteLock.RUnlock()
+	result, exists = snapshot.Data.PublisherLinks[linkID]
 
 	if !exists {
 		log.Warn(fmt.Sprintf("No data for publisher link id %s", linkID))
@@ -292,14 +720,82 @@ func (p *ParsedServingData) GetPublisherLinkDataByID(linkID string) (PublisherLi
 
 func (p *ParsedServingData) GetDSPAdvertisersList() (map[uint64]AdvertiserData, error) {
 	var result map[uint64]AdvertiserData
-	err := p.CheckData()
+	snapshot, err := p.current()
 	if err != nil {
 		return result, err
 	}
 
-	p.DataWriteLock.RLock()
-	result = p.Data.Advertisers
-	p.DataWriteLock.RUnlock()
+	result = snapshot.Data.Advertisers
 
 	return result, nil
 }
+
+func (p *ParsedServingData) GetAdTagsByPublisherTargetingID(targetingID string) (map[string]AdTagData, error) {
+	var result map[string]AdTagData
+	snapshot, err := p.current()
+	if err != nil {
+		return result, err
+	}
+
+	adTagIDs := snapshot.Indexes.AdTagsByPublisherTargetingID[targetingID]
+	result = make(map[string]AdTagData, len(adTagIDs))
+	for _, id := range adTagIDs {
+		result[id] = snapshot.Data.AdTags[id]
+	}
+
+	return result, nil
+}
+
+func (p *ParsedServingData) GetAdTagIDsByAdvertiserPlatform(platformTypeID uint64) ([]string, error) {
+	snapshot, err := p.current()
+	if err != nil {
+		return nil, err
+	}
+	return snapshot.Indexes.AdTagsByAdvertiserPlatform[platformTypeID], nil
+}
+
+func (p *ParsedServingData) GetAdTagIDsByGeo(ISOCode string) ([]string, error) {
+	snapshot, err := p.current()
+	if err != nil {
+		return nil, err
+	}
+	return snapshot.Indexes.AdTagsByGeo[ISOCode], nil
+}
+
+func (p *ParsedServingData) GetAdTagsForPublisherLink(linkID string) ([]AdTagEntry, error) {
+	var result []AdTagEntry
+	snapshot, err := p.current()
+	if err != nil {
+		return result, err
+	}
+
+	var exists bool
+	result, exists = snapshot.Indexes.PublisherLinkAdTags[linkID]
+
+	if !exists {
+		log.Warn(fmt.Sprintf("No ad tags for publisher link id %s", linkID))
+		return result, errors.New("no data")
+	}
+
+	return result, nil
+}
+
+// GetExperimentForPublisherLink returns experiment of the link or the global one, nil if traffic of the link is not split
+func (p *ParsedServingData) GetExperimentForPublisherLink(linkID string) (*ExperimentData, error) {
+	snapshot, err := p.current()
+	if err != nil {
+		return nil, err
+	}
+
+	experimentID, exists := snapshot.Indexes.ExperimentByPublisherLink[linkID]
+	if !exists {
+		experimentID, exists = snapshot.Indexes.ExperimentByPublisherLink[""]
+	}
+	if !exists {
+		return nil, nil
+	}
+	// Experiment is reported by its key in serving data
+	experiment := snapshot.Data.Experiments[experimentID]
+	experiment.ID = experimentID
+	return &experiment, nil
+}
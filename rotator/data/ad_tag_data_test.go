@@ -0,0 +1,51 @@
+package data
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newVersionedServingData(t *testing.T, version uint64) (*ParsedServingData, *testSource) {
+	source := &testSource{}
+	current := validSyncData()
+	current.Version = version
+	source.set(current)
+
+	servingData := NewParsedServingData(source, time.Hour)
+	if err := servingData.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return servingData, source
+}
+
+func olderSyncData(version uint64) SyncData {
+	older := validSyncData()
+	older.Version = version
+	older.AdTags["1"] = AdTagData{AdTagID: 1, URL: "http://ads.example.com/old", Price: 5, AdvertiserPlatformTypeID: 1}
+	return older
+}
+
+func TestLoadPublishesOlderVersion(t *testing.T) {
+	servingData, source := newVersionedServingData(t, 5)
+
+	source.set(olderSyncData(4))
+	if err := servingData.Load(); err != nil {
+		t.Fatalf("rollback was not published: %s", err)
+	}
+	if version := servingData.Snapshot().Data.Version; version != 4 {
+		t.Errorf("published version is %d", version)
+	}
+}
+
+func TestNotifiedRefreshRejectsOlderVersion(t *testing.T) {
+	servingData, source := newVersionedServingData(t, 5)
+
+	source.set(olderSyncData(4))
+	if err := servingData.refresh(true); !errors.Is(err, ErrStaleServingData) {
+		t.Errorf("older snapshot was published after notification, error %v", err)
+	}
+	if version := servingData.Snapshot().Data.Version; version != 5 {
+		t.Errorf("published version is %d", version)
+	}
+}
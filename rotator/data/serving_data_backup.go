@@ -0,0 +1,62 @@
+package data
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ServingDataBackup is an on-disk copy of raw serving data with its origin
+type ServingDataBackup struct {
+	FetchedAt   time.Time       `json:"fetched_at"`
+	Source      string          `json:"source"`
+	ServingData json.RawMessage `json:"serving_data"`
+}
+
+// BackupStore keeps last successfully loaded serving data on disk,
+// so we could start serving even if primary source is down
+type BackupStore struct {
+	Path string
+}
+
+func (b *BackupStore) Save(raw []byte, source string, fetchedAt time.Time) error {
+	backupJSON, err := json.Marshal(ServingDataBackup{
+		FetchedAt:   fetchedAt,
+		Source:      source,
+		ServingData: raw,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Writing into temporary file first, so reader will never see half written backup
+	tmpFile, err := ioutil.TempFile(filepath.Dir(b.Path), filepath.Base(b.Path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err = tmpFile.Write(backupJSON); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), b.Path)
+}
+
+func (b *BackupStore) Load() (ServingDataBackup, error) {
+	var backup ServingDataBackup
+
+	backupJSON, err := ioutil.ReadFile(b.Path)
+	if err != nil {
+		return backup, err
+	}
+
+	err = json.Unmarshal(backupJSON, &backup)
+	return backup, err
+}
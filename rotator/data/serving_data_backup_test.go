@@ -0,0 +1,108 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type failingSource struct{}
+
+func (failingSource) Name() string {
+	return "failing"
+}
+
+func (failingSource) Fetch() ([]byte, error) {
+	return nil, errors.New("source is down")
+}
+
+func newTestBackup(t *testing.T) (*BackupStore, func()) {
+	dir, err := ioutil.TempDir("", "serving_data_backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &BackupStore{Path: filepath.Join(dir, "serving_data.json")}, func() { os.RemoveAll(dir) }
+}
+
+func TestBackupSaveLoad(t *testing.T) {
+	backup, cleanup := newTestBackup(t)
+	defer cleanup()
+
+	fetchedAt := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	if err := backup.Save([]byte(`{"version":3}`), "redis", fetchedAt); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := backup.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.FetchedAt.Equal(fetchedAt) || loaded.Source != "redis" || string(loaded.ServingData) != `{"version":3}` {
+		t.Errorf("unexpected backup %+v", loaded)
+	}
+}
+
+func TestInitRestoresFromBackup(t *testing.T) {
+	backup, cleanup := newTestBackup(t)
+	defer cleanup()
+
+	source := &testSource{}
+	syncData := validSyncData()
+	syncData.Version = 7
+	source.set(syncData)
+	servingData := NewParsedServingData(source, time.Hour)
+	servingData.Backup = backup
+	if err := servingData.Init(); err != nil {
+		t.Fatal(err)
+	}
+	fetchedAt := servingData.Snapshot().FetchedAt
+
+	// Cold start while primary source is down
+	servingData = NewParsedServingData(failingSource{}, time.Hour)
+	servingData.Backup = backup
+	if err := servingData.Init(); err != nil {
+		t.Fatalf("serving data was not restored from backup: %s", err)
+	}
+
+	snapshot := servingData.Snapshot()
+	if !snapshot.FromBackup || snapshot.Source != "test" || snapshot.Data.Version != 7 {
+		t.Errorf("unexpected snapshot restored from backup: %+v", snapshot)
+	}
+	if !snapshot.FetchedAt.Equal(fetchedAt) {
+		t.Errorf("data age should be counted from %s, got %s", fetchedAt, snapshot.FetchedAt)
+	}
+}
+
+func TestInitDoesNotPublishCorruptBackup(t *testing.T) {
+	backup, cleanup := newTestBackup(t)
+	defer cleanup()
+
+	rejected := validSyncData()
+	for id, adTag := range rejected.AdTags {
+		adTag.URL = ""
+		rejected.AdTags[id] = adTag
+	}
+	rejectedJSON, _ := json.Marshal(rejected)
+
+	for name, content := range map[string][]byte{
+		"not json":              []byte(`{"serving_data": {"ad_tags`),
+		"broken serving data":   []byte(`{"source": "test", "serving_data": "ad_tags"}`),
+		"rejected serving data": append(append([]byte(`{"source": "test", "serving_data": `), rejectedJSON...), '}'),
+	} {
+		if err := ioutil.WriteFile(backup.Path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		servingData := NewParsedServingData(failingSource{}, time.Hour)
+		servingData.Backup = backup
+		if err := servingData.Init(); err == nil {
+			t.Errorf("%s: Init did not fail", name)
+		}
+		if servingData.IsInitialized() {
+			t.Errorf("%s: backup was published", name)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package data
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldChange is a change of a single entity field between two snapshots
+type FieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// EntityDiff lists added, removed and modified entities of one kind
+type EntityDiff struct {
+	Added    []string                 `json:"added,omitempty"`
+	Removed  []string                 `json:"removed,omitempty"`
+	Modified map[string][]FieldChange `json:"modified,omitempty"`
+}
+
+func (d *EntityDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+func (d *EntityDiff) addModified(id string, changes []FieldChange) {
+	if len(changes) == 0 {
+		return
+	}
+	if d.Modified == nil {
+		d.Modified = make(map[string][]FieldChange)
+	}
+	d.Modified[id] = changes
+}
+
+func (d *EntityDiff) sort() {
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+}
+
+// SnapshotDiff describes what was changed in serving data on refresh
+type SnapshotDiff struct {
+	Source             string     `json:"source"`
+	PreviousLoadedAt   time.Time  `json:"previous_loaded_at"`
+	LoadedAt           time.Time  `json:"loaded_at"`
+	AdTags             EntityDiff `json:"ad_tags"`
+	PublisherLinks     EntityDiff `json:"publisher_links"`
+	Advertisers        EntityDiff `json:"advertisers"`
+	PublisherLinkAdTag EntityDiff `json:"publisher_link_ad_tags"`
+	DomainsLists       EntityDiff `json:"domains_lists"`
+	Experiments        EntityDiff `json:"experiments"`
+}
+
+func (d *SnapshotDiff) IsEmpty() bool {
+	return d.AdTags.IsEmpty() && d.PublisherLinks.IsEmpty() && d.Advertisers.IsEmpty() &&
+		d.PublisherLinkAdTag.IsEmpty() && d.DomainsLists.IsEmpty() && d.Experiments.IsEmpty()
+}
+
+// DiffSyncData compares two versions of serving data. Statistics fields
+// (marked with diff:"-" tag) are skipped, they are changed on every sync.
+func DiffSyncData(previous, current SyncData) SnapshotDiff {
+	var diff SnapshotDiff
+
+	for id, adTag := range current.AdTags {
+		previousAdTag, exists := previous.AdTags[id]
+		if !exists {
+			diff.AdTags.Added = append(diff.AdTags.Added, id)
+			continue
+		}
+		diff.AdTags.addModified(id, diffFields(previousAdTag, adTag))
+	}
+	for id := range previous.AdTags {
+		if _, exists := current.AdTags[id]; !exists {
+			diff.AdTags.Removed = append(diff.AdTags.Removed, id)
+		}
+	}
+
+	for id, publisherLink := range current.PublisherLinks {
+		previousPublisherLink, exists := previous.PublisherLinks[id]
+		if !exists {
+			diff.PublisherLinks.Added = append(diff.PublisherLinks.Added, id)
+			continue
+		}
+		diff.PublisherLinks.addModified(id, diffFields(previousPublisherLink, publisherLink))
+	}
+	for id := range previous.PublisherLinks {
+		if _, exists := current.PublisherLinks[id]; !exists {
+			diff.PublisherLinks.Removed = append(diff.PublisherLinks.Removed, id)
+		}
+	}
+
+	for id, advertiser := range current.Advertisers {
+		advertiserID := strconv.FormatUint(id, 10)
+		previousAdvertiser, exists := previous.Advertisers[id]
+		if !exists {
+			diff.Advertisers.Added = append(diff.Advertisers.Added, advertiserID)
+			continue
+		}
+		diff.Advertisers.addModified(advertiserID, diffFields(previousAdvertiser, advertiser))
+	}
+	for id := range previous.Advertisers {
+		if _, exists := current.Advertisers[id]; !exists {
+			diff.Advertisers.Removed = append(diff.Advertisers.Removed, strconv.FormatUint(id, 10))
+		}
+	}
+
+	for linkID, adTagIDs := range current.TargetingLinkAdTagsIDs {
+		previousAdTagIDs, exists := previous.TargetingLinkAdTagsIDs[linkID]
+		if !exists {
+			diff.PublisherLinkAdTag.Added = append(diff.PublisherLinkAdTag.Added, linkID)
+			continue
+		}
+		added, removed := diffStringSets(previousAdTagIDs, adTagIDs)
+		if len(added) > 0 || len(removed) > 0 {
+			diff.PublisherLinkAdTag.addModified(linkID, []FieldChange{
+				{Field: "ad_tag_ids", Old: removed, New: added},
+			})
+		}
+	}
+	for linkID := range previous.TargetingLinkAdTagsIDs {
+		if _, exists := current.TargetingLinkAdTagsIDs[linkID]; !exists {
+			diff.PublisherLinkAdTag.Removed = append(diff.PublisherLinkAdTag.Removed, linkID)
+		}
+	}
+
+	for id, experiment := range current.Experiments {
+		previousExperiment, exists := previous.Experiments[id]
+		if !exists {
+			diff.Experiments.Added = append(diff.Experiments.Added, id)
+			continue
+		}
+		diff.Experiments.addModified(id, diffFields(previousExperiment, experiment))
+	}
+	for id := range previous.Experiments {
+		if _, exists := current.Experiments[id]; !exists {
+			diff.Experiments.Removed = append(diff.Experiments.Removed, id)
+		}
+	}
+
+	diff.DomainsLists.Added, diff.DomainsLists.Removed = diffStringSets(
+		referencedDomainsLists(previous), referencedDomainsLists(current),
+	)
+
+	diff.AdTags.sort()
+	diff.PublisherLinks.sort()
+	diff.Advertisers.sort()
+	diff.PublisherLinkAdTag.sort()
+	diff.DomainsLists.sort()
+	diff.Experiments.sort()
+
+	return diff
+}
+
+// diffFields compares exported fields of two structs of the same type
+func diffFields(previous, current interface{}) []FieldChange {
+	var changes []FieldChange
+
+	previousValue := reflect.ValueOf(previous)
+	currentValue := reflect.ValueOf(current)
+	valueType := currentValue.Type()
+
+	for i := 0; i < valueType.NumField(); i++ {
+		field := valueType.Field(i)
+		if field.PkgPath != "" || field.Tag.Get("diff") == "-" {
+			continue
+		}
+
+		oldValue := previousValue.Field(i).Interface()
+		newValue := currentValue.Field(i).Interface()
+		if reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+
+		changes = append(changes, FieldChange{
+			Field: fieldName(field),
+			Old:   oldValue,
+			New:   newValue,
+		})
+	}
+
+	return changes
+}
+
+func fieldName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
+
+func diffStringSets(previous, current []string) (added []string, removed []string) {
+	previousSet := make(map[string]bool, len(previous))
+	for _, item := range previous {
+		previousSet[item] = true
+	}
+	currentSet := make(map[string]bool, len(current))
+	for _, item := range current {
+		currentSet[item] = true
+		if !previousSet[item] {
+			added = append(added, item)
+		}
+	}
+	for _, item := range previous {
+		if !currentSet[item] {
+			removed = append(removed, item)
+		}
+	}
+	return added, removed
+}
+
+func referencedDomainsLists(syncData SyncData) []string {
+	var result []string
+	seen := make(map[string]bool)
+	add := func(listID uint64, listType string) {
+		if listID == 0 {
+			return
+		}
+		reference := strconv.FormatUint(listID, 10) + ":" + listType
+		if !seen[reference] {
+			seen[reference] = true
+			result = append(result, reference)
+		}
+	}
+
+	for _, adTag := range syncData.AdTags {
+		add(adTag.DomainsListID, adTag.DomainsListType)
+	}
+	for _, publisherLink := range syncData.PublisherLinks {
+		add(publisherLink.DomainsListID, publisherLink.DomainsListType)
+	}
+	return result
+}
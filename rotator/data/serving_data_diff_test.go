@@ -0,0 +1,140 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffSyncData(t *testing.T) {
+	cases := []struct {
+		name     string
+		change   func(syncData *SyncData)
+		expected SnapshotDiff
+	}{
+		{
+			name:     "nothing changed",
+			change:   func(syncData *SyncData) {},
+			expected: SnapshotDiff{},
+		},
+		{
+			name: "ad tag added",
+			change: func(syncData *SyncData) {
+				syncData.AdTags["5"] = AdTagData{AdTagID: 5, URL: "http://ads.example.com/vast", Price: 1}
+			},
+			expected: SnapshotDiff{AdTags: EntityDiff{Added: []string{"5"}}},
+		},
+		{
+			name: "ad tags removed",
+			change: func(syncData *SyncData) {
+				delete(syncData.AdTags, "3")
+				delete(syncData.AdTags, "2")
+			},
+			expected: SnapshotDiff{AdTags: EntityDiff{Removed: []string{"2", "3"}}},
+		},
+		{
+			name: "ad tag modified",
+			change: func(syncData *SyncData) {
+				adTag := syncData.AdTags["1"]
+				adTag.Price = 4
+				syncData.AdTags["1"] = adTag
+			},
+			expected: SnapshotDiff{AdTags: EntityDiff{Modified: map[string][]FieldChange{
+				"1": {{Field: "price", Old: 2.0, New: 4.0}},
+			}}},
+		},
+		{
+			name: "only statistics changed",
+			change: func(syncData *SyncData) {
+				adTag := syncData.AdTags["1"]
+				adTag.ERPRByTargetingID = map[string]ERPRData{"link": {ERPR: 0.5, Requests: 100}}
+				adTag.TotalStats = TotalStatsForLastMonth{}
+				syncData.AdTags["1"] = adTag
+			},
+			expected: SnapshotDiff{},
+		},
+		{
+			name: "publisher link and advertiser changed",
+			change: func(syncData *SyncData) {
+				syncData.PublisherLinks["other"] = PublisherLinkData{ID: "other", Price: 1}
+				delete(syncData.Advertisers, 5)
+			},
+			expected: SnapshotDiff{
+				PublisherLinks: EntityDiff{Added: []string{"other"}},
+				Advertisers:    EntityDiff{Removed: []string{"5"}},
+			},
+		},
+		{
+			name: "ad tags of publisher link changed",
+			change: func(syncData *SyncData) {
+				syncData.TargetingLinkAdTagsIDs["link"] = []string{"1", "2", "3", "5"}
+			},
+			expected: SnapshotDiff{PublisherLinkAdTag: EntityDiff{Modified: map[string][]FieldChange{
+				"link": {{Field: "ad_tag_ids", Old: []string{"4"}, New: []string{"5"}}},
+			}}},
+		},
+		{
+			name: "domains list referenced",
+			change: func(syncData *SyncData) {
+				adTag := syncData.AdTags["1"]
+				adTag.DomainsListID = 7
+				adTag.DomainsListType = "white"
+				syncData.AdTags["1"] = adTag
+			},
+			expected: SnapshotDiff{
+				AdTags: EntityDiff{Modified: map[string][]FieldChange{"1": {
+					{Field: "domains_list_id", Old: uint64(0), New: uint64(7)},
+					{Field: "domains_list_type", Old: "", New: "white"},
+				}}},
+				DomainsLists: EntityDiff{Added: []string{"7:white"}},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		current := validSyncData()
+		c.change(&current)
+		diff := DiffSyncData(validSyncData(), current)
+		if !reflect.DeepEqual(diff, c.expected) {
+			t.Errorf("%s: expected %+v, got %+v", c.name, c.expected, diff)
+		}
+		if diff.IsEmpty() != c.expected.IsEmpty() {
+			t.Errorf("%s: IsEmpty is %v", c.name, diff.IsEmpty())
+		}
+	}
+}
+
+func TestNoChangeNotificationForStatisticsUpdate(t *testing.T) {
+	source := &testSource{}
+	source.set(validSyncData())
+
+	var diffs []SnapshotDiff
+	servingData := NewParsedServingData(source, time.Hour)
+	servingData.OnChange = func(diff SnapshotDiff) {
+		diffs = append(diffs, diff)
+	}
+	if err := servingData.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	updated := validSyncData()
+	adTag := updated.AdTags["1"]
+	adTag.ERPRByTargetingID = map[string]ERPRData{"link": {ERPR: 0.5, Requests: 100}}
+	updated.AdTags["1"] = adTag
+	source.set(updated)
+	if err := servingData.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Fatalf("change was published for statistics update: %+v", diffs)
+	}
+
+	delete(updated.AdTags, "4")
+	source.set(updated)
+	if err := servingData.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || !reflect.DeepEqual(diffs[0].AdTags.Removed, []string{"4"}) {
+		t.Errorf("expected removal of ad tag 4 to be published, got %+v", diffs)
+	}
+}
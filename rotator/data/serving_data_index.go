@@ -0,0 +1,105 @@
+package data
+
+import "sort"
+
+// AdTagEntry is an ad tag joined with its ad tag pub id
+type AdTagEntry struct {
+	ID   string
+	Data AdTagData
+}
+
+type ourPlatformParameterKey struct {
+	Name           string
+	Platform       string
+	PlatformTypeID uint64
+}
+
+// SnapshotIndexes are secondary lookups built once per snapshot,
+// so request handlers do not need to scan all ad tags
+type SnapshotIndexes struct {
+	AdTagsByPublisherTargetingID map[string][]string
+	AdTagsByAdvertiserPlatform   map[uint64][]string
+	// AdTagsByGeo is keyed by country ISO code, world wide ad tags are under "O1"
+	AdTagsByGeo map[string][]string
+	// PublisherLinkAdTags contains existing ad tags of every publisher link
+	PublisherLinkAdTags   map[string][]AdTagEntry
+	OurPlatformParameters map[ourPlatformParameterKey]ParametersMapping
+	// ExperimentByPublisherLink is id of experiment every link is in, global experiment is under ""
+	ExperimentByPublisherLink map[string]string
+}
+
+func BuildIndexes(syncData SyncData) SnapshotIndexes {
+	indexes := SnapshotIndexes{
+		AdTagsByPublisherTargetingID: make(map[string][]string),
+		AdTagsByAdvertiserPlatform:   make(map[uint64][]string),
+		AdTagsByGeo:                  make(map[string][]string),
+		PublisherLinkAdTags:          make(map[string][]AdTagEntry, len(syncData.TargetingLinkAdTagsIDs)),
+		OurPlatformParameters:        make(map[ourPlatformParameterKey]ParametersMapping),
+		ExperimentByPublisherLink:    make(map[string]string),
+	}
+
+	// Sorting ids, so index content does not depend on map iteration order
+	adTagIDs := make([]string, 0, len(syncData.AdTags))
+	for id := range syncData.AdTags {
+		adTagIDs = append(adTagIDs, id)
+	}
+	sort.Strings(adTagIDs)
+
+	for _, id := range adTagIDs {
+		adTag := syncData.AdTags[id]
+		if adTag.PublisherTargetingID != "" {
+			indexes.AdTagsByPublisherTargetingID[adTag.PublisherTargetingID] = append(
+				indexes.AdTagsByPublisherTargetingID[adTag.PublisherTargetingID], id,
+			)
+		}
+		indexes.AdTagsByAdvertiserPlatform[adTag.AdvertiserPlatformTypeID] = append(
+			indexes.AdTagsByAdvertiserPlatform[adTag.AdvertiserPlatformTypeID], id,
+		)
+		for _, ISOCode := range adTag.Targeting.Geo {
+			indexes.AdTagsByGeo[ISOCode] = append(indexes.AdTagsByGeo[ISOCode], id)
+		}
+	}
+
+	for linkID, linkAdTagIDs := range syncData.TargetingLinkAdTagsIDs {
+		entries := make([]AdTagEntry, 0, len(linkAdTagIDs))
+		for _, id := range linkAdTagIDs {
+			adTag, exists := syncData.AdTags[id]
+			if exists {
+				entries = append(entries, AdTagEntry{ID: id, Data: adTag})
+			}
+		}
+		indexes.PublisherLinkAdTags[linkID] = entries
+	}
+
+	for name, platforms := range syncData.OurPlatformParametersMapping {
+		for platform, mappings := range platforms {
+			for platformTypeID, mapping := range mappings {
+				indexes.OurPlatformParameters[ourPlatformParameterKey{name, platform, platformTypeID}] = mapping
+			}
+		}
+	}
+
+	// Link could be in one experiment only, the first one by id is used, validation reports the others
+	for _, id := range sortedExperimentIDs(syncData.Experiments) {
+		linkIDs := syncData.Experiments[id].PublisherLinkIDs
+		if len(linkIDs) == 0 {
+			linkIDs = []string{""}
+		}
+		for _, linkID := range linkIDs {
+			if _, exists := indexes.ExperimentByPublisherLink[linkID]; !exists {
+				indexes.ExperimentByPublisherLink[linkID] = id
+			}
+		}
+	}
+
+	return indexes
+}
+
+func sortedExperimentIDs(experiments map[string]ExperimentData) []string {
+	ids := make([]string, 0, len(experiments))
+	for id := range experiments {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,56 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildIndexes(t *testing.T) {
+	syncData := SyncData{
+		AdTags: map[string]AdTagData{
+			"3": {AdTagID: 3, AdvertiserPlatformTypeID: 1, PublisherTargetingID: "link", Targeting: AdTagTargeting{Geo: []string{"US", "CA"}}},
+			"1": {AdTagID: 1, AdvertiserPlatformTypeID: 1, PublisherTargetingID: "link", Targeting: AdTagTargeting{Geo: []string{"US"}}},
+			"2": {AdTagID: 2, AdvertiserPlatformTypeID: 2, Targeting: AdTagTargeting{Geo: []string{"O1"}}},
+		},
+		TargetingLinkAdTagsIDs: map[string][]string{"link": {"3", "missing", "1"}},
+		OurPlatformParametersMapping: map[string]map[string]map[uint64]ParametersMapping{
+			"cb": {"desktop": {1: {Shortcut: "cachebuster"}}},
+		},
+		Experiments: map[string]ExperimentData{
+			"b":      {ID: "b", PublisherLinkIDs: []string{"link", "other"}},
+			"a":      {ID: "a", PublisherLinkIDs: []string{"link"}},
+			"global": {ID: "global"},
+		},
+	}
+
+	indexes := BuildIndexes(syncData)
+
+	if ids := indexes.AdTagsByPublisherTargetingID["link"]; !reflect.DeepEqual(ids, []string{"1", "3"}) {
+		t.Errorf("unexpected ad tags by publisher targeting id %v", ids)
+	}
+	if _, exists := indexes.AdTagsByPublisherTargetingID[""]; exists {
+		t.Error("ad tags without publisher targeting id should not be indexed")
+	}
+	if ids := indexes.AdTagsByAdvertiserPlatform[1]; !reflect.DeepEqual(ids, []string{"1", "3"}) {
+		t.Errorf("unexpected ad tags by advertiser platform %v", ids)
+	}
+	expectedGeo := map[string][]string{"US": {"1", "3"}, "CA": {"3"}, "O1": {"2"}}
+	if !reflect.DeepEqual(indexes.AdTagsByGeo, expectedGeo) {
+		t.Errorf("unexpected ad tags by geo %v", indexes.AdTagsByGeo)
+	}
+
+	entries := indexes.PublisherLinkAdTags["link"]
+	if len(entries) != 2 || entries[0].ID != "3" || entries[1].ID != "1" || entries[1].Data.AdTagID != 1 {
+		t.Errorf("link ad tags should keep order and skip missing ones, got %+v", entries)
+	}
+
+	key := ourPlatformParameterKey{Name: "cb", Platform: "desktop", PlatformTypeID: 1}
+	if mapping := indexes.OurPlatformParameters[key]; mapping.Shortcut != "cachebuster" {
+		t.Errorf("unexpected our platform parameter %+v", mapping)
+	}
+
+	expectedExperiments := map[string]string{"link": "a", "other": "b", "": "global"}
+	if !reflect.DeepEqual(indexes.ExperimentByPublisherLink, expectedExperiments) {
+		t.Errorf("unexpected experiments by publisher link %v", indexes.ExperimentByPublisherLink)
+	}
+}
@@ -0,0 +1,79 @@
+package data
+
+import (
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/redis_handler"
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-redis/redis"
+)
+
+// ServingDataNotifier tells that serving data was updated upstream
+// and should be reloaded right away instead of waiting for refresh interval
+type ServingDataNotifier interface {
+	Notifications() <-chan struct{}
+	Close() error
+}
+
+// RedisNotifier listens for serving data updates on a redis pub/sub channel
+type RedisNotifier struct {
+	Channel string
+
+	pubSub        *redis.PubSub
+	notifications chan struct{}
+}
+
+func NewRedisNotifier(channel string) *RedisNotifier {
+	n := &RedisNotifier{
+		Channel:       channel,
+		pubSub:        redis_handler.RedisConnection.Subscribe(channel),
+		notifications: make(chan struct{}, 1),
+	}
+	go n.listen()
+	return n
+}
+
+func (n *RedisNotifier) Notifications() <-chan struct{} {
+	return n.notifications
+}
+
+func (n *RedisNotifier) Close() error {
+	return n.pubSub.Close()
+}
+
+func (n *RedisNotifier) listen() {
+	for message := range n.pubSub.Channel() {
+		log.WithFields(log.Fields{
+			"channel": message.Channel,
+			"payload": message.Payload,
+		}).Info("Serving data update notification received")
+		notify(n.notifications)
+	}
+}
+
+// LocalNotifier is an in-process notifier, used in tests and when pub/sub is not available
+type LocalNotifier struct {
+	notifications chan struct{}
+}
+
+func NewLocalNotifier() *LocalNotifier {
+	return &LocalNotifier{notifications: make(chan struct{}, 1)}
+}
+
+func (n *LocalNotifier) Notify() {
+	notify(n.notifications)
+}
+
+func (n *LocalNotifier) Notifications() <-chan struct{} {
+	return n.notifications
+}
+
+func (n *LocalNotifier) Close() error {
+	return nil
+}
+
+// notify never blocks: if reload is already pending there is no need in one more
+func notify(notifications chan struct{}) {
+	select {
+	case notifications <- struct{}{}:
+	default:
+	}
+}
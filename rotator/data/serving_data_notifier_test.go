@@ -0,0 +1,58 @@
+package data
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testSource struct {
+	lock sync.Mutex
+	raw  []byte
+}
+
+func (s *testSource) Name() string {
+	return "test"
+}
+
+func (s *testSource) Fetch() ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.raw, nil
+}
+
+func (s *testSource) set(syncData SyncData) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.raw, _ = json.Marshal(syncData)
+}
+
+func TestReloadOnNotification(t *testing.T) {
+	source := &testSource{}
+	source.set(validSyncData())
+
+	notifier := NewLocalNotifier()
+	servingData := NewParsedServingData(source, time.Hour)
+	servingData.Notifier = notifier
+	if err := servingData.Init(); err != nil {
+		t.Fatal(err)
+	}
+	servingData.StartRefresh()
+	defer servingData.StopRefresh()
+
+	updated := validSyncData()
+	updated.AdTags["1"] = AdTagData{AdTagID: 1, URL: "http://ads.example.com/new", Price: 5, AdvertiserPlatformTypeID: 1}
+	source.set(updated)
+	notifier.Notify()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		adTag, err := servingData.GetAdTagByID("1")
+		if err == nil && adTag.Price == 5 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("serving data was not reloaded after notification")
+}
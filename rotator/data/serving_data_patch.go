@@ -0,0 +1,140 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrPatchVersionMismatch = errors.New("serving data patch does not match current version")
+
+// IncrementalServingDataSource is a source which can provide partial updates
+// on top of a known serving data version
+type IncrementalServingDataSource interface {
+	ServingDataSource
+	// FetchPatches returns raw ServingDataPatch JSONs with version greater than sinceVersion
+	FetchPatches(sinceVersion uint64) ([][]byte, error)
+}
+
+// ServingDataPatch is a partial serving data update which turns BaseVersion into Version.
+// Entities set to null are deleted.
+type ServingDataPatch struct {
+	BaseVersion             uint64                        `json:"base_version"`
+	Version                 uint64                        `json:"version"`
+	AdTags                  map[string]*AdTagData         `json:"ad_tags"`
+	PublisherLinks          map[string]*PublisherLinkData `json:"publisher_links"`
+	Advertisers             map[uint64]*AdvertiserData    `json:"advertisers"`
+	TargetingLinkAdTagsIDs  map[string][]string           `json:"targeting_link_ad_tags_i_ds"`
+	PublisherTargetingIDMap map[string]*uint64            `json:"publisher_targeting_id_map"`
+	Experiments             map[string]*ExperimentData    `json:"experiments"`
+}
+
+type sortedPatches []ServingDataPatch
+
+func (a sortedPatches) Len() int {
+	return len(a)
+}
+func (a sortedPatches) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+func (a sortedPatches) Less(i, j int) bool {
+	return a[i].Version < a[j].Version
+}
+
+// ApplyPatch returns new serving data with patch applied, patch must increase version.
+// Maps touched by patch are copied, so serving data of published snapshots is never modified.
+func ApplyPatch(syncData SyncData, patch ServingDataPatch) (SyncData, error) {
+	if patch.BaseVersion != syncData.Version || patch.Version <= patch.BaseVersion {
+		return syncData, fmt.Errorf(
+			"%w: current %d, patch %d -> %d", ErrPatchVersionMismatch, syncData.Version, patch.BaseVersion, patch.Version,
+		)
+	}
+
+	result := syncData
+	result.Version = patch.Version
+
+	if len(patch.AdTags) > 0 {
+		result.AdTags = make(map[string]AdTagData, len(syncData.AdTags))
+		for id, adTag := range syncData.AdTags {
+			result.AdTags[id] = adTag
+		}
+		for id, adTag := range patch.AdTags {
+			if adTag == nil {
+				delete(result.AdTags, id)
+			} else {
+				result.AdTags[id] = *adTag
+			}
+		}
+	}
+
+	if len(patch.PublisherLinks) > 0 {
+		result.PublisherLinks = make(map[string]PublisherLinkData, len(syncData.PublisherLinks))
+		for id, publisherLink := range syncData.PublisherLinks {
+			result.PublisherLinks[id] = publisherLink
+		}
+		for id, publisherLink := range patch.PublisherLinks {
+			if publisherLink == nil {
+				delete(result.PublisherLinks, id)
+			} else {
+				result.PublisherLinks[id] = *publisherLink
+			}
+		}
+	}
+
+	if len(patch.Advertisers) > 0 {
+		result.Advertisers = make(map[uint64]AdvertiserData, len(syncData.Advertisers))
+		for id, advertiser := range syncData.Advertisers {
+			result.Advertisers[id] = advertiser
+		}
+		for id, advertiser := range patch.Advertisers {
+			if advertiser == nil {
+				delete(result.Advertisers, id)
+			} else {
+				result.Advertisers[id] = *advertiser
+			}
+		}
+	}
+
+	if len(patch.TargetingLinkAdTagsIDs) > 0 {
+		result.TargetingLinkAdTagsIDs = make(map[string][]string, len(syncData.TargetingLinkAdTagsIDs))
+		for linkID, adTagIDs := range syncData.TargetingLinkAdTagsIDs {
+			result.TargetingLinkAdTagsIDs[linkID] = adTagIDs
+		}
+		for linkID, adTagIDs := range patch.TargetingLinkAdTagsIDs {
+			if adTagIDs == nil {
+				delete(result.TargetingLinkAdTagsIDs, linkID)
+			} else {
+				result.TargetingLinkAdTagsIDs[linkID] = adTagIDs
+			}
+		}
+	}
+
+	if len(patch.PublisherTargetingIDMap) > 0 {
+		result.PublisherTargetingIDMap = make(map[string]uint64, len(syncData.PublisherTargetingIDMap))
+		for linkID, publisherID := range syncData.PublisherTargetingIDMap {
+			result.PublisherTargetingIDMap[linkID] = publisherID
+		}
+		for linkID, publisherID := range patch.PublisherTargetingIDMap {
+			if publisherID == nil {
+				delete(result.PublisherTargetingIDMap, linkID)
+			} else {
+				result.PublisherTargetingIDMap[linkID] = *publisherID
+			}
+		}
+	}
+
+	if len(patch.Experiments) > 0 {
+		result.Experiments = make(map[string]ExperimentData, len(syncData.Experiments))
+		for id, experiment := range syncData.Experiments {
+			result.Experiments[id] = experiment
+		}
+		for id, experiment := range patch.Experiments {
+			if experiment == nil {
+				delete(result.Experiments, id)
+			} else {
+				result.Experiments[id] = *experiment
+			}
+		}
+	}
+
+	return result, nil
+}
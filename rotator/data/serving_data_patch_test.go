@@ -0,0 +1,170 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+type testIncrementalSource struct {
+	testSource
+	patches []ServingDataPatch
+}
+
+func (s *testIncrementalSource) FetchPatches(sinceVersion uint64) ([][]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var rawPatches [][]byte
+	for _, patch := range s.patches {
+		if patch.Version > sinceVersion {
+			rawPatch, _ := json.Marshal(patch)
+			rawPatches = append(rawPatches, rawPatch)
+		}
+	}
+	return rawPatches, nil
+}
+
+func (s *testIncrementalSource) addPatches(patches ...ServingDataPatch) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.patches = append(s.patches, patches...)
+}
+
+func newIncrementalServingData(t *testing.T, version uint64) (*ParsedServingData, *testIncrementalSource) {
+	source := &testIncrementalSource{}
+	syncData := validSyncData()
+	syncData.Version = version
+	source.set(syncData)
+
+	servingData := NewParsedServingData(source, time.Hour)
+	if err := servingData.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return servingData, source
+}
+
+func priceOf(t *testing.T, servingData *ParsedServingData, adTagID string) float64 {
+	adTag, err := servingData.GetAdTagByID(adTagID)
+	if err != nil {
+		t.Fatalf("ad tag %s: %s", adTagID, err)
+	}
+	return adTag.Price
+}
+
+func TestApplyPatch(t *testing.T) {
+	syncData := validSyncData()
+	syncData.Version = 1
+
+	result, err := ApplyPatch(syncData, ServingDataPatch{
+		BaseVersion: 1,
+		Version:     2,
+		AdTags: map[string]*AdTagData{
+			"1": {AdTagID: 1, URL: "http://ads.example.com/new", Price: 5, AdvertiserPlatformTypeID: 1},
+			"2": nil,
+			"5": {AdTagID: 5, URL: "http://ads.example.com/added", Price: 1, AdvertiserPlatformTypeID: 1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Version != 2 {
+		t.Errorf("version is %d", result.Version)
+	}
+	if result.AdTags["1"].Price != 5 {
+		t.Error("ad tag was not modified")
+	}
+	if _, exists := result.AdTags["2"]; exists {
+		t.Error("ad tag set to null was not deleted")
+	}
+	if _, exists := result.AdTags["5"]; !exists {
+		t.Error("ad tag was not added")
+	}
+	if len(result.PublisherLinks) != 1 {
+		t.Error("maps not touched by patch should stay in place")
+	}
+	if syncData.AdTags["1"].Price != 2 || len(syncData.AdTags) != 4 {
+		t.Error("original data should not be modified")
+	}
+}
+
+func TestApplyPatchVersionMismatch(t *testing.T) {
+	syncData := validSyncData()
+	syncData.Version = 1
+
+	_, err := ApplyPatch(syncData, ServingDataPatch{BaseVersion: 2, Version: 3})
+	if !errors.Is(err, ErrPatchVersionMismatch) {
+		t.Errorf("patch with gap in versions was applied, error %v", err)
+	}
+
+	_, err = ApplyPatch(syncData, ServingDataPatch{BaseVersion: 1, Version: 1})
+	if !errors.Is(err, ErrPatchVersionMismatch) {
+		t.Errorf("patch not increasing version was applied, error %v", err)
+	}
+}
+
+func TestRefreshAppliesPatchesInOrder(t *testing.T) {
+	servingData, source := newIncrementalServingData(t, 1)
+
+	source.addPatches(
+		ServingDataPatch{BaseVersion: 2, Version: 3, AdTags: map[string]*AdTagData{
+			"1": {AdTagID: 1, URL: "http://ads.example.com/3", Price: 7, AdvertiserPlatformTypeID: 1},
+		}},
+		ServingDataPatch{BaseVersion: 1, Version: 2, AdTags: map[string]*AdTagData{
+			"1": {AdTagID: 1, URL: "http://ads.example.com/2", Price: 5, AdvertiserPlatformTypeID: 1},
+		}},
+	)
+	if err := servingData.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	if version := servingData.Snapshot().Data.Version; version != 3 {
+		t.Errorf("published version is %d", version)
+	}
+	if price := priceOf(t, servingData, "1"); price != 7 {
+		t.Errorf("patches were not applied in order, price is %f", price)
+	}
+}
+
+func TestRefreshReloadsWithoutPatches(t *testing.T) {
+	servingData, source := newIncrementalServingData(t, 1)
+
+	updated := validSyncData()
+	updated.Version = 1
+	updated.AdTags["1"] = AdTagData{AdTagID: 1, URL: "http://ads.example.com/new", Price: 5, AdvertiserPlatformTypeID: 1}
+	source.set(updated)
+
+	if err := servingData.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if price := priceOf(t, servingData, "1"); price != 5 {
+		t.Error("serving data was not reloaded when there were no patches")
+	}
+}
+
+func TestRefreshReloadsOnVersionGap(t *testing.T) {
+	servingData, source := newIncrementalServingData(t, 1)
+
+	updated := validSyncData()
+	updated.Version = 3
+	updated.AdTags["1"] = AdTagData{AdTagID: 1, URL: "http://ads.example.com/new", Price: 5, AdvertiserPlatformTypeID: 1}
+	source.set(updated)
+	source.addPatches(ServingDataPatch{BaseVersion: 2, Version: 3, AdTags: map[string]*AdTagData{
+		"1": {AdTagID: 1, URL: "http://ads.example.com/3", Price: 7, AdvertiserPlatformTypeID: 1},
+	}})
+
+	if err := servingData.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if version := servingData.Snapshot().Data.Version; version != 3 {
+		t.Errorf("published version is %d", version)
+	}
+	if price := priceOf(t, servingData, "1"); price != 5 {
+		t.Errorf("full data should be reloaded on version gap, price is %f", price)
+	}
+	if err := servingData.Status().LastError; err != nil {
+		t.Errorf("recovered refresh reported error %s", err)
+	}
+}
@@ -0,0 +1,177 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/redis_handler"
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-redis/redis"
+)
+
+const servingDataRedisKey = "serving_data"
+
+// ServingDataSource provides raw serving data JSON (SyncData)
+type ServingDataSource interface {
+	Name() string
+	Fetch() ([]byte, error)
+}
+
+// WatchedServingDataSource is a source which knows when its data was changed.
+// Serving data is reloaded on every value received from Changes, watching is stopped by Close.
+type WatchedServingDataSource interface {
+	ServingDataSource
+	Changes() <-chan struct{}
+	Close() error
+}
+
+// NewServingDataSource creates source by its type: redis, file or http
+func NewServingDataSource(sourceType, location string) (ServingDataSource, error) {
+	switch sourceType {
+	case "redis":
+		key := location
+		if key == "" {
+			key = servingDataRedisKey
+		}
+		return &RedisSource{Key: key, PatchesKey: key + "_patches"}, nil
+	case "file":
+		if location == "" {
+			return nil, errors.New("serving data file is not set")
+		}
+		return NewFileSource(location, time.Second), nil
+	case "http":
+		if location == "" {
+			return nil, errors.New("serving data url is not set")
+		}
+		return &HTTPSource{URL: location, Client: &http.Client{Timeout: 10 * time.Second}}, nil
+	}
+	return nil, fmt.Errorf("unknown serving data source %s", sourceType)
+}
+
+// RedisSource reads serving data from a redis key. Incremental updates
+// are kept in a sorted set scored by the version they produce.
+type RedisSource struct {
+	Key        string
+	PatchesKey string
+}
+
+func (s *RedisSource) Name() string {
+	return fmt.Sprintf("redis:%s", s.Key)
+}
+
+func (s *RedisSource) Fetch() ([]byte, error) {
+	return redis_handler.RedisConnection.Get(s.Key).Bytes()
+}
+
+func (s *RedisSource) FetchPatches(sinceVersion uint64) ([][]byte, error) {
+	patches, err := redis_handler.RedisConnection.ZRangeByScore(s.PatchesKey, redis.ZRangeBy{
+		Min: fmt.Sprintf("(%d", sinceVersion),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([][]byte, len(patches))
+	for i, patch := range patches {
+		result[i] = []byte(patch)
+	}
+	return result, nil
+}
+
+// FileSource reads serving data from a local JSON file and polls it for modifications
+type FileSource struct {
+	Path string
+
+	changes   chan struct{}
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewFileSource(path string, pollInterval time.Duration) *FileSource {
+	s := &FileSource{
+		Path:    path,
+		changes: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	// Modification time is taken right away, so changes made after the source was created are not missed
+	var lastModified time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastModified = info.ModTime()
+	}
+	go s.watch(pollInterval, lastModified)
+	return s
+}
+
+func (s *FileSource) Name() string {
+	return fmt.Sprintf("file:%s", s.Path)
+}
+
+func (s *FileSource) Fetch() ([]byte, error) {
+	return ioutil.ReadFile(s.Path)
+}
+
+func (s *FileSource) Changes() <-chan struct{} {
+	return s.changes
+}
+
+// Close stops polling of the file
+func (s *FileSource) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	return nil
+}
+
+func (s *FileSource) watch(pollInterval time.Duration, lastModified time.Time) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(s.Path)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().Equal(lastModified) {
+			continue
+		}
+		lastModified = info.ModTime()
+
+		log.WithField("file", s.Path).Info("Serving data file changed")
+		notify(s.changes)
+	}
+}
+
+// HTTPSource downloads serving data from an url
+type HTTPSource struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s *HTTPSource) Name() string {
+	return fmt.Sprintf("http:%s", s.URL)
+}
+
+func (s *HTTPSource) Fetch() ([]byte, error) {
+	resp, err := s.Client.Get(s.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("serving data url responded with %d", resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,83 @@
+package data
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileSource(t *testing.T) {
+	file, err := ioutil.TempFile("", "serving_data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"version":1}`)
+	file.Close()
+
+	source := NewFileSource(file.Name(), 10*time.Millisecond)
+	defer source.Close()
+
+	raw, err := source.Fetch()
+	if err != nil || string(raw) != `{"version":1}` {
+		t.Fatalf("unexpected fetch result %q, %v", raw, err)
+	}
+
+	modified := time.Now().Add(time.Minute)
+	if err = os.Chtimes(file.Name(), modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-source.Changes():
+	case <-time.After(time.Second):
+		t.Fatal("file modification was not noticed")
+	}
+
+	source.Close()
+	// Closing twice is fine
+	source.Close()
+	// Let the watcher finish a poll which could have started before Close
+	time.Sleep(30 * time.Millisecond)
+	select {
+	case <-source.Changes():
+	default:
+	}
+
+	modified = modified.Add(time.Minute)
+	if err = os.Chtimes(file.Name(), modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-source.Changes():
+		t.Error("file is polled after Close")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHTTPSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/error":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/slow":
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.Write([]byte(`{"version":1}`))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Timeout: 100 * time.Millisecond}
+	raw, err := (&HTTPSource{URL: server.URL + "/ok", Client: client}).Fetch()
+	if err != nil || string(raw) != `{"version":1}` {
+		t.Fatalf("unexpected fetch result %q, %v", raw, err)
+	}
+	if _, err = (&HTTPSource{URL: server.URL + "/error", Client: client}).Fetch(); err == nil {
+		t.Error("error status was not reported")
+	}
+	if _, err = (&HTTPSource{URL: server.URL + "/slow", Client: client}).Fetch(); err == nil {
+		t.Error("timeout was not reported")
+	}
+}
@@ -0,0 +1,303 @@
+package data
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+const (
+	validationActionQuarantined      = "quarantined"
+	validationActionDroppedReference = "dropped_reference"
+	validationActionReported         = "reported"
+)
+
+// ValidationIssue describes one problem found in serving data
+type ValidationIssue struct {
+	Entity string `json:"entity"`
+	ID     string `json:"id"`
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+	Action string `json:"action"`
+}
+
+// ValidationReport is a result of serving data validation.
+// Rejected snapshots are never published.
+type ValidationReport struct {
+	Source                    string            `json:"source"`
+	AdTagsTotal               int               `json:"ad_tags_total"`
+	QuarantinedAdTags         int               `json:"quarantined_ad_tags"`
+	QuarantinedPublisherLinks int               `json:"quarantined_publisher_links"`
+	QuarantinedAdvertisers    int               `json:"quarantined_advertisers"`
+	QuarantinedExperiments    int               `json:"quarantined_experiments"`
+	DroppedReferences         int               `json:"dropped_references"`
+	Rejected                  bool              `json:"rejected"`
+	RejectReason              string            `json:"reject_reason,omitempty"`
+	Issues                    []ValidationIssue `json:"issues"`
+}
+
+func (r *ValidationReport) HasIssues() bool {
+	return len(r.Issues) > 0 || r.Rejected
+}
+
+func (r *ValidationReport) addIssue(entity, id, field, reason, action string) {
+	r.Issues = append(r.Issues, ValidationIssue{
+		Entity: entity,
+		ID:     id,
+		Field:  field,
+		Reason: reason,
+		Action: action,
+	})
+}
+
+// Validator checks referential integrity and value ranges of serving data.
+// Broken entities are quarantined (removed from serving), whole snapshot is
+// rejected if there are no ad tags left or too many of them are broken.
+type Validator struct {
+	MaxQuarantinedRatio float64
+	// KnownFilters are names of ad tag filters, unknown filters of publisher links are reported if it is set
+	KnownFilters []string
+	// KnownSelectors are names of selectors, unknown publisher link optimizations are reported if it is set
+	KnownSelectors []string
+}
+
+// Validate returns copy of serving data without quarantined entities.
+// Original data is not modified.
+func (v *Validator) Validate(syncData SyncData) (SyncData, ValidationReport) {
+	report := ValidationReport{
+		AdTagsTotal: len(syncData.AdTags),
+	}
+
+	result := syncData
+
+	result.AdTags = make(map[string]AdTagData, len(syncData.AdTags))
+	for id, adTag := range syncData.AdTags {
+		if field, reason := v.checkAdTag(adTag, syncData); reason != "" {
+			report.addIssue("ad_tag", id, field, reason, validationActionQuarantined)
+			report.QuarantinedAdTags++
+			continue
+		}
+		result.AdTags[id] = adTag
+	}
+
+	result.PublisherLinks = make(map[string]PublisherLinkData, len(syncData.PublisherLinks))
+	for id, publisherLink := range syncData.PublisherLinks {
+		if field, reason := v.checkPublisherLink(publisherLink); reason != "" {
+			report.addIssue("publisher_link", id, field, reason, validationActionQuarantined)
+			report.QuarantinedPublisherLinks++
+			continue
+		}
+		if _, exists := syncData.PublisherTargetingIDMap[id]; !exists {
+			report.addIssue("publisher_link", id, "publisher_targeting_id_map", "no publisher for link", validationActionReported)
+		}
+		for _, reason := range v.checkFilters(publisherLink.Filters) {
+			report.addIssue("publisher_link", id, "filters", reason, validationActionReported)
+		}
+		if publisherLink.Optimization != "" && len(v.KnownSelectors) > 0 && !containsString(v.KnownSelectors, publisherLink.Optimization) {
+			report.addIssue(
+				"publisher_link", id, "optimization",
+				fmt.Sprintf("unknown optimization %s, default is used", publisherLink.Optimization),
+				validationActionReported,
+			)
+		}
+		result.PublisherLinks[id] = publisherLink
+	}
+
+	result.Advertisers = make(map[uint64]AdvertiserData, len(syncData.Advertisers))
+	for id, advertiser := range syncData.Advertisers {
+		if field, reason := v.checkAdvertiser(advertiser); reason != "" {
+			report.addIssue("advertiser", strconv.FormatUint(id, 10), field, reason, validationActionQuarantined)
+			report.QuarantinedAdvertisers++
+			continue
+		}
+		result.Advertisers[id] = advertiser
+	}
+
+	result.Experiments = make(map[string]ExperimentData, len(syncData.Experiments))
+	experimentByLink := make(map[string]string)
+	for _, id := range sortedExperimentIDs(syncData.Experiments) {
+		experiment := syncData.Experiments[id]
+		if field, reason := v.checkExperiment(experiment); reason != "" {
+			report.addIssue("experiment", id, field, reason, validationActionQuarantined)
+			report.QuarantinedExperiments++
+			continue
+		}
+		for _, reason := range v.checkExperimentReferences(id, experiment, result.PublisherLinks, experimentByLink) {
+			report.addIssue("experiment", id, "publisher_link_ids", reason, validationActionReported)
+		}
+		for _, arm := range experiment.Arms {
+			for _, reason := range v.checkFilters(arm.Filters) {
+				report.addIssue("experiment", id, "arms", fmt.Sprintf("arm %s: %s", arm.Name, reason), validationActionReported)
+			}
+			if arm.Optimization != "" && len(v.KnownSelectors) > 0 && !containsString(v.KnownSelectors, arm.Optimization) {
+				report.addIssue(
+					"experiment", id, "arms",
+					fmt.Sprintf("arm %s: unknown optimization %s, default is used", arm.Name, arm.Optimization),
+					validationActionReported,
+				)
+			}
+		}
+		result.Experiments[id] = experiment
+	}
+
+	result.TargetingLinkAdTagsIDs = make(map[string][]string, len(syncData.TargetingLinkAdTagsIDs))
+	for linkID, adTagIDs := range syncData.TargetingLinkAdTagsIDs {
+		validIDs := make([]string, 0, len(adTagIDs))
+		for _, adTagID := range adTagIDs {
+			if _, exists := result.AdTags[adTagID]; !exists {
+				report.addIssue(
+					"targeting_link", linkID, "ad_tag_ids",
+					fmt.Sprintf("ad tag %s does not exist or quarantined", adTagID),
+					validationActionDroppedReference,
+				)
+				report.DroppedReferences++
+				continue
+			}
+			validIDs = append(validIDs, adTagID)
+		}
+		result.TargetingLinkAdTagsIDs[linkID] = validIDs
+	}
+
+	if len(result.AdTags) == 0 {
+		report.Rejected = true
+		report.RejectReason = "no valid ad tags"
+	} else if report.AdTagsTotal > 0 {
+		quarantinedRatio := float64(report.QuarantinedAdTags) / float64(report.AdTagsTotal)
+		if quarantinedRatio > v.MaxQuarantinedRatio {
+			report.Rejected = true
+			report.RejectReason = fmt.Sprintf(
+				"%.1f%% of ad tags quarantined, allowed %.1f%%", quarantinedRatio*100, v.MaxQuarantinedRatio*100,
+			)
+		}
+	}
+
+	return result, report
+}
+
+func (v *Validator) checkAdTag(adTag AdTagData, syncData SyncData) (string, string) {
+	if adTag.URL == "" {
+		return "url", "empty url"
+	}
+	if parsedURL, err := url.Parse(adTag.URL); err != nil || parsedURL.Host == "" {
+		return "url", "invalid url"
+	}
+	if adTag.Price < 0 {
+		return "price", fmt.Sprintf("negative price %f", adTag.Price)
+	}
+	if _, exists := syncData.ParametersMapping[adTag.AdvertiserPlatformTypeID]; !exists {
+		return "advertiser_platform_type_id", fmt.Sprintf("no parameters mapping for platform %d", adTag.AdvertiserPlatformTypeID)
+	}
+	if reason := checkDomainsList(adTag.DomainsListID, adTag.DomainsListType); reason != "" {
+		return "domains_list_type", reason
+	}
+	return "", ""
+}
+
+func (v *Validator) checkPublisherLink(publisherLink PublisherLinkData) (string, string) {
+	if publisherLink.Price < 0 {
+		return "price", fmt.Sprintf("negative price %f", publisherLink.Price)
+	}
+	if publisherLink.StudyRequests < 0 {
+		return "study_requests", fmt.Sprintf("negative study requests %d", publisherLink.StudyRequests)
+	}
+	if reason := checkDomainsList(publisherLink.DomainsListID, publisherLink.DomainsListType); reason != "" {
+		return "domains_list_type", reason
+	}
+	if publisherLink.Auction.hasNegative() {
+		return "auction", "negative auction settings"
+	}
+	return "", ""
+}
+
+func (v *Validator) checkExperiment(experiment ExperimentData) (string, string) {
+	if experiment.SplitBy != "" && experiment.SplitBy != "request" && experiment.SplitBy != "user" {
+		return "split_by", fmt.Sprintf("unknown split %q", experiment.SplitBy)
+	}
+	if len(experiment.Arms) == 0 {
+		return "arms", "no arms"
+	}
+
+	names := make(map[string]bool, len(experiment.Arms))
+	var totalWeight float64
+	for _, arm := range experiment.Arms {
+		if arm.Name == "" || names[arm.Name] {
+			return "arms", fmt.Sprintf("arm name %q is empty or not unique", arm.Name)
+		}
+		names[arm.Name] = true
+		if arm.Weight < 0 {
+			return "arms", fmt.Sprintf("negative weight %f of arm %s", arm.Weight, arm.Name)
+		}
+		if arm.Auction.hasNegative() {
+			return "arms", fmt.Sprintf("negative auction settings of arm %s", arm.Name)
+		}
+		totalWeight += arm.Weight
+	}
+	if totalWeight == 0 {
+		return "arms", "arms have no weight"
+	}
+	return "", ""
+}
+
+// checkExperimentReferences reports unknown publisher links and links which are already in another experiment,
+// experiments are checked in order of their ids, so the first experiment of a link is the one it is served with
+func (v *Validator) checkExperimentReferences(
+	id string, experiment ExperimentData, publisherLinks map[string]PublisherLinkData, experimentByLink map[string]string,
+) []string {
+	linkIDs := experiment.PublisherLinkIDs
+	if len(linkIDs) == 0 {
+		linkIDs = []string{""}
+	}
+
+	var reasons []string
+	for _, linkID := range linkIDs {
+		if _, exists := publisherLinks[linkID]; linkID != "" && !exists {
+			reasons = append(reasons, fmt.Sprintf("publisher link %s does not exist or quarantined", linkID))
+		}
+		if otherID, exists := experimentByLink[linkID]; exists {
+			reasons = append(reasons, fmt.Sprintf("publisher link %q is already in experiment %s", linkID, otherID))
+			continue
+		}
+		experimentByLink[linkID] = id
+	}
+	return reasons
+}
+
+// checkFilters reports unknown filters, they are skipped, and unknown policies, they act as "reject"
+func (v *Validator) checkFilters(filters []FilterSettings) []string {
+	var reasons []string
+	for _, filter := range filters {
+		if filter.Policy != "" && filter.Policy != "reject" && filter.Policy != "fallback" {
+			reasons = append(reasons, fmt.Sprintf("unknown policy %q of filter %s", filter.Policy, filter.Name))
+		}
+		if len(v.KnownFilters) > 0 && !containsString(v.KnownFilters, filter.Name) {
+			reasons = append(reasons, fmt.Sprintf("unknown filter %s", filter.Name))
+		}
+	}
+	return reasons
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *Validator) checkAdvertiser(advertiser AdvertiserData) (string, string) {
+	if advertiser.RTBIntegrationUrl == "" {
+		return "rtb_url", "empty rtb url"
+	}
+	if parsedURL, err := url.Parse(advertiser.RTBIntegrationUrl); err != nil || parsedURL.Host == "" {
+		return "rtb_url", "invalid rtb url"
+	}
+	return "", ""
+}
+
+func checkDomainsList(listID uint64, listType string) string {
+	if listID > 0 && listType != "white" && listType != "black" {
+		return fmt.Sprintf("unknown domains list type %q", listType)
+	}
+	return ""
+}
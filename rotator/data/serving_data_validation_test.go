@@ -0,0 +1,93 @@
+package data
+
+import "testing"
+
+func validSyncData() SyncData {
+	return SyncData{
+		AdTags: map[string]AdTagData{
+			"1": {AdTagID: 1, URL: "http://ads.example.com/vast?ip=[IP]", Price: 2, AdvertiserPlatformTypeID: 1},
+			"2": {AdTagID: 2, URL: "http://ads.example.com/vast?ua=[UA]", Price: 3, AdvertiserPlatformTypeID: 1},
+			"3": {AdTagID: 3, URL: "http://ads.example.com/vast", Price: 1, AdvertiserPlatformTypeID: 1},
+			"4": {AdTagID: 4, URL: "http://ads.example.com/vast", Price: 1, AdvertiserPlatformTypeID: 1},
+		},
+		ParametersMapping: map[uint64]map[string]map[string]ParametersMapping{
+			1: {},
+		},
+		PublisherTargetingIDMap: map[string]uint64{"link": 10},
+		TargetingLinkAdTagsIDs:  map[string][]string{"link": {"1", "2", "3", "4"}},
+		PublisherLinks:          map[string]PublisherLinkData{"link": {ID: "link", Price: 1}},
+		Advertisers:             map[uint64]AdvertiserData{5: {ID: 5, RTBIntegrationUrl: "http://dsp.example.com/bid"}},
+	}
+}
+
+func TestValidateQuarantinesBrokenEntities(t *testing.T) {
+	syncData := validSyncData()
+	syncData.AdTags["2"] = AdTagData{AdTagID: 2, URL: "", Price: 3, AdvertiserPlatformTypeID: 1}
+	syncData.Advertisers[6] = AdvertiserData{ID: 6}
+
+	validator := &Validator{MaxQuarantinedRatio: 0.5}
+	result, report := validator.Validate(syncData)
+
+	if report.Rejected {
+		t.Fatalf("snapshot should not be rejected: %s", report.RejectReason)
+	}
+	if _, exists := result.AdTags["2"]; exists {
+		t.Error("ad tag with empty url should be quarantined")
+	}
+	if _, exists := result.Advertisers[6]; exists {
+		t.Error("advertiser with empty rtb url should be quarantined")
+	}
+	if len(result.TargetingLinkAdTagsIDs["link"]) != 3 || report.DroppedReferences != 1 {
+		t.Errorf("reference to quarantined ad tag should be dropped, got %v", result.TargetingLinkAdTagsIDs["link"])
+	}
+	if _, exists := syncData.AdTags["2"]; !exists {
+		t.Error("original data should not be modified")
+	}
+}
+
+func TestValidateRejectsSnapshot(t *testing.T) {
+	syncData := validSyncData()
+	syncData.AdTags["1"] = AdTagData{AdTagID: 1, URL: "http://ads.example.com", Price: -1, AdvertiserPlatformTypeID: 1}
+	syncData.AdTags["2"] = AdTagData{AdTagID: 2, URL: "http://ads.example.com", Price: 1, AdvertiserPlatformTypeID: 100}
+
+	validator := &Validator{MaxQuarantinedRatio: 0.25}
+	_, report := validator.Validate(syncData)
+
+	if !report.Rejected {
+		t.Error("snapshot with half of ad tags broken should be rejected")
+	}
+	if report.QuarantinedAdTags != 2 {
+		t.Errorf("expected 2 quarantined ad tags, got %d", report.QuarantinedAdTags)
+	}
+}
+
+func TestValidateExperiments(t *testing.T) {
+	syncData := validSyncData()
+	syncData.Experiments = map[string]ExperimentData{
+		"a": {PublisherLinkIDs: []string{"link"}, Arms: []ExperimentArm{{Name: "control", Weight: 1}}},
+		"b": {PublisherLinkIDs: []string{"link", "unknown"}, Arms: []ExperimentArm{{Name: "control", Weight: 1}}},
+		"c": {Arms: []ExperimentArm{{Name: "control", Weight: 1}, {Name: "control", Weight: 1}}},
+		"d": {SplitBy: "session", Arms: []ExperimentArm{{Name: "control", Weight: 1}}},
+	}
+
+	validator := &Validator{MaxQuarantinedRatio: 0.25}
+	result, report := validator.Validate(syncData)
+
+	if report.QuarantinedExperiments != 2 || len(result.Experiments) != 2 {
+		t.Errorf("experiments with duplicated arms and unknown split should be quarantined, got %v", report.Issues)
+	}
+	var reported int
+	for _, issue := range report.Issues {
+		if issue.Entity == "experiment" && issue.ID == "b" && issue.Action == validationActionReported {
+			reported++
+		}
+	}
+	if reported != 2 {
+		t.Errorf("unknown link and link in another experiment should be reported, got %v", report.Issues)
+	}
+
+	indexes := BuildIndexes(result)
+	if indexes.ExperimentByPublisherLink["link"] != "a" {
+		t.Errorf("link should be in the first experiment, got %q", indexes.ExperimentByPublisherLink["link"])
+	}
+}
@@ -0,0 +1,288 @@
+package rotator
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/admin"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/request_context"
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// debugTraceParam carries "<expires unix>.<signature>", see SignDebugTrace
+	debugTraceParam = "debug_trace"
+	// debugTraceHeader requests a trace together with admin token headers
+	debugTraceHeader = "X-Debug-Trace"
+	// debugSeedParam replays random choices of a logged request, it is used only together with a trace
+	debugSeedParam   = "debug_seed"
+	debugTraceMaxTTL = 24 * time.Hour
+)
+
+// Selection phases of traced candidates. While there are study candidates
+// selector picks one of them uniformly, weighted candidates are used after that.
+const (
+	phaseStudy    = "study"
+	phaseWeighted = "weighted"
+	phaseExcluded = "excluded"
+	phaseFallback = "fallback"
+	phaseAuction  = "auction"
+)
+
+// DebugTraceKey signs debug_trace parameters and authorizes debug trace headers,
+// tracing is disabled while it is empty
+var DebugTraceKey []byte
+
+type decisionTraceResponse struct {
+	RequestID         string                            `json:"request_id"`
+	Endpoint          string                            `json:"endpoint"`
+	TargetingID       string                            `json:"targeting_id,omitempty"`
+	Outcome           string                            `json:"outcome"`
+	Reason            string                            `json:"reason,omitempty"`
+	SelectionStrategy string                            `json:"selection_strategy,omitempty"`
+	SelectedAdTagIDs  []string                          `json:"selected_ad_tag_ids,omitempty"`
+	RandomSeed        int64                             `json:"seed"`
+	Experiment        string                            `json:"experiment,omitempty"`
+	ExperimentArm     string                            `json:"arm,omitempty"`
+	Filters           []filterTrace                     `json:"filters,omitempty"`
+	Candidates        []*request_context.TraceCandidate `json:"candidates"`
+	Response          tracedResponse                    `json:"response"`
+}
+
+type filterTrace struct {
+	Name     string `json:"name"`
+	Passed   int    `json:"passed"`
+	Rejected int    `json:"rejected"`
+}
+
+type tracedResponse struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+	Location    string `json:"location,omitempty"`
+	Body        string `json:"body,omitempty"`
+}
+
+// tracingResponseWriter keeps handler response, it is returned inside the trace by writeDecisionTrace
+type tracingResponseWriter struct {
+	original http.ResponseWriter
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+}
+
+func (w *tracingResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *tracingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *tracingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// startDecisionTrace returns writer which replaces handler response with the decision trace
+// if request asks for it, otherwise w is returned as is
+func startDecisionTrace(w http.ResponseWriter, requestContext *request_context.RequestContext) http.ResponseWriter {
+	if requestContext.Request == nil || !isDebugTraceRequested(requestContext.Request, time.Now()) {
+		return w
+	}
+	requestContext.Decision.StartTrace()
+	return &tracingResponseWriter{original: w, header: make(http.Header)}
+}
+
+// requestRandomSeed returns a new seed, traced requests may replay the seed of a logged request
+func requestRandomSeed(requestContext *request_context.RequestContext) int64 {
+	if requestContext.Decision.Tracing() {
+		seed, err := strconv.ParseInt(requestContext.Request.URL.Query().Get(debugSeedParam), 10, 64)
+		if err == nil {
+			return seed
+		}
+	}
+	return request_context.NewRandomSeed()
+}
+
+func isDebugTraceRequested(r *http.Request, now time.Time) bool {
+	if len(DebugTraceKey) == 0 {
+		return false
+	}
+	if r.Header.Get(debugTraceHeader) != "" {
+		return admin.IsAuthorized(r, DebugTraceKey)
+	}
+
+	value := r.URL.Query().Get(debugTraceParam)
+	if value == "" {
+		return false
+	}
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || now.Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(parts[1]), []byte(debugTraceSignature(r.URL.Path, parts[0])))
+}
+
+// SignDebugTrace returns debug_trace parameter value which enables tracing on path until expires
+func SignDebugTrace(path string, expires time.Time) string {
+	expiresUnix := strconv.FormatInt(expires.Unix(), 10)
+	return fmt.Sprintf("%s.%s", expiresUnix, debugTraceSignature(path, expiresUnix))
+}
+
+func debugTraceSignature(path, expires string) string {
+	mac := hmac.New(sha256.New, DebugTraceKey)
+	mac.Write([]byte(path + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// DebugTraceSignHandler is an admin endpoint returning signed debug_trace parameter,
+// path is the handler path (e.g. /rotator/target/v2), ttl is a duration up to 24h
+func DebugTraceSignHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" || len(DebugTraceKey) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ttl := time.Hour
+	if value := r.URL.Query().Get("ttl"); value != "" {
+		var err error
+		ttl, err = time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if ttl > debugTraceMaxTTL {
+		ttl = debugTraceMaxTTL
+	}
+
+	expires := time.Now().Add(ttl)
+	responseJSON, _ := json.Marshal(map[string]string{
+		"path":    path,
+		"param":   debugTraceParam,
+		"value":   SignDebugTrace(path, expires),
+		"expires": expires.UTC().Format(time.RFC3339),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(responseJSON)
+}
+
+// writeDecisionTrace writes the trace with the response handler would have sent
+func writeDecisionTrace(w *tracingResponseWriter, requestContext *request_context.RequestContext) {
+	decision := requestContext.Decision
+	trace := decisionTraceResponse{
+		RequestID:         requestContext.RequestID.String(),
+		Endpoint:          requestContext.Endpoint,
+		TargetingID:       requestContext.PublisherTargetingID,
+		Outcome:           decision.Outcome,
+		Reason:            decision.Reason,
+		SelectionStrategy: decision.SelectionStrategy,
+		SelectedAdTagIDs:  decision.SelectedAdTagIDs,
+		RandomSeed:        requestContext.RandomSeed,
+		Experiment:        requestContext.Experiment,
+		ExperimentArm:     requestContext.ExperimentArm,
+		Candidates:        decision.Trace.Candidates,
+		Response: tracedResponse{
+			Status:      w.status,
+			ContentType: w.header.Get("Content-Type"),
+			Location:    w.header.Get("Location"),
+			Body:        w.body.String(),
+		},
+	}
+	if trace.Response.Status == 0 {
+		trace.Response.Status = http.StatusOK
+	}
+	for _, filter := range decision.Filters {
+		trace.Filters = append(trace.Filters, filterTrace{Name: filter.Name, Passed: filter.Passed, Rejected: filter.Rejected})
+	}
+
+	responseJSON, err := json.Marshal(trace)
+	if err != nil {
+		log.WithError(err).Warn("Decision trace was not encoded")
+		w.original.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.original.Header().Set("Content-Type", "application/json")
+	w.original.Write(responseJSON)
+}
+
+// traceSelection records how selector weighted candidates, selectors keep weights in AdTagContext
+func traceSelection(requestContext request_context.RequestContext, adTags []*AdTagContext, isFallback bool) {
+	if !requestContext.Decision.Tracing() {
+		return
+	}
+	for _, adTag := range adTags {
+		switch {
+		case isFallback:
+			requestContext.Decision.TraceWeight(adTag.ID, 1, phaseFallback)
+		case adTag.IsPeriodOfStudy:
+			requestContext.Decision.TraceWeight(adTag.ID, 1, phaseStudy)
+		case adTag.SelectionWeight > 0:
+			requestContext.Decision.TraceWeight(adTag.ID, adTag.SelectionWeight, phaseWeighted)
+		default:
+			requestContext.Decision.TraceWeight(adTag.ID, 0, phaseExcluded)
+		}
+	}
+}
+
+// traceSkippedDSPs records DSPs which were not called because the request is traced
+func traceSkippedDSPs(requestContext request_context.RequestContext, dspList map[uint64]data.AdvertiserData) {
+	ids := make([]uint64, 0, len(dspList))
+	for id := range dspList {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		requestContext.Decision.TraceVerdict(fmt.Sprintf("dsp:%d", id), "bid", false, "not called while tracing")
+	}
+}
+
+// traceBidResponses records DSP responses of an auction, DSPs are traced as "dsp:<advertiser id>"
+func traceBidResponses(requestContext request_context.RequestContext, bidResponses []BidResponseItem) {
+	if !requestContext.Decision.Tracing() {
+		return
+	}
+	for _, bidResponse := range bidResponses {
+		if bidResponse.AdvertiserID == 0 {
+			// Response was not parsed, it is logged by collectBidResponses
+			continue
+		}
+
+		id := fmt.Sprintf("dsp:%d", bidResponse.AdvertiserID)
+		switch {
+		case bidResponse.BidTimeout == 1:
+			requestContext.Decision.TraceVerdict(id, "bid", false, "timeout")
+		case bidResponse.BidEmpty == 1:
+			requestContext.Decision.TraceVerdict(id, "bid", false, "empty response")
+		case bidResponse.BidFloorError:
+			requestContext.Decision.TraceVerdict(id, "bid", false, fmt.Sprintf(
+				"bid %.4f is below floor %.4f", bidResponse.BidPrice, bidResponse.BidFloor,
+			))
+		default:
+			requestContext.Decision.TraceVerdict(id, "bid", true, "")
+			requestContext.Decision.TraceWeight(id, bidResponse.BidPrice, phaseAuction)
+		}
+		if bidResponse.BidWin == 1 {
+			requestContext.Decision.TraceSelected(id)
+		}
+	}
+}
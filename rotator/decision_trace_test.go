@@ -0,0 +1,51 @@
+package rotator
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDecisionTraceSignature(t *testing.T) {
+	DebugTraceKey = []byte("secret")
+	defer func() { DebugTraceKey = nil }()
+
+	now := time.Now()
+	value := SignDebugTrace("/rotator/target/v2", now.Add(time.Minute))
+
+	cases := []struct {
+		url       string
+		requested bool
+	}{
+		{"/rotator/target/v2?debug_trace=" + value, true},
+		{"/rotator/target?debug_trace=" + value, false},
+		{"/rotator/target/v2?debug_trace=" + SignDebugTrace("/rotator/target/v2", now.Add(-time.Second)), false},
+		{"/rotator/target/v2?debug_trace=1", false},
+		{"/rotator/target/v2", false},
+	}
+	for _, c := range cases {
+		if requested := isDebugTraceRequested(httptest.NewRequest("GET", c.url, nil), now); requested != c.requested {
+			t.Errorf("%s: expected %v, got %v", c.url, c.requested, requested)
+		}
+	}
+}
+
+func TestDecisionTraceResponse(t *testing.T) {
+	DebugTraceKey = []byte("secret")
+	defer func() { DebugTraceKey = nil }()
+
+	r := httptest.NewRequest("GET", "/rotator", nil)
+	r.Header.Set(debugTraceHeader, "1")
+	r.Header.Set("X-Admin-Token", "secret")
+	w := httptest.NewRecorder()
+	AdRotationHandler(w, r)
+
+	var trace decisionTraceResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &trace); err != nil {
+		t.Fatalf("trace is not JSON: %v, %s", err, w.Body.String())
+	}
+	if trace.Outcome != "rejected" || trace.Reason != reasonInvalidRequest || trace.Response.Status != 204 {
+		t.Errorf("unexpected trace %+v", trace)
+	}
+}
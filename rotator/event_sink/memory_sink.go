@@ -0,0 +1,53 @@
+package event_sink
+
+import "sync"
+
+// MemorySink keeps all events in memory, it is meant for tests
+type MemorySink struct {
+	lock   sync.Mutex
+	events []Event
+}
+
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+func (s *MemorySink) Send(event Event) error {
+	s.lock.Lock()
+	s.events = append(s.events, event)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemorySink) Close() error {
+	return nil
+}
+
+// Events returns copy of received events, optionally only of given types
+func (s *MemorySink) Events(eventTypes ...string) []Event {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result := make([]Event, 0, len(s.events))
+	for _, event := range s.events {
+		if len(eventTypes) == 0 || contains(eventTypes, event.Type) {
+			result = append(result, event)
+		}
+	}
+	return result
+}
+
+func (s *MemorySink) Reset() {
+	s.lock.Lock()
+	s.events = nil
+	s.lock.Unlock()
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package event_sink
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultRoute is used for event types which have no own sink
+const DefaultRoute = "default"
+
+// textSinks write newline-delimited payloads, binary payloads break them
+var textSinks = map[string]bool{"file": true, "stdout": true}
+
+// Router sends every event to the sink configured for its type
+type Router struct {
+	routes map[string]EventSink
+	sinks  []EventSink
+}
+
+func NewRouter(defaultSink EventSink) *Router {
+	r := &Router{routes: make(map[string]EventSink)}
+	r.Route(DefaultRoute, defaultSink)
+	return r
+}
+
+// Route sets sink of an event type
+func (r *Router) Route(eventType string, sink EventSink) {
+	r.routes[eventType] = sink
+	for _, s := range r.sinks {
+		if s == sink {
+			return
+		}
+	}
+	r.sinks = append(r.sinks, sink)
+}
+
+func (r *Router) Send(event Event) error {
+	sink, exists := r.routes[event.Type]
+	if !exists {
+		sink = r.routes[DefaultRoute]
+	}
+	if sink == nil {
+		return nil
+	}
+	return sink.Send(event)
+}
+
+// Close closes every sink once, first error is returned
+func (r *Router) Close() error {
+	var result error
+	for _, sink := range r.sinks {
+		if err := sink.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// ParseRouter builds router from config like
+// "default=kafka,rtb_bid_requests=file:/tmp/bids.ndjson,requests=stdout".
+// Routes with the same sink config share one sink.
+// If binaryPayloads is set, file and stdout sinks are rejected as they need NDJSON.
+func ParseRouter(config string, factories map[string]Factory, binaryPayloads bool) (*Router, error) {
+	router := &Router{routes: make(map[string]EventSink)}
+	sinks := make(map[string]EventSink)
+
+	for _, route := range strings.Split(config, ",") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+
+		parts := strings.SplitN(route, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid event sink route %q", route)
+		}
+		eventType, sinkConfig := parts[0], parts[1]
+
+		sink, exists := sinks[sinkConfig]
+		if !exists {
+			kindAndLocation := strings.SplitN(sinkConfig, ":", 2)
+			factory, exists := factories[kindAndLocation[0]]
+			if !exists {
+				router.Close()
+				return nil, fmt.Errorf("unknown event sink %q", kindAndLocation[0])
+			}
+			if binaryPayloads && textSinks[kindAndLocation[0]] {
+				router.Close()
+				return nil, fmt.Errorf("event sink %q needs json encoding", sinkConfig)
+			}
+			var location string
+			if len(kindAndLocation) == 2 {
+				location = kindAndLocation[1]
+			}
+
+			var err error
+			sink, err = factory(location)
+			if err != nil {
+				router.Close()
+				return nil, fmt.Errorf("event sink %q: %s", sinkConfig, err)
+			}
+			sinks[sinkConfig] = sink
+		}
+		router.Route(eventType, sink)
+	}
+
+	return router, nil
+}
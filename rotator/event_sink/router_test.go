@@ -0,0 +1,32 @@
+package event_sink
+
+import "testing"
+
+func TestParseRouter(t *testing.T) {
+	router, err := ParseRouter("default=memory,rtb_bid_requests=memory:bids", DefaultFactories(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router.Send(Event{Type: "requests", Payload: []byte(`{"rid":"1"}`)})
+	router.Send(Event{Type: "rtb_bid_requests", Payload: []byte(`{"id":"1"}`)})
+	router.Send(Event{Type: "rtb_events", Payload: []byte(`{"id":"1"}`)})
+
+	defaultSink := router.routes[DefaultRoute].(*MemorySink)
+	bidsSink := router.routes["rtb_bid_requests"].(*MemorySink)
+	if len(defaultSink.Events()) != 2 {
+		t.Errorf("default sink got %d events, expected 2", len(defaultSink.Events()))
+	}
+	if len(bidsSink.Events("rtb_bid_requests")) != 1 {
+		t.Errorf("bids sink got %d events, expected 1", len(bidsSink.Events()))
+	}
+
+	if _, err := ParseRouter("default=unknown", DefaultFactories(), false); err == nil {
+		t.Error("unknown sink must not be accepted")
+	}
+	for _, config := range []string{"default=stdout", "default=memory,requests=file:/tmp/requests.ndjson"} {
+		if _, err := ParseRouter(config, DefaultFactories(), true); err == nil {
+			t.Errorf("text sink of %q must not be accepted for binary payloads", config)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package event_sink
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrClosed = errors.New("event sink is closed")
+
+// Event is a serialized analytics message. Type is used for routing
+// and as kafka topic name.
+type Event struct {
+	Type      string
+	Payload   []byte
+	Timestamp time.Time
+	// Keys are candidate partition keys by name, e.g. "request_id" or "publisher_id"
+	Keys map[string]string
+}
+
+// EventSink delivers events. Send must not block request handling for long.
+type EventSink interface {
+	Send(event Event) error
+	Close() error
+}
+
+// Factory creates sink of some kind, location is the part of sink config after ":"
+type Factory func(location string) (EventSink, error)
+
+// DefaultFactories returns factories of sinks which need nothing but this package
+func DefaultFactories() map[string]Factory {
+	return map[string]Factory{
+		"file": func(location string) (EventSink, error) {
+			return NewFileSink(location)
+		},
+		"stdout": func(location string) (EventSink, error) {
+			return NewStdoutSink(), nil
+		},
+		"memory": func(location string) (EventSink, error) {
+			return NewMemorySink(), nil
+		},
+		"discard": func(location string) (EventSink, error) {
+			return DiscardSink{}, nil
+		},
+	}
+}
+
+// DiscardSink drops all events
+type DiscardSink struct{}
+
+func (DiscardSink) Send(event Event) error {
+	return nil
+}
+
+func (DiscardSink) Close() error {
+	return nil
+}
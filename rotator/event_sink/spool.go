@@ -0,0 +1,329 @@
+package event_sink
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spoolSegmentPrefix  = "spool-"
+	spoolSegmentSuffix  = ".ndjson"
+	defaultSegmentBytes = 16 << 20
+	maxSpoolRecordBytes = 16 << 20
+)
+
+var ErrSpoolFull = errors.New("event spool is full")
+
+// SpoolStats describes spool depth and replay progress
+type SpoolStats struct {
+	Segments    int       `json:"segments"`
+	Bytes       int64     `json:"bytes"`
+	MaxBytes    int64     `json:"max_bytes"`
+	Pending     int64     `json:"pending"`
+	Spooled     uint64    `json:"spooled"`
+	Dropped     uint64    `json:"dropped"`
+	Replayed    uint64    `json:"replayed"`
+	LastReplay  time.Time `json:"last_replay"`
+	ReplayError string    `json:"replay_error,omitempty"`
+}
+
+type spoolRecord struct {
+	Type      string            `json:"type"`
+	Timestamp time.Time         `json:"timestamp"`
+	Payload   []byte            `json:"payload"`
+	Keys      map[string]string `json:"keys,omitempty"`
+}
+
+type spoolSegment struct {
+	path   string
+	bytes  int64
+	events int64
+	// replayed events are skipped if replay of the segment is resumed
+	replayed int64
+}
+
+// Spool is an append-only, size-capped on-disk event queue split into segment files.
+// Events are replayed in the order they were appended, delivery is at-least-once:
+// events of a partially replayed segment may be sent again after restart.
+type Spool struct {
+	Dir          string
+	MaxBytes     int64
+	SegmentBytes int64
+
+	lock     sync.Mutex
+	segments []*spoolSegment
+	current  *os.File
+	sequence uint64
+	stats    SpoolStats
+}
+
+// OpenSpool opens spool directory, events left by previous run are kept for replay
+func OpenSpool(dir string, maxBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		Dir:          dir,
+		MaxBytes:     maxBytes,
+		SegmentBytes: defaultSegmentBytes,
+	}
+	if s.SegmentBytes > maxBytes {
+		s.SegmentBytes = maxBytes
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), spoolSegmentPrefix) && strings.HasSuffix(file.Name(), spoolSegmentSuffix) {
+			names = append(names, file.Name())
+		}
+	}
+	// Segment names contain zero padded sequence, so lexical order is append order
+	sort.Strings(names)
+
+	for _, name := range names {
+		segment := &spoolSegment{path: filepath.Join(dir, name)}
+		if err := segment.count(); err != nil {
+			return nil, err
+		}
+		if segment.events == 0 {
+			os.Remove(segment.path)
+			continue
+		}
+		s.segments = append(s.segments, segment)
+
+		var sequence uint64
+		fmt.Sscanf(strings.TrimPrefix(name, spoolSegmentPrefix), "%d", &sequence)
+		if sequence > s.sequence {
+			s.sequence = sequence
+		}
+	}
+
+	return s, nil
+}
+
+// Append writes event to the end of spool, ErrSpoolFull is returned if spool has no space left
+func (s *Spool) Append(event Event) error {
+	line, err := json.Marshal(spoolRecord{
+		Type:      event.Type,
+		Timestamp: event.Timestamp,
+		Payload:   event.Payload,
+		Keys:      event.Keys,
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.bytes()+int64(len(line)) > s.MaxBytes {
+		s.stats.Dropped++
+		return ErrSpoolFull
+	}
+
+	if s.current == nil || s.segments[len(s.segments)-1].bytes+int64(len(line)) > s.SegmentBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.current.Write(line); err != nil {
+		return err
+	}
+	segment := s.segments[len(s.segments)-1]
+	segment.bytes += int64(len(line))
+	segment.events++
+	s.stats.Spooled++
+	return nil
+}
+
+// Pending returns number of events waiting for replay
+func (s *Spool) Pending() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pending()
+}
+
+// Replay sends spooled events oldest first until spool is empty or send fails.
+// Replayed segments are removed. Replay must not be called concurrently.
+func (s *Spool) Replay(send func(Event) error) (int, error) {
+	replayed := 0
+	for {
+		segment := s.nextReplaySegment()
+		if segment == nil {
+			return replayed, nil
+		}
+
+		count, err := s.replaySegment(segment, send)
+		replayed += count
+
+		s.lock.Lock()
+		s.stats.Replayed += uint64(count)
+		s.stats.LastReplay = time.Now()
+		s.stats.ReplayError = ""
+		if err != nil {
+			s.stats.ReplayError = err.Error()
+			s.lock.Unlock()
+			return replayed, err
+		}
+		s.segments = s.segments[1:]
+		os.Remove(segment.path)
+		s.lock.Unlock()
+	}
+}
+
+func (s *Spool) Stats() SpoolStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats := s.stats
+	stats.Segments = len(s.segments)
+	stats.Bytes = s.bytes()
+	stats.MaxBytes = s.MaxBytes
+	stats.Pending = s.pending()
+	return stats
+}
+
+func (s *Spool) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.current == nil {
+		return nil
+	}
+	err := s.current.Close()
+	s.current = nil
+	return err
+}
+
+// nextReplaySegment returns the oldest segment, segment being written is closed first
+func (s *Spool) nextReplaySegment() *spoolSegment {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.segments) == 0 {
+		return nil
+	}
+	if len(s.segments) == 1 && s.current != nil {
+		s.current.Close()
+		s.current = nil
+	}
+	return s.segments[0]
+}
+
+func (s *Spool) replaySegment(segment *spoolSegment, send func(Event) error) (int, error) {
+	file, err := os.Open(segment.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxSpoolRecordBytes)
+
+	var line int64
+	replayed := 0
+	for scanner.Scan() {
+		line++
+		if line <= segment.replayed {
+			continue
+		}
+
+		var record spoolRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// Corrupted record can not be replayed, there is no reason to retry it
+			s.markReplayed(segment, line)
+			continue
+		}
+		err := send(Event{
+			Type:      record.Type,
+			Timestamp: record.Timestamp,
+			Payload:   record.Payload,
+			Keys:      record.Keys,
+		})
+		if err != nil {
+			return replayed, err
+		}
+		s.markReplayed(segment, line)
+		replayed++
+	}
+	return replayed, scanner.Err()
+}
+
+func (s *Spool) markReplayed(segment *spoolSegment, line int64) {
+	s.lock.Lock()
+	segment.replayed = line
+	s.lock.Unlock()
+}
+
+// rotate must be called under lock
+func (s *Spool) rotate() error {
+	if s.current != nil {
+		s.current.Close()
+		s.current = nil
+	}
+
+	s.sequence++
+	path := filepath.Join(s.Dir, fmt.Sprintf("%s%020d%s", spoolSegmentPrefix, s.sequence, spoolSegmentSuffix))
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.current = file
+	s.segments = append(s.segments, &spoolSegment{path: path})
+	return nil
+}
+
+// bytes must be called under lock
+func (s *Spool) bytes() int64 {
+	var total int64
+	for _, segment := range s.segments {
+		total += segment.bytes
+	}
+	return total
+}
+
+// pending must be called under lock
+func (s *Spool) pending() int64 {
+	var total int64
+	for _, segment := range s.segments {
+		total += segment.events - segment.replayed
+	}
+	return total
+}
+
+func (segment *spoolSegment) count() error {
+	file, err := os.Open(segment.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	segment.bytes = info.Size()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxSpoolRecordBytes)
+	for scanner.Scan() {
+		segment.events++
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,94 @@
+package event_sink
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSpoolReplayOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool.SegmentBytes = 256
+
+	for i := 0; i < 20; i++ {
+		if err := spool.Append(Event{Type: "requests", Payload: []byte(fmt.Sprintf(`{"n":%d}`, i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	spool.Close()
+
+	// Spooled events survive restart
+	spool, err = OpenSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spool.Pending() != 20 {
+		t.Fatalf("expected 20 pending events, got %d", spool.Pending())
+	}
+
+	var replayed []string
+	fail := true
+	send := func(event Event) error {
+		if len(replayed) == 5 && fail {
+			fail = false
+			return fmt.Errorf("kafka is down")
+		}
+		replayed = append(replayed, string(event.Payload))
+		return nil
+	}
+	if _, err := spool.Replay(send); err == nil {
+		t.Fatal("replay error expected")
+	}
+	if _, err := spool.Replay(send); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(replayed) != 20 {
+		t.Fatalf("expected 20 replayed events, got %d", len(replayed))
+	}
+	for i, payload := range replayed {
+		if payload != fmt.Sprintf(`{"n":%d}`, i) {
+			t.Errorf("event %d replayed out of order: %s", i, payload)
+		}
+	}
+	if stats := spool.Stats(); stats.Pending != 0 || stats.Segments != 0 {
+		t.Errorf("spool is not empty after replay: %+v", stats)
+	}
+}
+
+func TestSpoolSizeCap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenSpool(dir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	var full bool
+	for i := 0; i < 10; i++ {
+		if spool.Append(Event{Type: "requests", Payload: []byte(`{"rid":"00000000"}`)}) == ErrSpoolFull {
+			full = true
+		}
+	}
+	if !full {
+		t.Fatal("spool must be capped")
+	}
+	if stats := spool.Stats(); stats.Bytes > 200 || stats.Dropped == 0 {
+		t.Errorf("unexpected spool stats %+v", stats)
+	}
+}
@@ -0,0 +1,84 @@
+package event_sink
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// WriterSink writes events as newline-delimited JSON, one payload per line
+type WriterSink struct {
+	lock   sync.Mutex
+	writer *bufio.Writer
+	closer io.Closer
+	closed bool
+	// autoFlush flushes writer after every event
+	autoFlush bool
+}
+
+func NewWriterSink(writer io.Writer, closer io.Closer) *WriterSink {
+	return &WriterSink{
+		writer: bufio.NewWriter(writer),
+		closer: closer,
+	}
+}
+
+// NewFileSink appends events to a file, the file is created if it does not exist
+func NewFileSink(path string) (*WriterSink, error) {
+	if path == "" {
+		return nil, errors.New("event sink file is not set")
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterSink(file, file), nil
+}
+
+// NewStdoutSink writes events to stdout without buffering, so they are seen right away
+func NewStdoutSink() *WriterSink {
+	return &WriterSink{
+		writer:    bufio.NewWriter(os.Stdout),
+		autoFlush: true,
+	}
+}
+
+func (s *WriterSink) Send(event Event) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	if _, err := s.writer.Write(event.Payload); err != nil {
+		return err
+	}
+	if err := s.writer.WriteByte('\n'); err != nil {
+		return err
+	}
+	if s.autoFlush {
+		return s.writer.Flush()
+	}
+	return nil
+}
+
+func (s *WriterSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	err := s.writer.Flush()
+	if s.closer != nil {
+		if closeErr := s.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package rotator
+
+import (
+	"hash/fnv"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/request_context"
+)
+
+const (
+	experimentSplitByUser = "user"
+	// experimentBuckets is the resolution of arm weights
+	experimentBuckets = 10000
+)
+
+// enrollInExperiment assigns request to an arm of the experiment the link is in and applies overrides
+// of the arm to the link. Experiment and arm are recorded in the request context, so every event of the request has them.
+// OpenRTB init and auction of an impression are separate requests with their own ids, so they are split by user key
+// whatever split of the experiment is, this way both of them get the same arm.
+func (p *PublisherLink) enrollInExperiment(requestContext *request_context.RequestContext, isOpenRTB bool) {
+	experiment, err := data.ServingData.GetExperimentForPublisherLink(p.Data.ID)
+	if err != nil || experiment == nil {
+		return
+	}
+
+	arm := experimentArm(*experiment, *requestContext, isOpenRTB || experiment.SplitBy == experimentSplitByUser)
+	requestContext.Experiment = experiment.ID
+	requestContext.ExperimentArm = arm.Name
+	p.Data = arm.Apply(p.Data)
+}
+
+// experimentArm picks arm by hash of the split key, the same key gets the same arm while arm weights are not changed.
+// Experiment id is hashed together with the key, so splits of different experiments are independent.
+// Requests without user key are split by request id.
+func experimentArm(
+	experiment data.ExperimentData, requestContext request_context.RequestContext, splitByUser bool,
+) data.ExperimentArm {
+	key := requestContext.RequestID.String()
+	if splitByUser && requestContext.UserKey() != "" {
+		key = requestContext.UserKey()
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(experiment.ID + ":" + key))
+
+	var totalWeight float64
+	for _, arm := range experiment.Arms {
+		totalWeight += arm.Weight
+	}
+	point := float64(hash.Sum64()%experimentBuckets) / experimentBuckets * totalWeight
+	for _, arm := range experiment.Arms {
+		point -= arm.Weight
+		if point < 0 {
+			return arm
+		}
+	}
+	return experiment.Arms[len(experiment.Arms)-1]
+}
@@ -0,0 +1,129 @@
+package rotator
+
+import (
+	"math"
+	"net"
+	"testing"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/request_context"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestExperimentArmSplit(t *testing.T) {
+	experiment := data.ExperimentData{
+		ID: "exp",
+		Arms: []data.ExperimentArm{
+			{Name: "control", Weight: 3},
+			{Name: "disabled", Weight: 0},
+			{Name: "thompson", Weight: 1, Optimization: strategyThompson},
+		},
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 20000; i++ {
+		counts[experimentArm(experiment, request_context.RequestContext{RequestID: uuid.NewV4()}, false).Name]++
+	}
+	if counts["disabled"] > 0 {
+		t.Errorf("arm without weight got %d requests", counts["disabled"])
+	}
+	if share := float64(counts["thompson"]) / 20000; math.Abs(share-0.25) > 0.02 {
+		t.Errorf("arm with quarter of weight got %.3f of requests", share)
+	}
+
+	user := request_context.UserContext{IP: net.ParseIP("1.2.3.4"), UserAgentString: "Mozilla/5.0"}
+	arm := experimentArm(experiment, request_context.RequestContext{RequestID: uuid.NewV4(), User: user}, true)
+	for i := 0; i < 100; i++ {
+		if other := experimentArm(experiment, request_context.RequestContext{RequestID: uuid.NewV4(), User: user}, true); other.Name != arm.Name {
+			t.Fatalf("user got arms %s and %s", arm.Name, other.Name)
+		}
+	}
+}
+
+func TestEnrollInExperiment(t *testing.T) {
+	bidFloorMargin, bidTimeoutMs := 0.2, int64(150)
+	useServingData(t, data.SyncData{
+		Version: 1,
+		AdTags: map[string]data.AdTagData{
+			"1": {AdTagID: 1, URL: "http://ads.example.com/vast", Price: 1, AdvertiserPlatformTypeID: 1},
+		},
+		ParametersMapping: map[uint64]map[string]map[string]data.ParametersMapping{1: {}},
+		PublisherLinks: map[string]data.PublisherLinkData{
+			"link":  {ID: "link", Optimization: strategyERPR, OptimizationParams: map[string]float64{"max_ad_tags": 5}},
+			"other": {ID: "other"},
+		},
+		Experiments: map[string]data.ExperimentData{
+			"selector": {
+				PublisherLinkIDs: []string{"link"},
+				Arms: []data.ExperimentArm{{
+					Name:               "thompson",
+					Weight:             1,
+					Optimization:       strategyThompson,
+					OptimizationParams: map[string]float64{"prior_weight": 0.5},
+					Auction:            &data.AuctionSettings{BidFloorMargin: &bidFloorMargin, TimeoutMs: &bidTimeoutMs},
+				}},
+			},
+			"global": {Arms: []data.ExperimentArm{{Name: "control", Weight: 1}}},
+		},
+	})
+
+	publisherLink := &PublisherLink{}
+	if err := publisherLink.init("link"); err != nil {
+		t.Fatal(err)
+	}
+	requestContext := request_context.RequestContext{RequestID: uuid.NewV4()}
+	publisherLink.enrollInExperiment(&requestContext, false)
+
+	if requestContext.Experiment != "selector" || requestContext.ExperimentArm != "thompson" {
+		t.Errorf("request is in experiment %q arm %q", requestContext.Experiment, requestContext.ExperimentArm)
+	}
+	name, _, params := selectorForLink(publisherLink.Data, "link")
+	if name != strategyThompson || params.Get("max_ad_tags", 0) != 5 || params.Get("prior_weight", 0) != 0.5 {
+		t.Errorf("arm overrides are not applied: selector %s, params %v", name, params.Params)
+	}
+	if margin, timeout := auctionSettingsForLink(publisherLink.Data); margin != 0.2 || timeout.Seconds() != 0.15 {
+		t.Errorf("arm auction settings are not applied: margin %f, timeout %s", margin, timeout)
+	}
+
+	// Links without own experiment are in the global one
+	if err := publisherLink.init("other"); err != nil {
+		t.Fatal(err)
+	}
+	requestContext = request_context.RequestContext{RequestID: uuid.NewV4()}
+	publisherLink.enrollInExperiment(&requestContext, false)
+	if requestContext.Experiment != "global" || requestContext.ExperimentArm != "control" {
+		t.Errorf("request is in experiment %q arm %q", requestContext.Experiment, requestContext.ExperimentArm)
+	}
+}
+
+func TestEnrollOpenRTBInExperimentByUser(t *testing.T) {
+	useServingData(t, data.SyncData{
+		Version: 1,
+		AdTags: map[string]data.AdTagData{
+			"1": {AdTagID: 1, URL: "http://ads.example.com/vast", Price: 1, AdvertiserPlatformTypeID: 1},
+		},
+		ParametersMapping: map[uint64]map[string]map[string]data.ParametersMapping{1: {}},
+		PublisherLinks:    map[string]data.PublisherLinkData{"link": {ID: "link"}},
+		Experiments: map[string]data.ExperimentData{
+			"auction": {Arms: []data.ExperimentArm{{Name: "control", Weight: 1}, {Name: "fast", Weight: 1}}},
+		},
+	})
+
+	// Init and auction of the same user come with different request ids
+	user := request_context.UserContext{IP: net.ParseIP("1.2.3.4"), UserAgentString: "Mozilla/5.0"}
+	var arm string
+	for i := 0; i < 20; i++ {
+		publisherLink := &PublisherLink{}
+		if err := publisherLink.init("link"); err != nil {
+			t.Fatal(err)
+		}
+		requestContext := request_context.RequestContext{RequestID: uuid.NewV4(), User: user}
+		publisherLink.enrollInExperiment(&requestContext, true)
+		if arm == "" {
+			arm = requestContext.ExperimentArm
+		}
+		if requestContext.ExperimentArm != arm {
+			t.Fatalf("OpenRTB requests of the user got arms %s and %s", arm, requestContext.ExperimentArm)
+		}
+	}
+}
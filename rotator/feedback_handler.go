@@ -0,0 +1,134 @@
+package rotator
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/metrics"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/string_encryption"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/vast"
+	log "github.com/Sirupsen/logrus"
+)
+
+// Feedback events come in the same encrypted form as stats events
+const (
+	feedbackEventRequest    = "request"
+	feedbackEventImpression = "impression"
+	maxFeedbackBodyBytes    = 4 << 20
+)
+
+var feedbackEventsTotal = metrics.NewCounterVec(
+	"rotator_feedback_events_total",
+	"Live feedback events by event and result: accepted, ignored or invalid when received, "+
+		"counted, duplicate or unmatched when matched with requests",
+	"event", "result",
+)
+
+var errUnknownFeedbackEvent = errors.New("unknown feedback event")
+
+type feedbackResponse struct {
+	Accepted int `json:"accepted"`
+	Ignored  int `json:"ignored"`
+	Invalid  int `json:"invalid"`
+}
+
+// FeedbackHandler ingests request and impression events into live Feedback counters, it is served by admin API.
+// Events are encrypted EventParams, the same which are sent to stats domain, so they could not be forged.
+// Event is counted only if the rotator recorded its request, each event of a request is counted once,
+// so replayed events do not change counters.
+// GET request carries one event in "data" param, POST body carries one event per line, it is used to relay events in batches.
+// Requests of VAST responses are counted by the rotator itself, VPAID ones come as request events.
+func FeedbackHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+
+	switch r.Method {
+	case http.MethodGet:
+		if _, err := ingestFeedbackEvent(r.URL.Query().Get("data"), now); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodPost:
+		var response feedbackResponse
+		scanner := bufio.NewScanner(http.MaxBytesReader(w, r.Body, maxFeedbackBodyBytes))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			accepted, err := ingestFeedbackEvent(line, now)
+			switch {
+			case err != nil:
+				response.Invalid++
+			case accepted:
+				response.Accepted++
+			default:
+				response.Ignored++
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.WithError(err).Warn("Feedback body was not read")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		responseJSON, _ := json.Marshal(response)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(responseJSON)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// ingestFeedbackEvent decrypts the event and queues it to be matched with its request,
+// events are ignored while too many of them are pending
+func ingestFeedbackEvent(encrypted string, now time.Time) (bool, error) {
+	event, err := decryptFeedbackEvent(encrypted)
+	if err != nil {
+		feedbackEventsTotal.Inc("", "invalid")
+		return false, err
+	}
+
+	isQueued := Feedback.RecordEvent(FeedbackEvent{
+		RequestID: event.RequestID,
+		AdTagID:   event.AdTagPubID,
+		Name:      event.EventName,
+		Revenue:   event.Price,
+		At:        now,
+	})
+	if !isQueued {
+		feedbackEventsTotal.Inc(event.EventName, "ignored")
+		return false, nil
+	}
+	feedbackEventsTotal.Inc(event.EventName, "accepted")
+	return true, nil
+}
+
+func decryptFeedbackEvent(encrypted string) (vast.EventParams, error) {
+	var event vast.EventParams
+	if encrypted == "" {
+		return event, errors.New("no feedback event")
+	}
+
+	eventJSON, err := stringEncryption.Decrypt(EncryptionKey, encrypted)
+	if err != nil {
+		return event, err
+	}
+	if err = json.Unmarshal(eventJSON, &event); err != nil {
+		return event, err
+	}
+
+	if event.EventName != feedbackEventRequest && event.EventName != feedbackEventImpression {
+		return event, errUnknownFeedbackEvent
+	}
+	if event.RequestID == "" || event.AdTagPubID == "" {
+		return event, errors.New("feedback event has no request id or ad tag")
+	}
+	return event, nil
+}
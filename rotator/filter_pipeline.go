@@ -0,0 +1,140 @@
+package rotator
+
+import (
+	"fmt"
+	"sort"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/request_context"
+)
+
+// Policies of filter pipeline stages
+const (
+	// FilterPolicyReject removes ad tags which failed the filter, it is the default
+	FilterPolicyReject = "reject"
+	// FilterPolicyFallback keeps ad tags which failed only fallback filters as fallback candidates,
+	// they are served only if there are no ad tags which passed all filters
+	FilterPolicyFallback = "fallback"
+)
+
+// Filter checks ad tags of a publisher link against a request
+type Filter interface {
+	Name() string
+	// AppliesTo tells if filter is used for publisher link platform
+	AppliesTo(platform string) bool
+	// Evaluate returns empty string if ad tag passed the filter, otherwise a rejection reason
+	Evaluate(r request_context.RequestContext, adTag *AdTagContext) string
+}
+
+var adTagFilters = make(map[string]Filter)
+
+// defaultFilterSettings is the pipeline of publisher links without own filter settings
+var defaultFilterSettings = []data.FilterSettings{
+	{Name: "price"},
+	{Name: "device_type"},
+	{Name: "required_parameters"},
+	{Name: "domain_lists"},
+	{Name: "geo", Policy: FilterPolicyFallback},
+}
+
+// RegisterFilter makes filter available for pipelines by its name
+func RegisterFilter(filter Filter) {
+	if _, exists := adTagFilters[filter.Name()]; exists {
+		panic(fmt.Sprintf("filter %s is already registered", filter.Name()))
+	}
+	adTagFilters[filter.Name()] = filter
+}
+
+// FilterNames returns names of registered filters, serving data validation reports unknown ones
+func FilterNames() []string {
+	names := make([]string, 0, len(adTagFilters))
+	for name := range adTagFilters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type filterStage struct {
+	filter   Filter
+	fallback bool
+}
+
+// FilterPipeline runs filters in order, see FilterPolicyReject and FilterPolicyFallback
+type FilterPipeline []filterStage
+
+// NewFilterPipeline builds pipeline from settings, unknown and disabled filters are skipped
+func NewFilterPipeline(settings []data.FilterSettings) FilterPipeline {
+	pipeline := make(FilterPipeline, 0, len(settings))
+	for _, stage := range settings {
+		filter, exists := adTagFilters[stage.Name]
+		if !exists || stage.Disabled {
+			continue
+		}
+		pipeline = append(pipeline, filterStage{filter: filter, fallback: stage.Policy == FilterPolicyFallback})
+	}
+	return pipeline
+}
+
+func filterPipelineForLink(publisherLink data.PublisherLinkData) FilterPipeline {
+	if len(publisherLink.Filters) == 0 {
+		return NewFilterPipeline(defaultFilterSettings)
+	}
+	return NewFilterPipeline(publisherLink.Filters)
+}
+
+// Run evaluates ad tags and returns ones which passed all filters. If there are no such ad tags,
+// ad tags which failed only fallback filters are returned and isFallback is true.
+// Fallback filters are evaluated only for ad tags which passed all other filters so far.
+func (p FilterPipeline) Run(
+	requestContext request_context.RequestContext, adTags []*AdTagContext,
+) (result []*AdTagContext, isFallback bool) {
+	for _, stage := range p {
+		if !stage.filter.AppliesTo(requestContext.RequestPlatform) {
+			continue
+		}
+
+		var passed, rejected int
+		for _, adTag := range adTags {
+			if !adTag.AllChecksPassed && (stage.fallback || !adTag.FallbackOnly) {
+				continue
+			}
+
+			reason := stage.filter.Evaluate(requestContext, adTag)
+			requestContext.Decision.TraceVerdict(adTag.ID, stage.filter.Name(), reason == "", reason)
+			if reason == "" {
+				if adTag.AllChecksPassed {
+					passed++
+				}
+				continue
+			}
+			if adTag.AllChecksPassed {
+				rejected++
+			}
+			adTag.AllChecksPassed = false
+			adTag.FallbackOnly = stage.fallback
+		}
+		requestContext.Decision.AddFilter(stage.filter.Name(), passed, rejected)
+	}
+
+	var fallback []*AdTagContext
+	for _, adTag := range adTags {
+		if adTag.AllChecksPassed {
+			result = append(result, adTag)
+		} else if adTag.FallbackOnly {
+			fallback = append(fallback, adTag)
+		}
+	}
+	if len(result) == 0 && len(fallback) > 0 {
+		return fallback, true
+	}
+	return result, false
+}
+
+// rejection formats rejection reason of a filter, it is formatted only for traced requests
+func rejection(r request_context.RequestContext, format string, args ...interface{}) string {
+	if !r.Decision.Tracing() {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
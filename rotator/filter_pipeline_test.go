@@ -0,0 +1,66 @@
+package rotator
+
+import (
+	"testing"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/request_context"
+)
+
+// rejectIDsFilter rejects ad tags by id
+type rejectIDsFilter struct {
+	anyPlatform
+	name string
+	ids  map[string]bool
+}
+
+func (f rejectIDsFilter) Name() string {
+	return f.name
+}
+
+func (f rejectIDsFilter) Evaluate(r request_context.RequestContext, adTag *AdTagContext) string {
+	if f.ids[adTag.ID] {
+		return "rejected"
+	}
+	return ""
+}
+
+func newAdTagContexts(ids ...string) []*AdTagContext {
+	adTags := make([]*AdTagContext, len(ids))
+	for i, id := range ids {
+		adTags[i] = &AdTagContext{ID: id, AllChecksPassed: true}
+	}
+	return adTags
+}
+
+func TestFilterPipelineFallback(t *testing.T) {
+	hard := rejectIDsFilter{name: "test_hard", ids: map[string]bool{"a": true}}
+	soft := rejectIDsFilter{name: "test_soft", ids: map[string]bool{"b": true, "c": true}}
+	adTagFilters[hard.name] = hard
+	adTagFilters[soft.name] = soft
+	defer delete(adTagFilters, hard.name)
+	defer delete(adTagFilters, soft.name)
+
+	requestContext := request_context.RequestContext{Decision: &request_context.Decision{}}
+
+	// Fallback filter runs first, still ad tags rejected by the hard filter are not fallback candidates
+	pipeline := NewFilterPipeline([]data.FilterSettings{
+		{Name: "test_soft", Policy: FilterPolicyFallback},
+		{Name: "test_hard"},
+		{Name: "unknown"},
+	})
+	result, isFallback := pipeline.Run(requestContext, newAdTagContexts("a", "b", "c", "d"))
+	if isFallback || len(result) != 1 || result[0].ID != "d" {
+		t.Errorf("expected d to pass, got %v fallback %v", adTagContextIDs(result), isFallback)
+	}
+
+	result, isFallback = pipeline.Run(requestContext, newAdTagContexts("a", "b", "c"))
+	if !isFallback || len(result) != 2 || result[0].ID != "b" || result[1].ID != "c" {
+		t.Errorf("expected b and c as fallback, got %v fallback %v", adTagContextIDs(result), isFallback)
+	}
+
+	disabled := NewFilterPipeline([]data.FilterSettings{{Name: "test_hard", Disabled: true}})
+	if result, _ = disabled.Run(requestContext, newAdTagContexts("a")); len(result) != 1 {
+		t.Errorf("disabled filter rejected ad tag")
+	}
+}
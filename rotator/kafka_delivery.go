@@ -0,0 +1,363 @@
+package rotator
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/event_sink"
+	"github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// Payload of every kafkaErrorLogSampleRate-th failed message is logged
+	kafkaErrorLogSampleRate = 100
+	kafkaErrorLogPayloadMax = 1024
+	// Delivery is unhealthy if there were errors and no successes during this period
+	kafkaUnhealthyAfter = time.Minute
+	// Spooled messages are replayed no more often than this
+	kafkaSpoolReplayInterval = time.Second
+)
+
+// KafkaTopicDeliveryStats counts messages of a topic by outcome
+type KafkaTopicDeliveryStats struct {
+	Delivered uint64 `json:"delivered"`
+	Failed    uint64 `json:"failed"`
+	Dropped   uint64 `json:"dropped"`
+	Spooled   uint64 `json:"spooled"`
+}
+
+// KafkaDeliveryHealth is a delivery status snapshot
+type KafkaDeliveryHealth struct {
+	Healthy        bool                               `json:"healthy"`
+	LastSuccess    time.Time                          `json:"last_success"`
+	LastError      time.Time                          `json:"last_error"`
+	LastErrorText  string                             `json:"last_error_text,omitempty"`
+	Buffered       int                                `json:"buffered"`
+	BufferCapacity int                                `json:"buffer_capacity"`
+	Topics         map[string]KafkaTopicDeliveryStats `json:"topics"`
+	Spool          *event_sink.SpoolStats             `json:"spool,omitempty"`
+}
+
+type kafkaDelivery struct {
+	producer sarama.AsyncProducer
+	buffer   chan *sarama.ProducerMessage
+	pumpDone chan struct{}
+	stopOnce sync.Once
+	// bufferLock guards buffer from being closed while a message is sent to it
+	bufferLock sync.RWMutex
+	closed     bool
+	// spool keeps messages which can not be delivered right now, it is optional
+	spool      *event_sink.Spool
+	stopReplay chan struct{}
+	replayDone chan struct{}
+	// consumers of producer errors and successes exit once producer closes their channels
+	consumers sync.WaitGroup
+
+	lock          sync.Mutex
+	topics        map[string]*KafkaTopicDeliveryStats
+	lastSuccess   time.Time
+	lastError     time.Time
+	lastErrorText string
+	failedCount   uint64
+}
+
+var delivery *kafkaDelivery
+
+// StartKafkaDelivery starts feeding KafkaProducer from a bounded buffer of bufferSize messages
+// and consuming its errors and successes. Successes are consumed only if
+// Producer.Return.Successes is enabled in producer config.
+// If spool is set, messages which can not be delivered are written to it
+// and replayed in order when kafka recovers.
+func StartKafkaDelivery(bufferSize int, consumeSuccesses bool, spool *event_sink.Spool) {
+	delivery = &kafkaDelivery{
+		producer:   KafkaProducer,
+		buffer:     make(chan *sarama.ProducerMessage, bufferSize),
+		pumpDone:   make(chan struct{}),
+		spool:      spool,
+		stopReplay: make(chan struct{}),
+		replayDone: make(chan struct{}),
+		topics:     make(map[string]*KafkaTopicDeliveryStats),
+	}
+
+	go delivery.pump()
+	delivery.startConsumer("kafka_errors", delivery.consumeErrors)
+	if consumeSuccesses {
+		delivery.startConsumer("kafka_successes", delivery.consumeSuccesses)
+	}
+	if spool != nil {
+		go delivery.replay()
+	} else {
+		close(delivery.replayDone)
+	}
+}
+
+// CloseKafkaProducer sends buffered messages to producer and closes it,
+// pending messages are flushed by producer, undelivered ones are spooled.
+// Producer is closed asynchronously, so its errors are read by consumeErrors only,
+// and spool is closed after consumers exit.
+func CloseKafkaProducer() error {
+	if delivery == nil {
+		return KafkaProducer.Close()
+	}
+
+	delivery.stopOnce.Do(func() {
+		close(delivery.stopReplay)
+		<-delivery.replayDone
+
+		delivery.bufferLock.Lock()
+		delivery.closed = true
+		close(delivery.buffer)
+		delivery.bufferLock.Unlock()
+	})
+	<-delivery.pumpDone
+
+	delivery.producer.AsyncClose()
+	delivery.consumers.Wait()
+	if delivery.spool == nil {
+		return nil
+	}
+	return delivery.spool.Close()
+}
+
+// GetKafkaDeliveryHealth returns current delivery status
+func GetKafkaDeliveryHealth() KafkaDeliveryHealth {
+	if delivery == nil {
+		return KafkaDeliveryHealth{}
+	}
+	return delivery.health()
+}
+
+func KafkaDeliveryHealthHandler(w http.ResponseWriter, r *http.Request) {
+	health := GetKafkaDeliveryHealth()
+	responseJSON, err := json.Marshal(health)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !health.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(responseJSON)
+}
+
+// sendToKafka never blocks request handling: if buffer is full message is spooled or dropped.
+// While spool is not empty or kafka is unhealthy new messages go to the spool too,
+// so they are delivered in order. Messages sent after producer is closed are dropped.
+func sendToKafka(message *sarama.ProducerMessage) {
+	if delivery == nil {
+		KafkaProducer.Input() <- message
+		return
+	}
+
+	delivery.bufferLock.RLock()
+	defer delivery.bufferLock.RUnlock()
+	if delivery.closed {
+		delivery.count(message.Topic, func(stats *KafkaTopicDeliveryStats) {
+			stats.Dropped++
+		})
+		return
+	}
+
+	if delivery.spool != nil && (delivery.spool.Pending() > 0 || !delivery.healthy()) {
+		delivery.toSpool(message)
+		return
+	}
+
+	select {
+	case delivery.buffer <- message:
+	default:
+		delivery.toSpool(message)
+	}
+}
+
+// toSpool writes message to the spool, message is dropped if there is no spool or it is full
+func (d *kafkaDelivery) toSpool(message *sarama.ProducerMessage) {
+	event, isEvent := message.Metadata.(event_sink.Event)
+	if d.spool == nil || !isEvent || d.spool.Append(event) != nil {
+		d.count(message.Topic, func(stats *KafkaTopicDeliveryStats) {
+			stats.Dropped++
+		})
+		return
+	}
+	d.count(message.Topic, func(stats *KafkaTopicDeliveryStats) {
+		stats.Spooled++
+	})
+}
+
+// replay moves spooled messages to producer once kafka is healthy again
+func (d *kafkaDelivery) replay() {
+	defer close(d.replayDone)
+
+	stopped := errors.New("replay stopped")
+	for {
+		select {
+		case <-d.stopReplay:
+			return
+		case <-time.After(kafkaSpoolReplayInterval):
+		}
+
+		if d.spool.Pending() == 0 || !d.healthy() {
+			continue
+		}
+
+		replayed, err := d.spool.Replay(func(event event_sink.Event) error {
+			// Replay stops as soon as kafka fails again, remaining messages are kept in the spool
+			if !d.healthy() {
+				return errors.New("kafka is unhealthy")
+			}
+			select {
+			case d.buffer <- newKafkaMessage(event):
+				return nil
+			case <-d.stopReplay:
+				return stopped
+			}
+		})
+
+		logEntry := log.WithFields(log.Fields{
+			"replayed": replayed,
+			"pending":  d.spool.Pending(),
+		})
+		if err != nil && err != stopped {
+			logEntry.WithError(err).Warn("Kafka spool replay interrupted")
+		} else if replayed > 0 {
+			logEntry.Info("Kafka spool replayed")
+		}
+	}
+}
+
+func (d *kafkaDelivery) pump() {
+	defer close(d.pumpDone)
+	for message := range d.buffer {
+		d.producer.Input() <- message
+	}
+}
+
+func (d *kafkaDelivery) startConsumer(name string, consumer func()) {
+	d.consumers.Add(1)
+	go func() {
+		defer d.consumers.Done()
+		supervise(name, consumer)
+	}()
+}
+
+func (d *kafkaDelivery) consumeErrors() {
+	for producerError := range d.producer.Errors() {
+		topic := producerError.Msg.Topic
+
+		d.toSpool(producerError.Msg)
+
+		d.lock.Lock()
+		d.stats(topic).Failed++
+		d.failedCount++
+		d.lastError = time.Now()
+		d.lastErrorText = producerError.Err.Error()
+		logPayload := d.failedCount%kafkaErrorLogSampleRate == 1
+		d.lock.Unlock()
+
+		if logPayload {
+			entry := log.WithError(producerError.Err).WithField("topic", topic)
+			if producerError.Msg.Value != nil {
+				payload, err := producerError.Msg.Value.Encode()
+				if err == nil {
+					if len(payload) > kafkaErrorLogPayloadMax {
+						payload = payload[:kafkaErrorLogPayloadMax]
+					}
+					entry = entry.WithField("payload", string(payload))
+				}
+			}
+			entry.Warn("Kafka message was not delivered")
+		}
+	}
+}
+
+func (d *kafkaDelivery) consumeSuccesses() {
+	for message := range d.producer.Successes() {
+		d.lock.Lock()
+		d.stats(message.Topic).Delivered++
+		d.lastSuccess = time.Now()
+		d.lock.Unlock()
+	}
+}
+
+func (d *kafkaDelivery) count(topic string, update func(stats *KafkaTopicDeliveryStats)) {
+	d.lock.Lock()
+	update(d.stats(topic))
+	d.lock.Unlock()
+}
+
+// stats must be called under lock
+func (d *kafkaDelivery) stats(topic string) *KafkaTopicDeliveryStats {
+	stats, exists := d.topics[topic]
+	if !exists {
+		stats = &KafkaTopicDeliveryStats{}
+		d.topics[topic] = stats
+	}
+	return stats
+}
+
+func (d *kafkaDelivery) health() KafkaDeliveryHealth {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	health := KafkaDeliveryHealth{
+		LastSuccess:    d.lastSuccess,
+		LastError:      d.lastError,
+		LastErrorText:  d.lastErrorText,
+		Buffered:       len(d.buffer),
+		BufferCapacity: cap(d.buffer),
+		Topics:         make(map[string]KafkaTopicDeliveryStats, len(d.topics)),
+	}
+	for topic, stats := range d.topics {
+		health.Topics[topic] = *stats
+	}
+	if d.spool != nil {
+		spoolStats := d.spool.Stats()
+		health.Spool = &spoolStats
+	}
+
+	health.Healthy = d.brokersHealthy() && (cap(d.buffer) == 0 || len(d.buffer) < cap(d.buffer))
+	return health
+}
+
+func (d *kafkaDelivery) healthy() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.brokersHealthy()
+}
+
+// brokersHealthy tells if kafka accepts messages judging by delivery results, must be called under lock
+func (d *kafkaDelivery) brokersHealthy() bool {
+	return d.lastError.IsZero() ||
+		d.lastSuccess.After(d.lastError) ||
+		time.Since(d.lastError) > kafkaUnhealthyAfter
+}
+
+// supervise restarts consumer if it panics, consumer returning normally means its channel was closed
+func supervise(name string, consumer func()) {
+	for {
+		if !runSupervised(name, consumer) {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func runSupervised(name string, consumer func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithFields(log.Fields{
+				"consumer": name,
+				"panic":    r,
+			}).Error("Consumer panicked, restarting")
+			panicked = true
+		}
+	}()
+	consumer()
+	return false
+}
@@ -0,0 +1,238 @@
+package rotator
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/event_sink"
+	"github.com/Shopify/sarama"
+)
+
+// fakeProducer delivers or fails messages like sarama.AsyncProducer, it does not read input until released
+type fakeProducer struct {
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+	release   chan struct{}
+	closeOnce sync.Once
+
+	lock      sync.Mutex
+	isFailing bool
+}
+
+func newFakeProducer(isStalled bool) *fakeProducer {
+	p := &fakeProducer{
+		input:     make(chan *sarama.ProducerMessage),
+		successes: make(chan *sarama.ProducerMessage, 100),
+		errors:    make(chan *sarama.ProducerError, 100),
+		release:   make(chan struct{}),
+	}
+	if !isStalled {
+		close(p.release)
+	}
+	go p.run()
+	return p
+}
+
+func (p *fakeProducer) run() {
+	<-p.release
+	for message := range p.input {
+		p.lock.Lock()
+		isFailing := p.isFailing
+		p.lock.Unlock()
+
+		if isFailing {
+			p.errors <- &sarama.ProducerError{Msg: message, Err: errors.New("kafka is down")}
+		} else {
+			p.successes <- message
+		}
+	}
+	close(p.errors)
+	close(p.successes)
+}
+
+func (p *fakeProducer) setFailing(isFailing bool) {
+	p.lock.Lock()
+	p.isFailing = isFailing
+	p.lock.Unlock()
+}
+
+func (p *fakeProducer) AsyncClose() {
+	p.closeOnce.Do(func() { close(p.input) })
+}
+
+func (p *fakeProducer) Close() error {
+	p.AsyncClose()
+	for range p.errors {
+	}
+	return nil
+}
+
+func (p *fakeProducer) Input() chan<- *sarama.ProducerMessage {
+	return p.input
+}
+
+func (p *fakeProducer) Successes() <-chan *sarama.ProducerMessage {
+	return p.successes
+}
+
+func (p *fakeProducer) Errors() <-chan *sarama.ProducerError {
+	return p.errors
+}
+
+func startTestDelivery(producer *fakeProducer, bufferSize int, spool *event_sink.Spool) func() {
+	KafkaProducer = producer
+	StartKafkaDelivery(bufferSize, true, spool)
+	return func() {
+		CloseKafkaProducer()
+		KafkaProducer = nil
+		delivery = nil
+	}
+}
+
+func openTestSpool(t *testing.T) (*event_sink.Spool, string) {
+	dir, err := ioutil.TempDir("", "kafka_spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool, err := event_sink.OpenSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spool, dir
+}
+
+func sendTestMessages(count int) {
+	for i := 0; i < count; i++ {
+		sendToKafka(newKafkaMessage(event_sink.Event{Type: EventTypeRequests, Payload: []byte(`{}`)}))
+	}
+}
+
+func waitForDelivery(t *testing.T, description string, condition func(health KafkaDeliveryHealth) bool) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if condition(GetKafkaDeliveryHealth()) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%s: %+v", description, GetKafkaDeliveryHealth())
+}
+
+func TestKafkaDeliveryNeverBlocks(t *testing.T) {
+	producer := newFakeProducer(true)
+	stop := startTestDelivery(producer, 2, nil)
+	defer stop()
+
+	// Pump takes the first message and waits for producer input
+	sendTestMessages(1)
+	waitForDelivery(t, "pump did not take a message", func(health KafkaDeliveryHealth) bool {
+		return health.Buffered == 0
+	})
+
+	sent := make(chan struct{})
+	go func() {
+		sendTestMessages(10)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("sending blocked while producer is stalled")
+	}
+
+	health := GetKafkaDeliveryHealth()
+	if health.Healthy || health.Buffered != 2 {
+		t.Errorf("full buffer should make delivery unhealthy: %+v", health)
+	}
+	if dropped := health.Topics[EventTypeRequests].Dropped; dropped != 8 {
+		t.Errorf("messages over the buffer should be dropped, %d dropped", dropped)
+	}
+
+	close(producer.release)
+	waitForDelivery(t, "buffered messages were not delivered", func(health KafkaDeliveryHealth) bool {
+		return health.Topics[EventTypeRequests].Delivered == 3
+	})
+}
+
+func TestKafkaDeliverySpoolsWhenUnhealthy(t *testing.T) {
+	spool, dir := openTestSpool(t)
+	defer os.RemoveAll(dir)
+	producer := newFakeProducer(false)
+	producer.setFailing(true)
+	stop := startTestDelivery(producer, 10, spool)
+	defer stop()
+
+	sendTestMessages(1)
+	waitForDelivery(t, "failed message was not spooled", func(health KafkaDeliveryHealth) bool {
+		return health.Topics[EventTypeRequests].Spooled == 1
+	})
+
+	// Kafka is unhealthy after the error, new messages go to the spool right away
+	sendTestMessages(2)
+	health := GetKafkaDeliveryHealth()
+	stats := health.Topics[EventTypeRequests]
+	if health.Healthy || stats.Failed != 1 || stats.Spooled != 3 || spool.Pending() != 3 {
+		t.Errorf("messages should be spooled while kafka is unhealthy: %+v", health)
+	}
+}
+
+func TestKafkaDeliveryHealth(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name        string
+		lastSuccess time.Time
+		lastError   time.Time
+		healthy     bool
+	}{
+		{name: "no errors", lastSuccess: now, healthy: true},
+		{name: "recent error", lastSuccess: now.Add(-time.Second), lastError: now, healthy: false},
+		{name: "success after error", lastSuccess: now, lastError: now.Add(-time.Second), healthy: true},
+		{name: "old error", lastError: now.Add(-2 * kafkaUnhealthyAfter), healthy: true},
+	}
+	for _, c := range cases {
+		d := &kafkaDelivery{
+			buffer:      make(chan *sarama.ProducerMessage, 1),
+			topics:      make(map[string]*KafkaTopicDeliveryStats),
+			lastSuccess: c.lastSuccess,
+			lastError:   c.lastError,
+		}
+		if healthy := d.health().Healthy; healthy != c.healthy {
+			t.Errorf("%s: healthy is %v", c.name, healthy)
+		}
+	}
+}
+
+func TestCloseKafkaProducerSpoolsUndelivered(t *testing.T) {
+	spool, dir := openTestSpool(t)
+	defer os.RemoveAll(dir)
+	producer := newFakeProducer(true)
+	stop := startTestDelivery(producer, 10, spool)
+	defer stop()
+
+	sendTestMessages(3)
+	producer.setFailing(true)
+	close(producer.release)
+	if err := CloseKafkaProducer(); err != nil {
+		t.Fatal(err)
+	}
+
+	sendTestMessages(1)
+	stats := GetKafkaDeliveryHealth().Topics[EventTypeRequests]
+	if stats.Failed != 3 || stats.Spooled != 3 || stats.Dropped != 1 {
+		t.Errorf("undelivered messages should be spooled on close, later ones dropped: %+v", stats)
+	}
+
+	// Spool was closed after all failed messages were written to it
+	spool, err := event_sink.OpenSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	if spool.Pending() != 3 {
+		t.Errorf("expected 3 spooled messages after restart, got %d", spool.Pending())
+	}
+}
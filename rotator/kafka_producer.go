@@ -5,6 +5,12 @@ import (
 
 	"encoding/json"
 
+	"fmt"
+	"strconv"
+	"strings"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/event_sink"
 	"bitbucket.org/tapgerine/traffic_rotator/rotator/message_format"
 	"bitbucket.org/tapgerine/traffic_rotator/rotator/request_context"
 	"github.com/Shopify/sarama"
@@ -12,67 +18,104 @@ import (
 	"github.com/satori/go.uuid"
 )
 
+const (
+	EventTypeRequests           = "requests"
+	EventTypeRequestsTargeting  = "requests_targeting"
+	EventTypeRTBEvents          = "rtb_events"
+	EventTypeRTBBidRequests     = "rtb_bid_requests"
+	EventTypeServingDataChanges = "serving_data_changes"
+	EventTypeRequestEvents      = "request_events"
+)
+
+// Partition key strategies, every strategy except KafkaKeyNone is a name of Event key
+const (
+	KafkaKeyNone         = "none"
+	KafkaKeyRequestID    = "request_id"
+	KafkaKeyPublisherID  = "publisher_id"
+	KafkaKeyTargetingID  = "targeting_id"
+	KafkaKeyAdvertiserID = "advertiser_id"
+)
+
 var (
 	KafkaProducer sarama.AsyncProducer
+	// Events receives all analytics events, see event_sink.ParseRouter for per event type configuration
+	Events event_sink.EventSink = event_sink.DiscardSink{}
+	// KafkaPartitionKeys is a key strategy by topic. Messages of the same request
+	// land in the same partition, so consumers can rely on ordering per request.
+	KafkaPartitionKeys = map[string]string{event_sink.DefaultRoute: KafkaKeyRequestID}
+	// EventEncoding is used for messages with versioned schema, other messages are always JSON
+	EventEncoding = message_format.EncodingJSON
 )
 
-type KafkaRequestMessageFormat struct {
-	MessageType string `json:"message_type"`
-	AdTagPubID  string `json:"adpid"`
-	RequestID   string `json:"rid"`
-	Timestamp   int64  `json:"timestamp"`
-	RequestType string `json:"rtype"`
-	GeoCountry  string `json:"geo_country"`
-	DeviceType  string `json:"device_type"`
-	PublisherID uint64 `json:"publisher_id"`
-	TargetingID string `json:"targeting_id"`
-	Domain      string `json:"domain"`
-	AppName     string `json:"app_name"`
-	BundleID    string `json:"bundle_id"`
+// ParseKafkaPartitionKeys parses config like "default=request_id,rtb_bid_requests=publisher_id"
+func ParseKafkaPartitionKeys(config string) (map[string]string, error) {
+	strategies := make(map[string]string)
+	for _, topicStrategy := range strings.Split(config, ",") {
+		topicStrategy = strings.TrimSpace(topicStrategy)
+		if topicStrategy == "" {
+			continue
+		}
+
+		parts := strings.SplitN(topicStrategy, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid kafka partition key %q", topicStrategy)
+		}
+		switch parts[1] {
+		case KafkaKeyNone, KafkaKeyRequestID, KafkaKeyPublisherID, KafkaKeyTargetingID, KafkaKeyAdvertiserID:
+			strategies[parts[0]] = parts[1]
+		default:
+			return nil, fmt.Errorf("unknown kafka partition key strategy %q", parts[1])
+		}
+	}
+	return strategies, nil
 }
 
-//type KafkaRTBEventsMessageFormat struct {
-//	ID             string  `json:"id"`
-//	PublisherID    uint64  `json:"pid"`
-//	TargetingID    string  `json:"tid"`
-//	EventName      string  `json:"e"`
-//	PublisherPrice float64 `json:"price"`
-//	Timestamp      int64   `json:"timestamp"`
-//	GeoCountry     string  `json:"geo_country"`
-//	DeviceType     string  `json:"device_type"`
-//	Domain         string  `json:"domain"`
-//	AppName        string  `json:"app_name"`
-//	BundleID       string  `json:"bundle_id"`
-//}
-
-type KafkaRTBBidRequestsMessageFormat struct {
-	ID                 string  `json:"id"`
-	PublisherID        uint64  `json:"pid"`
-	TargetingID        string  `json:"tid"`
-	PublisherPrice     float64 `json:"price"`
-	Timestamp          int64   `json:"timestamp"`
-	AdvertiserID       uint64  `json:"advertiser_id"`
-	BidResponse        int8    `json:"bid_response"`
-	BidResponseTime    int64   `json:"bid_response_time"`
-	BidResponseTimeout int8    `json:"bid_response_timeout"`
-	BidResponseEmpty   int8    `json:"bid_response_empty"`
-	BidResponseError   string  `json:"bid_response_error"`
-	BidWin             int8    `json:"bid_win"`
-	BidFloorPrice      float64 `json:"bid_floor_price"`
-	BidPrice           float64 `json:"bid_price"`
-	SecondPrice        float64 `json:"second_price"`
-	GeoCountry         string  `json:"geo_country"`
-	DeviceType         string  `json:"device_type"`
-	Domain             string  `json:"domain"`
-	AppName            string  `json:"app_name"`
-	BundleID           string  `json:"bundle_id"`
+// KafkaSink sends events to KafkaProducer, event type is used as topic
+type KafkaSink struct{}
+
+func (KafkaSink) Send(event event_sink.Event) error {
+	sendToKafka(newKafkaMessage(event))
+	return nil
+}
+
+func (KafkaSink) Close() error {
+	return CloseKafkaProducer()
+}
+
+// newKafkaMessage keeps event in message metadata, so failed message can be spooled
+func newKafkaMessage(event event_sink.Event) *sarama.ProducerMessage {
+	message := &sarama.ProducerMessage{
+		Topic:    event.Type,
+		Value:    sarama.StringEncoder(event.Payload),
+		Metadata: event,
+	}
+	// Messages without key are spread randomly by hash partitioner
+	if key := event.Keys[kafkaKeyStrategy(event.Type)]; key != "" {
+		message.Key = sarama.StringEncoder(key)
+	}
+	return message
+}
+
+func kafkaKeyStrategy(topic string) string {
+	if strategy, exists := KafkaPartitionKeys[topic]; exists {
+		return strategy
+	}
+	return KafkaPartitionKeys[event_sink.DefaultRoute]
+}
+
+func requestContextKeys(requestContext request_context.RequestContext) map[string]string {
+	return map[string]string{
+		KafkaKeyRequestID:   requestContext.RequestID.String(),
+		KafkaKeyPublisherID: strconv.FormatUint(requestContext.PublisherID, 10),
+		KafkaKeyTargetingID: requestContext.PublisherTargetingID,
+	}
 }
 
 func SendRequestMessageToKafka(
 	adTagPubID string, requestID uuid.UUID, timestamp time.Time,
-	geoCountry, deviceType string, domain string,
+	geoCountry, deviceType string, domain string, debug bool,
 ) {
-	msg := KafkaRequestMessageFormat{
+	msg := message_format.KafkaRequestMessageFormat{
 		AdTagPubID:  adTagPubID,
 		RequestID:   requestID.String(),
 		Timestamp:   timestamp.Unix(),
@@ -80,27 +123,20 @@ func SendRequestMessageToKafka(
 		DeviceType:  deviceType,
 		RequestType: "direct",
 		Domain:      domain,
+		Debug:       debug,
 	}
 
-	msgJson, err := json.Marshal(msg)
-	if err != nil {
-		log.WithError(err).Warn("Can't marshall kafka message")
-	}
-
-	message := &sarama.ProducerMessage{
-		Topic:     "requests",
-		Partition: 0,
-		Value:     sarama.StringEncoder(msgJson),
-	}
-	KafkaProducer.Input() <- message
+	sendEvent(EventTypeRequests, &msg, timestamp, map[string]string{
+		KafkaKeyRequestID: msg.RequestID,
+	})
 }
 
 func SendRequestTargetedMessageToKafka(
 	adTagPubID string, requestID uuid.UUID, timestamp time.Time,
 	geoCountry, deviceType string, publisherID uint64, requestType string, targetingID string, domain string,
-	appName string, bundleID string,
+	appName string, bundleID string, experiment, experimentArm string, debug bool,
 ) {
-	msg := KafkaRequestMessageFormat{
+	msg := message_format.KafkaRequestMessageFormat{
 		AdTagPubID:  adTagPubID,
 		RequestID:   requestID.String(),
 		Timestamp:   timestamp.Unix(),
@@ -112,19 +148,17 @@ func SendRequestTargetedMessageToKafka(
 		Domain:      domain,
 		AppName:     appName,
 		BundleID:    bundleID,
-	}
 
-	msgJson, err := json.Marshal(msg)
-	if err != nil {
-		log.WithError(err).Warn("Can't marshall kafka message")
+		Experiment:    experiment,
+		ExperimentArm: experimentArm,
+		Debug:         debug,
 	}
 
-	message := &sarama.ProducerMessage{
-		Topic:     "requests_targeting",
-		Partition: 0,
-		Value:     sarama.StringEncoder(msgJson),
-	}
-	KafkaProducer.Input() <- message
+	sendEvent(EventTypeRequestsTargeting, &msg, timestamp, map[string]string{
+		KafkaKeyRequestID:   msg.RequestID,
+		KafkaKeyPublisherID: strconv.FormatUint(publisherID, 10),
+		KafkaKeyTargetingID: targetingID,
+	})
 }
 
 func SendRTBEventMessageToKafka(requestContext request_context.RequestContext, eventName string, timestamp time.Time) {
@@ -140,18 +174,11 @@ func SendRTBEventMessageToKafka(requestContext request_context.RequestContext, e
 		Domain:         requestContext.Domain,
 		AppName:        requestContext.AppName,
 		BundleID:       requestContext.BundleID,
+		Experiment:     requestContext.Experiment,
+		ExperimentArm:  requestContext.ExperimentArm,
+		Debug:          requestContext.Decision.Tracing(),
 	}
-	msgJson, err := json.Marshal(msg)
-	if err != nil {
-		log.WithError(err).Warn("Can't marshall kafka message")
-	}
-
-	message := &sarama.ProducerMessage{
-		Topic:     "rtb_events",
-		Partition: 0,
-		Value:     sarama.StringEncoder(msgJson),
-	}
-	KafkaProducer.Input() <- message
+	sendEvent(EventTypeRTBEvents, &msg, timestamp, requestContextKeys(requestContext))
 }
 
 func SendRTBBidRequestMessageToKafka(requestContext request_context.RequestContext, bidResponse BidResponseItem, timestamp time.Time) {
@@ -161,7 +188,7 @@ func SendRTBBidRequestMessageToKafka(requestContext request_context.RequestConte
 		bidResponseReceived = 1
 	}
 
-	msg := KafkaRTBBidRequestsMessageFormat{
+	msg := message_format.KafkaRTBBidRequestsMessageFormat{
 		ID:             requestContext.RequestID.String(),
 		PublisherID:    requestContext.PublisherID,
 		AdvertiserID:   bidResponse.AdvertiserID,
@@ -184,17 +211,41 @@ func SendRTBBidRequestMessageToKafka(requestContext request_context.RequestConte
 		Domain:     requestContext.Domain,
 		AppName:    requestContext.AppName,
 		BundleID:   requestContext.BundleID,
+
+		Experiment:    requestContext.Experiment,
+		ExperimentArm: requestContext.ExperimentArm,
+		Debug:         requestContext.Decision.Tracing(),
 	}
 
-	msgJson, err := json.Marshal(msg)
+	keys := requestContextKeys(requestContext)
+	keys[KafkaKeyAdvertiserID] = strconv.FormatUint(bidResponse.AdvertiserID, 10)
+	sendEvent(EventTypeRTBBidRequests, &msg, timestamp, keys)
+}
+
+func SendServingDataDiffToKafka(diff data.SnapshotDiff) {
+	sendEvent(EventTypeServingDataChanges, diff, time.Now(), nil)
+}
+
+func sendEvent(eventType string, msg interface{}, timestamp time.Time, keys map[string]string) {
+	var payload []byte
+	var err error
+	if versionedMsg, ok := msg.(message_format.Message); ok {
+		payload, err = message_format.Encode(versionedMsg, EventEncoding)
+	} else {
+		payload, err = json.Marshal(msg)
+	}
 	if err != nil {
-		log.WithError(err).Warn("Can't marshall kafka message")
+		log.WithError(err).WithField("event_type", eventType).Warn("Can't marshall event")
+		return
 	}
 
-	message := &sarama.ProducerMessage{
-		Topic:     "rtb_bid_requests",
-		Partition: 0,
-		Value:     sarama.StringEncoder(msgJson),
+	err = Events.Send(event_sink.Event{
+		Type:      eventType,
+		Payload:   payload,
+		Timestamp: timestamp,
+		Keys:      keys,
+	})
+	if err != nil {
+		log.WithError(err).WithField("event_type", eventType).Warn("Can't send event")
 	}
-	KafkaProducer.Input() <- message
 }
@@ -0,0 +1,73 @@
+package rotator
+
+import (
+	"reflect"
+	"testing"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/event_sink"
+)
+
+func TestParseKafkaPartitionKeys(t *testing.T) {
+	cases := []struct {
+		config   string
+		expected map[string]string
+		isValid  bool
+	}{
+		{config: "", expected: map[string]string{}, isValid: true},
+		{
+			config:   "default=request_id, rtb_bid_requests=advertiser_id,request_events=none",
+			expected: map[string]string{"default": "request_id", "rtb_bid_requests": "advertiser_id", "request_events": "none"},
+			isValid:  true,
+		},
+		{config: "default", isValid: false},
+		{config: "=request_id", isValid: false},
+		{config: "default=user_id", isValid: false},
+	}
+	for _, c := range cases {
+		strategies, err := ParseKafkaPartitionKeys(c.config)
+		if (err == nil) != c.isValid {
+			t.Errorf("%q: unexpected error %v", c.config, err)
+			continue
+		}
+		if c.isValid && !reflect.DeepEqual(strategies, c.expected) {
+			t.Errorf("%q: expected %v, got %v", c.config, c.expected, strategies)
+		}
+	}
+}
+
+func TestKafkaMessageKey(t *testing.T) {
+	defer func(keys map[string]string) { KafkaPartitionKeys = keys }(KafkaPartitionKeys)
+	KafkaPartitionKeys = map[string]string{
+		event_sink.DefaultRoute: KafkaKeyRequestID,
+		EventTypeRTBBidRequests: KafkaKeyAdvertiserID,
+		EventTypeRequestEvents:  KafkaKeyNone,
+	}
+	keys := map[string]string{
+		KafkaKeyRequestID:    "r1",
+		KafkaKeyPublisherID:  "42",
+		KafkaKeyAdvertiserID: "7",
+	}
+
+	cases := []struct {
+		topic string
+		keys  map[string]string
+		key   string
+	}{
+		{topic: EventTypeRTBEvents, keys: keys, key: "r1"},
+		{topic: EventTypeRTBBidRequests, keys: keys, key: "7"},
+		{topic: EventTypeRequestEvents, keys: keys, key: ""},
+		// Messages without a key of the strategy are not keyed
+		{topic: EventTypeRTBEvents, keys: map[string]string{KafkaKeyPublisherID: "42"}, key: ""},
+	}
+	for _, c := range cases {
+		message := newKafkaMessage(event_sink.Event{Type: c.topic, Payload: []byte(`{}`), Keys: c.keys})
+		var key string
+		if message.Key != nil {
+			encoded, _ := message.Key.Encode()
+			key = string(encoded)
+		}
+		if key != c.key || message.Topic != c.topic {
+			t.Errorf("%s: expected key %q, got %q", c.topic, c.key, key)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package rotator
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-redis/redis"
+)
+
+const (
+	defaultFeedbackWindow     = time.Hour
+	defaultFeedbackBucketSize = 5 * time.Minute
+	defaultFeedbackHalfLife   = time.Hour
+	defaultFeedbackKeyPrefix  = "live_feedback"
+)
+
+// Counter names used in redis hash fields
+const (
+	feedbackCounterRequests    = "req"
+	feedbackCounterImpressions = "imp"
+	feedbackCounterRevenue     = "rev"
+)
+
+// Feedback are live counters of ad tag requests and impressions used by selectors
+var Feedback = NewLiveFeedback(defaultFeedbackWindow, defaultFeedbackBucketSize)
+
+// IsFeedbackRecorded enables recording of requests for live feedback. It should be on only while
+// player events are relayed to FeedbackHandler, otherwise recorded requests never get impressions.
+var IsFeedbackRecorded bool
+
+// FeedbackKey identifies counters of an ad tag of a publisher link in a user country and on a domain,
+// counters with empty Country or Domain are totals of all countries or domains
+type FeedbackKey struct {
+	TargetingID string
+	AdTagID     string
+	Country     string
+	Domain      string
+}
+
+// FeedbackCounts are counters of a key for the rolling window
+type FeedbackCounts struct {
+	Requests    float64
+	Impressions float64
+	Revenue     float64
+}
+
+func (c FeedbackCounts) FillRate() float64 {
+	if c.Requests == 0 {
+		return 0
+	}
+	return c.Impressions / c.Requests
+}
+
+// ERPR is revenue per request
+func (c FeedbackCounts) ERPR() float64 {
+	if c.Requests == 0 {
+		return 0
+	}
+	return c.Revenue / c.Requests
+}
+
+func (c *FeedbackCounts) add(other FeedbackCounts) {
+	c.Requests += other.Requests
+	c.Impressions += other.Impressions
+	c.Revenue += other.Revenue
+}
+
+type feedbackBuckets map[int64]map[FeedbackKey]*FeedbackCounts
+
+// LiveFeedback keeps rolling window counters split into buckets of BucketSize.
+// Counters of this instance are flushed to redis on every Sync and merged with counters
+// of other instances, so selectors of every instance see the same totals.
+// Without Redis only counters of this instance are used.
+// Counters of a bucket decay exponentially with HalfLife, so recent outcomes have more influence than old ones.
+type LiveFeedback struct {
+	Window     time.Duration
+	BucketSize time.Duration
+	// HalfLife is the age at which counters of a bucket weigh half, zero disables decay
+	HalfLife  time.Duration
+	Redis     *redis.Client
+	KeyPrefix string
+
+	lock sync.Mutex
+	// local counters and requests are used if there is no redis
+	local    feedbackBuckets
+	requests feedbackRequests
+	// pending counters and requests were not flushed to redis yet
+	pending         feedbackBuckets
+	pendingRequests feedbackRequests
+	// events were not matched with their requests yet
+	events []FeedbackEvent
+	totals atomic.Value
+
+	stopSync chan struct{}
+	syncDone chan struct{}
+}
+
+func NewLiveFeedback(window, bucketSize time.Duration) *LiveFeedback {
+	f := &LiveFeedback{
+		Window:          window,
+		BucketSize:      bucketSize,
+		HalfLife:        defaultFeedbackHalfLife,
+		KeyPrefix:       defaultFeedbackKeyPrefix,
+		local:           make(feedbackBuckets),
+		requests:        make(feedbackRequests),
+		pending:         make(feedbackBuckets),
+		pendingRequests: make(feedbackRequests),
+	}
+	f.totals.Store(map[FeedbackKey]FeedbackCounts{})
+	return f
+}
+
+// RecordRequest counts a request sent to the ad tag and registers it, so its impression could be counted
+func (f *LiveFeedback) RecordRequest(requestID string, key FeedbackKey, at time.Time) {
+	bucket := f.bucket(at)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.Redis == nil {
+		f.requests.add(requestID, bucket, key, true)
+		f.local.add(bucket, key, FeedbackCounts{Requests: 1})
+	} else {
+		f.pendingRequests.add(requestID, bucket, key, true)
+		f.pending.add(bucket, key, FeedbackCounts{Requests: 1})
+	}
+}
+
+// Get returns counters of the key as of the last Sync
+func (f *LiveFeedback) Get(key FeedbackKey) FeedbackCounts {
+	return f.totals.Load().(map[FeedbackKey]FeedbackCounts)[key]
+}
+
+// Len returns number of keys with counters
+func (f *LiveFeedback) Len() int {
+	return len(f.totals.Load().(map[FeedbackKey]FeedbackCounts))
+}
+
+// Sync flushes pending counters and requests to redis, counts events of registered requests
+// and reloads totals of the window
+func (f *LiveFeedback) Sync(now time.Time) error {
+	oldest := f.bucket(now.Add(-f.Window)) + 1
+	newest := f.bucket(now)
+
+	f.lock.Lock()
+	f.local.prune(oldest)
+	f.requests.prune(oldest)
+	events := f.events
+	f.events = nil
+	if f.Redis == nil {
+		f.retryEvents(f.matchLocalEvents(events, now))
+		totals := f.aggregate(f.local, now)
+		f.lock.Unlock()
+		f.totals.Store(totals)
+		return nil
+	}
+	pending, pendingRequests := f.pending, f.pendingRequests
+	f.pending, f.pendingRequests = make(feedbackBuckets), make(feedbackRequests)
+	f.lock.Unlock()
+
+	if err := f.flush(pending, pendingRequests); err != nil {
+		f.keepPending(pending, pendingRequests, events, oldest)
+		return err
+	}
+
+	// Requests of this instance are in redis now, so their events could be matched
+	matched, retry, err := f.matchEvents(events, now)
+	if err != nil {
+		f.keepPending(nil, nil, events, oldest)
+		return err
+	}
+	f.lock.Lock()
+	f.retryEvents(retry)
+	f.lock.Unlock()
+	if err = f.flush(matched, nil); err != nil {
+		f.keepPending(matched, nil, nil, oldest)
+		return err
+	}
+
+	buckets, err := f.load(oldest, newest)
+	if err != nil {
+		return err
+	}
+	f.totals.Store(f.aggregate(buckets, now))
+	return nil
+}
+
+// StartSync syncs counters every interval until StopSync is called
+func (f *LiveFeedback) StartSync(interval time.Duration) {
+	f.stopSync = make(chan struct{})
+	f.syncDone = make(chan struct{})
+
+	go func() {
+		defer close(f.syncDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-f.stopSync:
+				return
+			case now := <-ticker.C:
+				if err := f.Sync(now); err != nil {
+					log.WithError(err).Warn("Live feedback sync failed")
+				}
+			}
+		}
+	}()
+}
+
+// StopSync stops syncing and flushes pending counters
+func (f *LiveFeedback) StopSync() error {
+	if f.stopSync == nil {
+		return nil
+	}
+	close(f.stopSync)
+	<-f.syncDone
+	f.stopSync = nil
+	return f.Sync(time.Now())
+}
+
+// keepPending returns data of a failed sync for the next attempt, counters could be counted twice
+// if redis failed in the middle of flush. Buckets and requests which left the window are dropped,
+// so pending data does not grow while redis is down.
+func (f *LiveFeedback) keepPending(
+	pending feedbackBuckets, pendingRequests feedbackRequests, events []FeedbackEvent, oldest int64,
+) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	mergeFeedback(f.pending, pending)
+	f.pending.prune(oldest)
+	mergeFeedbackRequests(f.pendingRequests, pendingRequests)
+	f.pendingRequests.prune(oldest)
+	f.retryEvents(events)
+}
+
+func (f *LiveFeedback) bucket(at time.Time) int64 {
+	return at.UnixNano() / int64(f.BucketSize)
+}
+
+func (f *LiveFeedback) redisKey(bucket int64) string {
+	return fmt.Sprintf("%s:%d:%d", f.KeyPrefix, int64(f.BucketSize/time.Second), bucket)
+}
+
+// flush adds pending counters to redis and registers pending requests after them,
+// so counted requests are always in redis by the time their events are matched
+func (f *LiveFeedback) flush(pending feedbackBuckets, pendingRequests feedbackRequests) error {
+	if len(pending) == 0 && len(pendingRequests) == 0 {
+		return nil
+	}
+
+	pipe := f.Redis.Pipeline()
+	for bucket, counters := range pending {
+		redisKey := f.redisKey(bucket)
+		for key, counts := range counters {
+			if counts.Requests != 0 {
+				pipe.HIncrByFloat(redisKey, feedbackField(key, feedbackCounterRequests), counts.Requests)
+			}
+			if counts.Impressions != 0 {
+				pipe.HIncrByFloat(redisKey, feedbackField(key, feedbackCounterImpressions), counts.Impressions)
+			}
+			if counts.Revenue != 0 {
+				pipe.HIncrByFloat(redisKey, feedbackField(key, feedbackCounterRevenue), counts.Revenue)
+			}
+		}
+		// Bucket is kept a bit longer than the window, so it is not lost while it is being read
+		pipe.Expire(redisKey, f.Window+f.BucketSize)
+	}
+	for requestID, request := range pendingRequests {
+		f.registerRequest(pipe, requestID, request)
+	}
+	_, err := pipe.Exec()
+	return err
+}
+
+func (f *LiveFeedback) load(oldest, newest int64) (feedbackBuckets, error) {
+	pipe := f.Redis.Pipeline()
+	commands := make(map[int64]*redis.StringStringMapCmd, newest-oldest+1)
+	for bucket := oldest; bucket <= newest; bucket++ {
+		commands[bucket] = pipe.HGetAll(f.redisKey(bucket))
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	buckets := make(feedbackBuckets, len(commands))
+	for bucket, command := range commands {
+		fields, err := command.Result()
+		if err != nil {
+			continue
+		}
+		for field, value := range fields {
+			key, counter, ok := parseFeedbackField(field)
+			if !ok {
+				continue
+			}
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			var counts FeedbackCounts
+			switch counter {
+			case feedbackCounterRequests:
+				counts.Requests = number
+			case feedbackCounterImpressions:
+				counts.Impressions = number
+			case feedbackCounterRevenue:
+				counts.Revenue = number
+			default:
+				continue
+			}
+			buckets.add(bucket, key, counts)
+		}
+	}
+	return buckets, nil
+}
+
+func (buckets feedbackBuckets) add(bucket int64, key FeedbackKey, counts FeedbackCounts) {
+	counters, exists := buckets[bucket]
+	if !exists {
+		counters = make(map[FeedbackKey]*FeedbackCounts)
+		buckets[bucket] = counters
+	}
+	total, exists := counters[key]
+	if !exists {
+		total = &FeedbackCounts{}
+		counters[key] = total
+	}
+	total.add(counts)
+}
+
+// prune removes buckets older than oldest
+func (buckets feedbackBuckets) prune(oldest int64) {
+	for bucket := range buckets {
+		if bucket < oldest {
+			delete(buckets, bucket)
+		}
+	}
+}
+
+func mergeFeedback(to, from feedbackBuckets) {
+	for bucket, counters := range from {
+		for key, counts := range counters {
+			to.add(bucket, key, *counts)
+		}
+	}
+}
+
+// aggregate sums decayed buckets, counters of every country and domain are added to totals
+// of the ad tag in all countries and on all domains too
+func (f *LiveFeedback) aggregate(buckets feedbackBuckets, now time.Time) map[FeedbackKey]FeedbackCounts {
+	totals := make(map[FeedbackKey]FeedbackCounts)
+	add := func(key FeedbackKey, counts FeedbackCounts) {
+		total := totals[key]
+		total.add(counts)
+		totals[key] = total
+	}
+	for bucket, counters := range buckets {
+		factor := f.decayFactor(bucket, now)
+		for key, counts := range counters {
+			decayed := FeedbackCounts{
+				Requests:    counts.Requests * factor,
+				Impressions: counts.Impressions * factor,
+				Revenue:     counts.Revenue * factor,
+			}
+			for _, segment := range feedbackSegments(key) {
+				add(segment, decayed)
+			}
+		}
+	}
+	return totals
+}
+
+// decayFactor is the weight of bucket counters, bucket age is counted from its start
+func (f *LiveFeedback) decayFactor(bucket int64, now time.Time) float64 {
+	age := now.Sub(time.Unix(0, bucket*int64(f.BucketSize)))
+	if f.HalfLife <= 0 || age <= 0 {
+		return 1
+	}
+	return math.Exp2(-float64(age) / float64(f.HalfLife))
+}
+
+// feedbackSegments returns the key and its totals of all countries and domains
+func feedbackSegments(key FeedbackKey) []FeedbackKey {
+	segments := []FeedbackKey{key}
+	if key.Country != "" {
+		segments = append(segments, FeedbackKey{TargetingID: key.TargetingID, AdTagID: key.AdTagID, Domain: key.Domain})
+	}
+	if key.Domain != "" {
+		segments = append(segments, FeedbackKey{TargetingID: key.TargetingID, AdTagID: key.AdTagID, Country: key.Country})
+	}
+	if key.Country != "" && key.Domain != "" {
+		segments = append(segments, FeedbackKey{TargetingID: key.TargetingID, AdTagID: key.AdTagID})
+	}
+	return segments
+}
+
+// feedbackField is a redis hash field of a counter: <targeting id>|<ad tag id>|<counter>|<country>|<domain>,
+// domain goes last as the only part which could contain the separator
+func feedbackField(key FeedbackKey, counter string) string {
+	return key.TargetingID + "|" + key.AdTagID + "|" + counter + "|" + key.Country + "|" + key.Domain
+}
+
+func parseFeedbackField(field string) (FeedbackKey, string, bool) {
+	parts := strings.SplitN(field, "|", 5)
+	if len(parts) != 5 {
+		return FeedbackKey{}, "", false
+	}
+	return FeedbackKey{TargetingID: parts[0], AdTagID: parts[1], Country: parts[3], Domain: parts[4]}, parts[2], true
+}
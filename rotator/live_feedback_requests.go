@@ -0,0 +1,270 @@
+package rotator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	// Unmatched events are retried while request could still be on its way to redis from another instance
+	feedbackMatchGrace = time.Minute
+	// Events over the limit are ignored until pending ones are matched
+	maxPendingFeedbackEvents = 100000
+)
+
+// Fields of request hash in redis: key of every ad tag the request was sent to
+// and markers of counted request and impression events
+const (
+	feedbackAdTagField     = "tag:"
+	feedbackRequestMark    = "req:"
+	feedbackImpressionMark = "imp"
+)
+
+// FeedbackEvent is a request or impression event of an ad tag reported by a player.
+// It is counted only if its request was recorded by the rotator, every event of a request is counted once.
+type FeedbackEvent struct {
+	RequestID string
+	AdTagID   string
+	Name      string
+	Revenue   float64
+	// At is the time event was received, counters of the request bucket are updated
+	At time.Time
+}
+
+// feedbackRequest is a request registered for matching of its events
+type feedbackRequest struct {
+	bucket int64
+	// adTags are keys of ad tags the request was sent to
+	adTags map[string]FeedbackKey
+	// counted are ad tags which requests were counted
+	counted       map[string]bool
+	hasImpression bool
+}
+
+type feedbackRequests map[string]*feedbackRequest
+
+// ExpectRequests registers ad tags of a VPAID waterfall, their requests are counted when request events come
+func (f *LiveFeedback) ExpectRequests(requestID string, keys []FeedbackKey, at time.Time) {
+	bucket := f.bucket(at)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	requests := f.requests
+	if f.Redis != nil {
+		requests = f.pendingRequests
+	}
+	for _, key := range keys {
+		requests.add(requestID, bucket, key, false)
+	}
+}
+
+// RecordEvent queues event to be matched with its request on the next Sync,
+// false is returned if there are too many pending events
+func (f *LiveFeedback) RecordEvent(event FeedbackEvent) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if len(f.events) >= maxPendingFeedbackEvents {
+		return false
+	}
+	f.events = append(f.events, event)
+	return true
+}
+
+// retryEvents keeps events for the next Sync, must be called under lock
+func (f *LiveFeedback) retryEvents(events []FeedbackEvent) {
+	f.events = append(events, f.events...)
+	if len(f.events) > maxPendingFeedbackEvents {
+		f.events = f.events[:maxPendingFeedbackEvents]
+	}
+}
+
+// matchLocalEvents counts events of requests of this instance, must be called under lock
+func (f *LiveFeedback) matchLocalEvents(events []FeedbackEvent, now time.Time) []FeedbackEvent {
+	var retry []FeedbackEvent
+	for _, event := range events {
+		request, exists := f.requests[event.RequestID]
+		var key FeedbackKey
+		if exists {
+			key, exists = request.adTags[event.AdTagID]
+		}
+		if !exists {
+			retry = retryUnmatchedEvent(retry, event, now)
+			continue
+		}
+
+		countRequest := !request.counted[event.AdTagID]
+		request.counted[event.AdTagID] = true
+		var countImpression bool
+		if event.Name == feedbackEventImpression {
+			countImpression = !request.hasImpression
+			request.hasImpression = true
+		}
+		countMatchedEvent(f.local, request.bucket, key, event, countRequest, countImpression)
+	}
+	return retry
+}
+
+// matchEvents counts events of requests registered in redis by any instance.
+// Markers of counted events are set with HSETNX, so an event is counted once even if instances race.
+func (f *LiveFeedback) matchEvents(events []FeedbackEvent, now time.Time) (feedbackBuckets, []FeedbackEvent, error) {
+	matched := make(feedbackBuckets)
+	if len(events) == 0 {
+		return matched, nil, nil
+	}
+
+	pipe := f.Redis.Pipeline()
+	registered := make(map[string]*redis.StringStringMapCmd)
+	for _, event := range events {
+		if _, exists := registered[event.RequestID]; !exists {
+			registered[event.RequestID] = pipe.HGetAll(f.requestKey(event.RequestID))
+		}
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return nil, nil, err
+	}
+
+	type mark struct {
+		event      FeedbackEvent
+		bucket     int64
+		key        FeedbackKey
+		request    *redis.BoolCmd
+		impression *redis.BoolCmd
+	}
+	var marks []mark
+	var retry []FeedbackEvent
+	pipe = f.Redis.Pipeline()
+	for _, event := range events {
+		bucket, key, ok := parseRegisteredFeedbackKey(registered[event.RequestID].Val()[feedbackAdTagField+event.AdTagID])
+		if !ok {
+			retry = retryUnmatchedEvent(retry, event, now)
+			continue
+		}
+
+		requestKey := f.requestKey(event.RequestID)
+		m := mark{event: event, bucket: bucket, key: key}
+		// Impression means the request was made even if its request event was lost
+		m.request = pipe.HSetNX(requestKey, feedbackRequestMark+event.AdTagID, 1)
+		if event.Name == feedbackEventImpression {
+			m.impression = pipe.HSetNX(requestKey, feedbackImpressionMark, 1)
+		}
+		marks = append(marks, m)
+	}
+	if len(marks) == 0 {
+		return matched, retry, nil
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, nil, err
+	}
+
+	for _, m := range marks {
+		countImpression := m.impression != nil && m.impression.Val()
+		countMatchedEvent(matched, m.bucket, m.key, m.event, m.request.Val(), countImpression)
+	}
+	return matched, retry, nil
+}
+
+// countMatchedEvent counts request and impression of a matched event which were not counted yet.
+// Counters of the request bucket are updated, so impressions never outnumber requests of a bucket.
+func countMatchedEvent(
+	buckets feedbackBuckets, bucket int64, key FeedbackKey, event FeedbackEvent, countRequest, countImpression bool,
+) {
+	if countRequest {
+		buckets.add(bucket, key, FeedbackCounts{Requests: 1})
+	}
+	isCounted := countRequest
+	if event.Name == feedbackEventImpression {
+		isCounted = countImpression
+		if countImpression {
+			buckets.add(bucket, key, FeedbackCounts{Impressions: 1, Revenue: event.Revenue})
+		}
+	}
+
+	if isCounted {
+		feedbackEventsTotal.Inc(event.Name, "counted")
+	} else {
+		feedbackEventsTotal.Inc(event.Name, "duplicate")
+	}
+}
+
+// retryUnmatchedEvent keeps event of unknown request for a while, the request could be registered
+// by another instance which did not sync yet. Events of requests which were never recorded are dropped.
+func retryUnmatchedEvent(retry []FeedbackEvent, event FeedbackEvent, now time.Time) []FeedbackEvent {
+	if now.Sub(event.At) < feedbackMatchGrace {
+		return append(retry, event)
+	}
+	feedbackEventsTotal.Inc(event.Name, "unmatched")
+	return retry
+}
+
+// registerRequest adds ad tags of the request to its redis hash, the hash lives as long as counters of its bucket
+func (f *LiveFeedback) registerRequest(pipe redis.Pipeliner, requestID string, request *feedbackRequest) {
+	requestKey := f.requestKey(requestID)
+	for adTagID, key := range request.adTags {
+		pipe.HSet(requestKey, feedbackAdTagField+adTagID, registeredFeedbackKey(request.bucket, key))
+	}
+	for adTagID := range request.counted {
+		pipe.HSet(requestKey, feedbackRequestMark+adTagID, 1)
+	}
+	pipe.Expire(requestKey, f.Window+f.BucketSize)
+}
+
+func (f *LiveFeedback) requestKey(requestID string) string {
+	return fmt.Sprintf("%s:request:%s", f.KeyPrefix, requestID)
+}
+
+func (requests feedbackRequests) add(requestID string, bucket int64, key FeedbackKey, isCounted bool) {
+	request, exists := requests[requestID]
+	if !exists {
+		request = &feedbackRequest{
+			bucket:  bucket,
+			adTags:  make(map[string]FeedbackKey),
+			counted: make(map[string]bool),
+		}
+		requests[requestID] = request
+	}
+	request.adTags[key.AdTagID] = key
+	if isCounted {
+		request.counted[key.AdTagID] = true
+	}
+}
+
+// prune removes requests older than oldest bucket
+func (requests feedbackRequests) prune(oldest int64) {
+	for requestID, request := range requests {
+		if request.bucket < oldest {
+			delete(requests, requestID)
+		}
+	}
+}
+
+func mergeFeedbackRequests(to, from feedbackRequests) {
+	for requestID, request := range from {
+		for adTagID, key := range request.adTags {
+			to.add(requestID, request.bucket, key, request.counted[adTagID])
+		}
+	}
+}
+
+// registeredFeedbackKey is a value of ad tag field of request hash: <bucket>|<feedback field without counter>
+func registeredFeedbackKey(bucket int64, key FeedbackKey) string {
+	return strconv.FormatInt(bucket, 10) + "|" + feedbackField(key, "")
+}
+
+func parseRegisteredFeedbackKey(value string) (int64, FeedbackKey, bool) {
+	parts := strings.SplitN(value, "|", 2)
+	if len(parts) != 2 {
+		return 0, FeedbackKey{}, false
+	}
+	bucket, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, FeedbackKey{}, false
+	}
+	key, _, ok := parseFeedbackField(parts[1])
+	return bucket, key, ok
+}
@@ -0,0 +1,164 @@
+package rotator
+
+import (
+	"testing"
+	"time"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/request_context"
+	"github.com/go-redis/redis"
+)
+
+func TestLiveFeedbackWindow(t *testing.T) {
+	feedback := NewLiveFeedback(time.Hour, 10*time.Minute)
+	feedback.HalfLife = 0
+	start := time.Unix(1500000000, 0)
+	onDomain := FeedbackKey{TargetingID: "link", AdTagID: "tag", Domain: "example.com"}
+
+	feedback.RecordRequest("1", onDomain, start)
+	feedback.RecordRequest("2", onDomain, start)
+	feedback.RecordEvent(FeedbackEvent{RequestID: "1", AdTagID: "tag", Name: feedbackEventImpression, Revenue: 2, At: start})
+	feedback.RecordRequest("3", FeedbackKey{TargetingID: "link", AdTagID: "tag"}, start.Add(30*time.Minute))
+
+	if feedback.Len() != 0 {
+		t.Errorf("expected counters to be visible only after sync, got %d keys", feedback.Len())
+	}
+
+	feedback.Sync(start.Add(30 * time.Minute))
+	counts := feedback.Get(onDomain)
+	if counts.Requests != 2 || counts.FillRate() != 0.5 || counts.ERPR() != 1 {
+		t.Errorf("unexpected domain counters %+v", counts)
+	}
+	if total := feedback.Get(FeedbackKey{TargetingID: "link", AdTagID: "tag"}); total.Requests != 3 {
+		t.Errorf("expected domain counters to be added to ad tag totals, got %+v", total)
+	}
+
+	// First bucket leaves the window
+	feedback.Sync(start.Add(70 * time.Minute))
+	if counts := feedback.Get(onDomain); counts.Requests != 0 {
+		t.Errorf("expected counters to leave the window, got %+v", counts)
+	}
+	if total := feedback.Get(FeedbackKey{TargetingID: "link", AdTagID: "tag"}); total.Requests != 1 {
+		t.Errorf("expected only recent request in totals, got %+v", total)
+	}
+}
+
+func TestLiveFeedbackMatchesEvents(t *testing.T) {
+	feedback := NewLiveFeedback(time.Hour, 10*time.Minute)
+	feedback.HalfLife = 0
+	start := time.Unix(1500000000, 0)
+	key := func(adTagID string) FeedbackKey {
+		return FeedbackKey{TargetingID: "link", AdTagID: adTagID}
+	}
+	event := func(requestID, adTagID, name string) FeedbackEvent {
+		return FeedbackEvent{RequestID: requestID, AdTagID: adTagID, Name: name, Revenue: 1, At: start}
+	}
+
+	feedback.RecordRequest("vast", key("first"), start)
+	feedback.ExpectRequests("vpaid", []FeedbackKey{key("first"), key("second")}, start)
+	for _, e := range []FeedbackEvent{
+		// Replayed impression is counted once
+		event("vast", "first", feedbackEventImpression),
+		event("vast", "first", feedbackEventImpression),
+		// Impression of VPAID ad tag counts its request if request event was lost
+		event("vpaid", "second", feedbackEventImpression),
+		event("vpaid", "second", feedbackEventRequest),
+		event("vpaid", "first", feedbackEventRequest),
+		event("vpaid", "first", feedbackEventRequest),
+		// Events of requests which were never recorded are not counted
+		event("unknown", "first", feedbackEventImpression),
+		event("vpaid", "unknown", feedbackEventRequest),
+	} {
+		feedback.RecordEvent(e)
+	}
+	feedback.Sync(start)
+
+	if counts := feedback.Get(key("first")); counts.Requests != 2 || counts.Impressions != 1 {
+		t.Errorf("unexpected counters of first ad tag %+v", counts)
+	}
+	if counts := feedback.Get(key("second")); counts.Requests != 1 || counts.Impressions != 1 {
+		t.Errorf("unexpected counters of second ad tag %+v", counts)
+	}
+	if len(feedback.events) != 2 {
+		t.Errorf("expected unmatched events to be retried, got %d pending events", len(feedback.events))
+	}
+	feedback.Sync(start.Add(2 * feedbackMatchGrace))
+	if len(feedback.events) != 0 {
+		t.Errorf("expected unmatched events to be dropped after grace period, got %d pending events", len(feedback.events))
+	}
+	if feedback.Len() != 2 {
+		t.Errorf("expected counters of recorded ad tags only, got %d keys", feedback.Len())
+	}
+}
+
+func TestLiveFeedbackSegmentsDecay(t *testing.T) {
+	feedback := NewLiveFeedback(time.Hour, 10*time.Minute)
+	feedback.HalfLife = 20 * time.Minute
+	start := time.Unix(1500000000, 0).Truncate(10 * time.Minute)
+
+	feedback.RecordRequest("1", FeedbackKey{TargetingID: "link", AdTagID: "tag", Country: "US", Domain: "example.com"}, start)
+	feedback.RecordRequest("2", FeedbackKey{TargetingID: "link", AdTagID: "tag", Country: "DE", Domain: "example.com"}, start)
+	feedback.Sync(start.Add(20 * time.Minute))
+
+	expected := map[FeedbackKey]float64{
+		{TargetingID: "link", AdTagID: "tag", Country: "US", Domain: "example.com"}: 0.5,
+		{TargetingID: "link", AdTagID: "tag", Country: "US"}:                        0.5,
+		{TargetingID: "link", AdTagID: "tag", Domain: "example.com"}:                1,
+		{TargetingID: "link", AdTagID: "tag"}:                                       1,
+	}
+	for key, requests := range expected {
+		if counts := feedback.Get(key); counts.Requests != requests {
+			t.Errorf("expected %f decayed requests of %+v, got %f", requests, key, counts.Requests)
+		}
+	}
+}
+
+func TestLiveFeedbackDropsStalePendingCounters(t *testing.T) {
+	feedback := NewLiveFeedback(time.Hour, 10*time.Minute)
+	feedback.Redis = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: 0, DialTimeout: 100 * time.Millisecond})
+	defer feedback.Redis.Close()
+	start := time.Unix(1500000000, 0)
+
+	feedback.RecordRequest("1", FeedbackKey{TargetingID: "link", AdTagID: "tag"}, start)
+	if err := feedback.Sync(start); err == nil {
+		t.Fatal("expected flush to unavailable redis to fail")
+	}
+	if len(feedback.pending) != 1 {
+		t.Fatalf("expected counters to be kept for the next attempt, got %d buckets", len(feedback.pending))
+	}
+
+	feedback.Sync(start.Add(2 * time.Hour))
+	if len(feedback.pending) != 0 {
+		t.Errorf("expected buckets out of the window to be dropped, got %d buckets", len(feedback.pending))
+	}
+}
+
+func TestFeedbackField(t *testing.T) {
+	key := FeedbackKey{TargetingID: "link", AdTagID: "tag", Country: "US", Domain: "weird|domain"}
+	parsed, counter, ok := parseFeedbackField(feedbackField(key, feedbackCounterImpressions))
+	if !ok || parsed != key || counter != feedbackCounterImpressions {
+		t.Errorf("field was not parsed back: %+v %s %v", parsed, counter, ok)
+	}
+}
+
+func TestRecordsFeedback(t *testing.T) {
+	defer func(isRecorded bool) { IsFeedbackRecorded = isRecorded }(IsFeedbackRecorded)
+
+	requestContext := request_context.RequestContext{Decision: &request_context.Decision{}}
+	IsFeedbackRecorded = false
+	if recordsFeedback(requestContext, selectors[strategyThompson]) {
+		t.Error("requests should not be recorded unless recording is enabled")
+	}
+
+	IsFeedbackRecorded = true
+	if !recordsFeedback(requestContext, selectors[strategyThompson]) {
+		t.Error("requests of thompson selector should be recorded")
+	}
+	if recordsFeedback(requestContext, selectors[strategyERPR]) {
+		t.Error("requests of selector not reading feedback should not be recorded")
+	}
+
+	requestContext.Decision.StartTrace()
+	if recordsFeedback(requestContext, selectors[strategyThompson]) {
+		t.Error("debug traced requests should not be recorded")
+	}
+}
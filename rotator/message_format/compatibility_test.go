@@ -0,0 +1,208 @@
+package message_format
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// Payloads produced by schema version 1, consumers must be able to read them forever
+var v1Messages = []struct {
+	name     string
+	json     string
+	protobuf string
+	expected Message
+}{
+	{
+		name:     "request",
+		json:     `{"v":1,"message_type":"","adpid":"t1","rid":"r1","timestamp":1500000000,"rtype":"targeted","geo_country":"US","device_type":"mobile","publisher_id":42,"targeting_id":"pl1","domain":"example.com","app_name":"","bundle_id":""}`,
+		protobuf: "000101120274311a0272312080dea0cb052a087461726765746564320255533a066d6f62696c65402a4a03706c31520b6578616d706c652e636f6d",
+		expected: &KafkaRequestMessageFormat{
+			Header:      Header{Version: 1},
+			AdTagPubID:  "t1",
+			RequestID:   "r1",
+			Timestamp:   1500000000,
+			RequestType: "targeted",
+			GeoCountry:  "US",
+			DeviceType:  "mobile",
+			PublisherID: 42,
+			TargetingID: "pl1",
+			Domain:      "example.com",
+		},
+	},
+	{
+		name:     "rtb_event",
+		json:     `{"v":1,"id":"r1","pid":42,"tid":"pl1","e":"impression","price":1.5,"timestamp":1500000000,"geo_country":"US","device_type":"ctv","domain":"","app_name":"","bundle_id":""}`,
+		protobuf: "0002010a027231102a1a03706c31220a696d7072657373696f6e29000000000000f83f3080dea0cb053a0255534203637476",
+		expected: &KafkaRTBEventsMessageFormat{
+			Header:         Header{Version: 1},
+			ID:             "r1",
+			PublisherID:    42,
+			TargetingID:    "pl1",
+			EventName:      "impression",
+			PublisherPrice: 1.5,
+			Timestamp:      1500000000,
+			GeoCountry:     "US",
+			DeviceType:     "ctv",
+		},
+	},
+	{
+		name:     "rtb_bid_request",
+		json:     `{"v":1,"id":"b7a1","pid":42,"tid":"pl1","price":1.5,"timestamp":1500000000,"advertiser_id":7,"bid_response":1,"bid_response_time":120,"bid_response_timeout":0,"bid_response_empty":0,"bid_response_error":"","bid_win":1,"bid_floor_price":2,"bid_price":3.25,"second_price":2.5,"geo_country":"US","device_type":"desktop","domain":"example.com","app_name":"","bundle_id":""}`,
+		protobuf: "0003010a0462376131102a1a03706c3121000000000000f83f2880dea0cb053007380140786001690000000000000040710000000000000a4079000000000000044082010255538a01076465736b746f7092010b6578616d706c652e636f6d",
+		expected: &KafkaRTBBidRequestsMessageFormat{
+			Header:          Header{Version: 1},
+			ID:              "b7a1",
+			PublisherID:     42,
+			TargetingID:     "pl1",
+			PublisherPrice:  1.5,
+			Timestamp:       1500000000,
+			AdvertiserID:    7,
+			BidResponse:     1,
+			BidResponseTime: 120,
+			BidWin:          1,
+			BidFloorPrice:   2,
+			BidPrice:        3.25,
+			SecondPrice:     2.5,
+			GeoCountry:      "US",
+			DeviceType:      "desktop",
+			Domain:          "example.com",
+		},
+	},
+	{
+		name:     "request_event",
+		json:     `{"v":1,"rid":"r1","timestamp":1500000000,"endpoint":"/rotator/target/v2","rtype":"targeting","response_type":"vast","vast_version":2,"outcome":"filled","reason":"","publisher_id":42,"targeting_id":"pl1","price":1.5,"platform":"desktop","device_type":"desktop","geo_country":"US","domain":"example.com","app_name":"","bundle_id":"","selection_strategy":"erpr","selected_adpids":["t1"],"candidates":3,"filters":[{"name":"price","passed":2,"rejected":1},{"name":"geo","passed":2,"rejected":0}],"latency_us":850}`,
+		protobuf: "0004010a0272311080dea0cb051a122f726f7461746f722f7461726765742f76322209746172676574696e672a047661737430023a0666696c6c6564482a5203706c3159000000000000f83f62076465736b746f706a076465736b746f70720255537a0b6578616d706c652e636f6d920104657270729a01027431a00103aa010b0a05707269636510021801aa01070a0367656f1002b001d206",
+		expected: &RequestEvent{
+			Header:            Header{Version: 1},
+			RequestID:         "r1",
+			Timestamp:         1500000000,
+			Endpoint:          "/rotator/target/v2",
+			RequestType:       "targeting",
+			ResponseType:      "vast",
+			VastVersion:       2,
+			Outcome:           "filled",
+			PublisherID:       42,
+			TargetingID:       "pl1",
+			PublisherPrice:    1.5,
+			Platform:          "desktop",
+			DeviceType:        "desktop",
+			GeoCountry:        "US",
+			Domain:            "example.com",
+			SelectionStrategy: "erpr",
+			SelectedAdTagIDs:  []string{"t1"},
+			Candidates:        3,
+			Filters: []RequestEventFilter{
+				{Name: "price", Passed: 2, Rejected: 1},
+				{Name: "geo", Passed: 2},
+			},
+			LatencyMicros: 850,
+		},
+	},
+}
+
+func newEmpty(message Message) Message {
+	return reflect.New(reflect.TypeOf(message).Elem()).Interface().(Message)
+}
+
+func TestDecodeV1Messages(t *testing.T) {
+	for _, test := range v1Messages {
+		protobuf, err := hex.DecodeString(test.protobuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for encoding, payload := range map[Encoding][]byte{
+			EncodingJSON:     []byte(test.json),
+			EncodingProtobuf: protobuf,
+		} {
+			decoded := newEmpty(test.expected)
+			if err := Decode(payload, decoded); err != nil {
+				t.Errorf("%s %s: %s", test.name, encoding, err)
+				continue
+			}
+			if !reflect.DeepEqual(decoded, test.expected) {
+				t.Errorf("%s %s: decoded %+v, expected %+v", test.name, encoding, decoded, test.expected)
+			}
+		}
+	}
+}
+
+// JSON field names of the current schema must stay compatible with version 1 consumers
+func TestJSONFieldsCompatibility(t *testing.T) {
+	for _, test := range v1Messages {
+		var v1Fields map[string]interface{}
+		if err := json.Unmarshal([]byte(test.json), &v1Fields); err != nil {
+			t.Fatal(err)
+		}
+
+		payload, err := Encode(test.expected, EncodingJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var currentFields map[string]interface{}
+		if err := json.Unmarshal(payload, &currentFields); err != nil {
+			t.Fatal(err)
+		}
+
+		for field, value := range v1Fields {
+			if field == "v" {
+				continue
+			}
+			if !reflect.DeepEqual(currentFields[field], value) {
+				t.Errorf("%s: field %q is %v, version 1 had %v", test.name, field, currentFields[field], value)
+			}
+		}
+	}
+}
+
+func TestProtobufRoundTripAndUnknownFields(t *testing.T) {
+	for _, test := range v1Messages {
+		payload, err := Encode(test.expected, EncodingProtobuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if payload[1] != test.expected.Schema().ID || payload[2] != test.expected.Schema().Version {
+			t.Errorf("%s: wrong frame header %x", test.name, payload[:3])
+		}
+
+		// Field 1000 (string "new") is written by a newer schema version
+		payload = append(payload, 0xc2, 0x3e, 0x03, 'n', 'e', 'w')
+		decoded := newEmpty(test.expected)
+		if err := Decode(payload, decoded); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, test.expected) {
+			t.Errorf("%s: decoded %+v, expected %+v", test.name, decoded, test.expected)
+		}
+	}
+
+	payload, _ := Encode(&KafkaRTBEventsMessageFormat{ID: "r1"}, EncodingProtobuf)
+	if err := Decode(payload, &KafkaRequestMessageFormat{}); err == nil {
+		t.Error("message of other schema must not be decoded")
+	}
+}
+
+func TestSchemaFieldNumbers(t *testing.T) {
+	for _, test := range v1Messages {
+		messageType := reflect.TypeOf(test.expected).Elem()
+		fields, err := fieldsOf(messageType)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		numbers := make(map[uint64]bool)
+		for _, field := range fields {
+			if numbers[field.number] {
+				t.Errorf("%s: proto field number %d is used twice", test.name, field.number)
+			}
+			numbers[field.number] = true
+		}
+		// Every field but Header has to be in protobuf encoding
+		if len(fields) != messageType.NumField()-1 {
+			t.Errorf("%s: %d fields have no proto number", test.name, messageType.NumField()-1-len(fields))
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package message_format
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+type Encoding string
+
+const (
+	EncodingJSON     Encoding = "json"
+	EncodingProtobuf Encoding = "protobuf"
+)
+
+// Binary frame is: magic byte, schema id, schema version, protobuf encoded message.
+// Magic byte can't be the first byte of JSON, so consumers can read both encodings.
+const (
+	binaryMagic      byte = 0
+	binaryHeaderSize      = 3
+)
+
+var ErrSchemaMismatch = errors.New("message schema does not match")
+
+// Schema identifies message type and its version
+type Schema struct {
+	ID      uint8
+	Name    string
+	Version uint8
+}
+
+// Message is a versioned kafka message
+type Message interface {
+	Schema() Schema
+}
+
+// Header is embedded in every message, in JSON it is the "v" field.
+// Version is set on Encode and Decode.
+type Header struct {
+	Version uint8 `json:"v,omitempty"`
+}
+
+func (h *Header) setVersion(version uint8) {
+	h.Version = version
+}
+
+type versioned interface {
+	setVersion(version uint8)
+}
+
+func ParseEncoding(encoding string) (Encoding, error) {
+	switch Encoding(encoding) {
+	case EncodingJSON, EncodingProtobuf:
+		return Encoding(encoding), nil
+	}
+	return "", fmt.Errorf("unknown message encoding %q", encoding)
+}
+
+// Encode serializes message with its current schema version, message must be a pointer
+func Encode(message Message, encoding Encoding) ([]byte, error) {
+	schema := message.Schema()
+	if v, ok := message.(versioned); ok {
+		v.setVersion(schema.Version)
+	}
+
+	switch encoding {
+	case EncodingJSON:
+		return json.Marshal(message)
+	case EncodingProtobuf:
+		body, err := marshalProto(message)
+		if err != nil {
+			return nil, err
+		}
+		frame := make([]byte, binaryHeaderSize, binaryHeaderSize+len(body))
+		frame[0] = binaryMagic
+		frame[1] = schema.ID
+		frame[2] = schema.Version
+		return append(frame, body...), nil
+	}
+	return nil, fmt.Errorf("unknown message encoding %q", encoding)
+}
+
+// Decode reads message of any encoding and any version of its schema, message must be a pointer.
+// Fields unknown to the current schema are skipped, missing ones are left zero.
+func Decode(payload []byte, message Message) error {
+	if len(payload) == 0 {
+		return errors.New("empty message")
+	}
+
+	if payload[0] != binaryMagic {
+		return json.Unmarshal(payload, message)
+	}
+
+	if len(payload) < binaryHeaderSize {
+		return errors.New("truncated message header")
+	}
+	if payload[1] != message.Schema().ID {
+		return fmt.Errorf("%s: got schema id %d, expected %s (%d)",
+			ErrSchemaMismatch, payload[1], message.Schema().Name, message.Schema().ID)
+	}
+	if err := unmarshalProto(payload[binaryHeaderSize:], message); err != nil {
+		return err
+	}
+	if v, ok := message.(versioned); ok {
+		v.setVersion(payload[2])
+	}
+	return nil
+}
@@ -1,15 +1,146 @@
 package message_format
 
+// Schema IDs are written to binary frame header, they must never be reused
+const (
+	SchemaIDRequest       uint8 = 1
+	SchemaIDRTBEvent      uint8 = 2
+	SchemaIDRTBBidRequest uint8 = 3
+	SchemaIDRequestEvent  uint8 = 4
+)
+
+// Current schema versions. Version must be increased on every field change,
+// fields can only be added with new proto numbers, removed fields numbers are never reused.
+const (
+	RequestSchemaVersion       uint8 = 3
+	RTBEventSchemaVersion      uint8 = 3
+	RTBBidRequestSchemaVersion uint8 = 3
+	RequestEventSchemaVersion  uint8 = 4
+)
+
+// KafkaRequestMessageFormat is sent to requests and requests_targeting topics
+type KafkaRequestMessageFormat struct {
+	Header
+	MessageType string `json:"message_type" proto:"1"`
+	AdTagPubID  string `json:"adpid" proto:"2"`
+	RequestID   string `json:"rid" proto:"3"`
+	Timestamp   int64  `json:"timestamp" proto:"4"`
+	RequestType string `json:"rtype" proto:"5"`
+	GeoCountry  string `json:"geo_country" proto:"6"`
+	DeviceType  string `json:"device_type" proto:"7"`
+	PublisherID uint64 `json:"publisher_id" proto:"8"`
+	TargetingID string `json:"targeting_id" proto:"9"`
+	Domain      string `json:"domain" proto:"10"`
+	AppName     string `json:"app_name" proto:"11"`
+	BundleID    string `json:"bundle_id" proto:"12"`
+	// Experiment and ExperimentArm of the request, added in version 2
+	Experiment    string `json:"experiment" proto:"13"`
+	ExperimentArm string `json:"arm" proto:"14"`
+	// Debug marks debug traced requests which are not real traffic, added in version 3
+	Debug bool `json:"debug,omitempty" proto:"15"`
+}
+
+func (KafkaRequestMessageFormat) Schema() Schema {
+	return Schema{ID: SchemaIDRequest, Name: "request", Version: RequestSchemaVersion}
+}
+
 type KafkaRTBEventsMessageFormat struct {
-	ID             string  `json:"id"`
-	PublisherID    uint64  `json:"pid"`
-	TargetingID    string  `json:"tid"`
-	EventName      string  `json:"e"`
-	PublisherPrice float64 `json:"price"`
-	Timestamp      int64   `json:"timestamp"`
-	GeoCountry     string  `json:"geo_country"`
-	DeviceType     string  `json:"device_type"`
-	Domain         string  `json:"domain"`
-	AppName        string  `json:"app_name"`
-	BundleID       string  `json:"bundle_id"`
+	Header
+	ID             string  `json:"id" proto:"1"`
+	PublisherID    uint64  `json:"pid" proto:"2"`
+	TargetingID    string  `json:"tid" proto:"3"`
+	EventName      string  `json:"e" proto:"4"`
+	PublisherPrice float64 `json:"price" proto:"5"`
+	Timestamp      int64   `json:"timestamp" proto:"6"`
+	GeoCountry     string  `json:"geo_country" proto:"7"`
+	DeviceType     string  `json:"device_type" proto:"8"`
+	Domain         string  `json:"domain" proto:"9"`
+	AppName        string  `json:"app_name" proto:"10"`
+	BundleID       string  `json:"bundle_id" proto:"11"`
+	// Experiment and ExperimentArm of the request, added in version 2
+	Experiment    string `json:"experiment" proto:"12"`
+	ExperimentArm string `json:"arm" proto:"13"`
+	// Debug marks debug traced requests which are not real traffic, added in version 3
+	Debug bool `json:"debug,omitempty" proto:"14"`
+}
+
+func (KafkaRTBEventsMessageFormat) Schema() Schema {
+	return Schema{ID: SchemaIDRTBEvent, Name: "rtb_event", Version: RTBEventSchemaVersion}
+}
+
+type KafkaRTBBidRequestsMessageFormat struct {
+	Header
+	ID                 string  `json:"id" proto:"1"`
+	PublisherID        uint64  `json:"pid" proto:"2"`
+	TargetingID        string  `json:"tid" proto:"3"`
+	PublisherPrice     float64 `json:"price" proto:"4"`
+	Timestamp          int64   `json:"timestamp" proto:"5"`
+	AdvertiserID       uint64  `json:"advertiser_id" proto:"6"`
+	BidResponse        int8    `json:"bid_response" proto:"7"`
+	BidResponseTime    int64   `json:"bid_response_time" proto:"8"`
+	BidResponseTimeout int8    `json:"bid_response_timeout" proto:"9"`
+	BidResponseEmpty   int8    `json:"bid_response_empty" proto:"10"`
+	BidResponseError   string  `json:"bid_response_error" proto:"11"`
+	BidWin             int8    `json:"bid_win" proto:"12"`
+	BidFloorPrice      float64 `json:"bid_floor_price" proto:"13"`
+	BidPrice           float64 `json:"bid_price" proto:"14"`
+	SecondPrice        float64 `json:"second_price" proto:"15"`
+	GeoCountry         string  `json:"geo_country" proto:"16"`
+	DeviceType         string  `json:"device_type" proto:"17"`
+	Domain             string  `json:"domain" proto:"18"`
+	AppName            string  `json:"app_name" proto:"19"`
+	BundleID           string  `json:"bundle_id" proto:"20"`
+	// Experiment and ExperimentArm of the request, added in version 2
+	Experiment    string `json:"experiment" proto:"21"`
+	ExperimentArm string `json:"arm" proto:"22"`
+	// Debug marks debug traced requests which are not real traffic, added in version 3
+	Debug bool `json:"debug,omitempty" proto:"23"`
+}
+
+func (KafkaRTBBidRequestsMessageFormat) Schema() Schema {
+	return Schema{ID: SchemaIDRTBBidRequest, Name: "rtb_bid_request", Version: RTBBidRequestSchemaVersion}
+}
+
+// RequestEvent is the canonical event sent once for every request by every handler
+type RequestEvent struct {
+	Header
+	RequestID         string               `json:"rid" proto:"1"`
+	Timestamp         int64                `json:"timestamp" proto:"2"`
+	Endpoint          string               `json:"endpoint" proto:"3"`
+	RequestType       string               `json:"rtype" proto:"4"`
+	ResponseType      string               `json:"response_type" proto:"5"`
+	VastVersion       int                  `json:"vast_version" proto:"6"`
+	Outcome           string               `json:"outcome" proto:"7"`
+	Reason            string               `json:"reason" proto:"8"`
+	PublisherID       uint64               `json:"publisher_id" proto:"9"`
+	TargetingID       string               `json:"targeting_id" proto:"10"`
+	PublisherPrice    float64              `json:"price" proto:"11"`
+	Platform          string               `json:"platform" proto:"12"`
+	DeviceType        string               `json:"device_type" proto:"13"`
+	GeoCountry        string               `json:"geo_country" proto:"14"`
+	Domain            string               `json:"domain" proto:"15"`
+	AppName           string               `json:"app_name" proto:"16"`
+	BundleID          string               `json:"bundle_id" proto:"17"`
+	SelectionStrategy string               `json:"selection_strategy" proto:"18"`
+	SelectedAdTagIDs  []string             `json:"selected_adpids" proto:"19"`
+	Candidates        int                  `json:"candidates" proto:"20"`
+	Filters           []RequestEventFilter `json:"filters" proto:"21"`
+	LatencyMicros     int64                `json:"latency_us" proto:"22"`
+	// RandomSeed reproduces random choices of the request, added in version 2
+	RandomSeed int64 `json:"seed" proto:"23"`
+	// Experiment and ExperimentArm of the request, added in version 3
+	Experiment    string `json:"experiment" proto:"24"`
+	ExperimentArm string `json:"arm" proto:"25"`
+	// Debug marks debug traced requests which are not real traffic, added in version 4
+	Debug bool `json:"debug,omitempty" proto:"26"`
+}
+
+func (RequestEvent) Schema() Schema {
+	return Schema{ID: SchemaIDRequestEvent, Name: "request_event", Version: RequestEventSchemaVersion}
+}
+
+// RequestEventFilter tells how many ad tags were passed and rejected by a filter
+type RequestEventFilter struct {
+	Name     string `json:"name" proto:"1"`
+	Passed   int    `json:"passed" proto:"2"`
+	Rejected int    `json:"rejected" proto:"3"`
 }
@@ -0,0 +1,245 @@
+package message_format
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("truncated protobuf message")
+
+type protoField struct {
+	index    int
+	number   uint64
+	wireType int
+	// repeated fields are slices of strings or of nested messages
+	repeated bool
+}
+
+// protoFields are cached by struct type
+var protoFields sync.Map
+
+// fieldsOf returns fields with "proto" tag, the tag is the protobuf field number
+func fieldsOf(t reflect.Type) ([]protoField, error) {
+	if cached, ok := protoFields.Load(t); ok {
+		return cached.([]protoField), nil
+	}
+
+	var fields []protoField
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("proto")
+		if tag == "" {
+			continue
+		}
+		number, err := strconv.ParseUint(tag, 10, 29)
+		if err != nil || number == 0 {
+			return nil, fmt.Errorf("%s.%s: invalid proto field number %q", t.Name(), t.Field(i).Name, tag)
+		}
+
+		field := protoField{index: i, number: number}
+		switch t.Field(i).Type.Kind() {
+		case reflect.String:
+			field.wireType = wireBytes
+		case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			field.wireType = wireVarint
+		case reflect.Float64:
+			field.wireType = wireFixed64
+		case reflect.Float32:
+			field.wireType = wireFixed32
+		case reflect.Slice:
+			elemKind := t.Field(i).Type.Elem().Kind()
+			if elemKind != reflect.String && elemKind != reflect.Struct {
+				return nil, fmt.Errorf("%s.%s: unsupported proto field type %s", t.Name(), t.Field(i).Name, t.Field(i).Type)
+			}
+			field.wireType = wireBytes
+			field.repeated = true
+		default:
+			return nil, fmt.Errorf("%s.%s: unsupported proto field type %s", t.Name(), t.Field(i).Name, t.Field(i).Type)
+		}
+		fields = append(fields, field)
+	}
+
+	protoFields.Store(t, fields)
+	return fields, nil
+}
+
+// marshalProto encodes struct fields tagged with "proto" as proto3 scalars,
+// repeated strings and repeated nested messages. Zero values are omitted.
+func marshalProto(message interface{}) ([]byte, error) {
+	value := reflect.Indirect(reflect.ValueOf(message))
+	fields, err := fieldsOf(value.Type())
+	if err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, 0, 128)
+	for _, field := range fields {
+		fieldValue := value.Field(field.index)
+		if isZero(fieldValue) {
+			continue
+		}
+
+		if field.repeated {
+			for i := 0; i < fieldValue.Len(); i++ {
+				var element []byte
+				if fieldValue.Index(i).Kind() == reflect.String {
+					element = []byte(fieldValue.Index(i).String())
+				} else if element, err = marshalProto(fieldValue.Index(i).Interface()); err != nil {
+					return nil, err
+				}
+				buffer = appendVarint(buffer, field.number<<3|uint64(field.wireType))
+				buffer = appendVarint(buffer, uint64(len(element)))
+				buffer = append(buffer, element...)
+			}
+			continue
+		}
+
+		buffer = appendVarint(buffer, field.number<<3|uint64(field.wireType))
+		switch fieldValue.Kind() {
+		case reflect.String:
+			buffer = appendVarint(buffer, uint64(fieldValue.Len()))
+			buffer = append(buffer, fieldValue.String()...)
+		case reflect.Bool:
+			buffer = appendVarint(buffer, 1)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			// Negative values take 10 bytes, the same as protobuf int32 and int64
+			buffer = appendVarint(buffer, uint64(fieldValue.Int()))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			buffer = appendVarint(buffer, fieldValue.Uint())
+		case reflect.Float64:
+			var fixed [8]byte
+			binary.LittleEndian.PutUint64(fixed[:], math.Float64bits(fieldValue.Float()))
+			buffer = append(buffer, fixed[:]...)
+		case reflect.Float32:
+			var fixed [4]byte
+			binary.LittleEndian.PutUint32(fixed[:], math.Float32bits(float32(fieldValue.Float())))
+			buffer = append(buffer, fixed[:]...)
+		}
+	}
+	return buffer, nil
+}
+
+// unmarshalProto decodes protobuf into struct fields tagged with "proto", unknown fields are skipped
+func unmarshalProto(data []byte, message interface{}) error {
+	value := reflect.Indirect(reflect.ValueOf(message))
+	fields, err := fieldsOf(value.Type())
+	if err != nil {
+		return err
+	}
+
+	byNumber := make(map[uint64]protoField, len(fields))
+	for _, field := range fields {
+		byNumber[field.number] = field
+	}
+
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+		data = data[n:]
+		number, wireType := key>>3, int(key&7)
+
+		var varint uint64
+		var bytes []byte
+		switch wireType {
+		case wireVarint:
+			varint, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errTruncated
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errTruncated
+			}
+			varint = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return errTruncated
+			}
+			varint = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errTruncated
+			}
+			bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", wireType)
+		}
+
+		field, known := byNumber[number]
+		if !known {
+			continue
+		}
+		if field.wireType != wireType {
+			return fmt.Errorf("field %d: wire type %d, expected %d", number, wireType, field.wireType)
+		}
+
+		fieldValue := value.Field(field.index)
+		switch fieldValue.Kind() {
+		case reflect.Slice:
+			element := reflect.New(fieldValue.Type().Elem()).Elem()
+			if element.Kind() == reflect.String {
+				element.SetString(string(bytes))
+			} else if err := unmarshalProto(bytes, element.Addr().Interface()); err != nil {
+				return err
+			}
+			fieldValue.Set(reflect.Append(fieldValue, element))
+		case reflect.String:
+			fieldValue.SetString(string(bytes))
+		case reflect.Bool:
+			fieldValue.SetBool(varint != 0)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			fieldValue.SetInt(int64(varint))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			fieldValue.SetUint(varint)
+		case reflect.Float64:
+			fieldValue.SetFloat(math.Float64frombits(varint))
+		case reflect.Float32:
+			fieldValue.SetFloat(float64(math.Float32frombits(uint32(varint))))
+		}
+	}
+	return nil
+}
+
+func appendVarint(buffer []byte, value uint64) []byte {
+	var varint [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(varint[:], value)
+	return append(buffer, varint[:n]...)
+}
+
+func isZero(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.String:
+		return value.Len() == 0
+	case reflect.Bool:
+		return !value.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return value.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return value.Float() == 0
+	case reflect.Slice:
+		return value.Len() == 0
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package rotator
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/metrics"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/request_context"
+)
+
+// DSP response results
+const (
+	dspResultBid        = "bid"
+	dspResultBelowFloor = "below_floor"
+	dspResultInvalid    = "invalid"
+	dspResultTimeout    = "timeout"
+	dspResultEmpty      = "empty"
+)
+
+// Buckets start at the old redis time buckets (100us - 5ms), bidder requests take up to DSP timeout
+var requestDurationBuckets = []float64{
+	0.0001, 0.00025, 0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1,
+}
+
+var (
+	requestsTotal = metrics.NewCounterVec(
+		"rotator_requests_total",
+		"Requests by handler, publisher and outcome",
+		"handler", "publisher_id", "outcome",
+	)
+	requestDuration = metrics.NewHistogramVec(
+		"rotator_request_duration_seconds",
+		"Request handling latency",
+		requestDurationBuckets,
+		"handler",
+	)
+	noFillTotal = metrics.NewCounterVec(
+		"rotator_no_fill_total",
+		"Requests which were not filled by handler and reason",
+		"handler", "reason",
+	)
+	dspResponsesTotal = metrics.NewCounterVec(
+		"rotator_dsp_responses_total",
+		"DSP bid responses by advertiser and result: bid, below_floor, invalid, timeout or empty",
+		"advertiser_id", "result",
+	)
+
+	_ = metrics.NewGaugeFunc(
+		"rotator_serving_data_age_seconds",
+		"Time since serving data was fetched from its source",
+		func() []metrics.Sample {
+			if data.ServingData == nil {
+				return nil
+			}
+			snapshot := data.ServingData.Snapshot()
+			if snapshot == nil {
+				return nil
+			}
+			return []metrics.Sample{{Value: snapshot.Age().Seconds()}}
+		},
+	)
+	_ = metrics.NewGaugeFunc(
+		"rotator_serving_data_version",
+		"Version of serving data snapshot in use",
+		func() []metrics.Sample {
+			if data.ServingData == nil {
+				return nil
+			}
+			snapshot := data.ServingData.Snapshot()
+			if snapshot == nil {
+				return nil
+			}
+			return []metrics.Sample{{Value: float64(snapshot.Data.Version)}}
+		},
+	)
+	_ = metrics.NewCounterFunc(
+		"rotator_kafka_messages_total",
+		"Kafka messages by topic and result: delivered, failed, spooled or dropped",
+		collectKafkaMessages,
+		"topic", "result",
+	)
+	_ = metrics.NewGaugeFunc(
+		"rotator_kafka_spool_pending",
+		"Kafka messages waiting in the spool for replay",
+		func() []metrics.Sample {
+			spool := GetKafkaDeliveryHealth().Spool
+			if spool == nil {
+				return nil
+			}
+			return []metrics.Sample{{Value: float64(spool.Pending)}}
+		},
+	)
+)
+
+// observeRequest is called by sendRequestEvent once the decision is final
+func observeRequest(requestContext *request_context.RequestContext, decision *request_context.Decision) {
+	requestsTotal.Inc(requestContext.Endpoint, strconv.FormatUint(requestContext.PublisherID, 10), decision.Outcome)
+	requestDuration.Observe(time.Since(requestContext.ReceivedAt).Seconds(), requestContext.Endpoint)
+	if decision.Outcome != request_context.OutcomeFilled {
+		noFillTotal.Inc(requestContext.Endpoint, decision.Reason)
+	}
+}
+
+func observeDSPResponse(advertiserID uint64, result string) {
+	dspResponsesTotal.Inc(strconv.FormatUint(advertiserID, 10), result)
+}
+
+func collectKafkaMessages() []metrics.Sample {
+	topics := GetKafkaDeliveryHealth().Topics
+	names := make([]string, 0, len(topics))
+	for topic := range topics {
+		names = append(names, topic)
+	}
+	sort.Strings(names)
+
+	samples := make([]metrics.Sample, 0, len(names)*4)
+	for _, topic := range names {
+		stats := topics[topic]
+		samples = append(samples,
+			metrics.Sample{LabelValues: []string{topic, "delivered"}, Value: float64(stats.Delivered)},
+			metrics.Sample{LabelValues: []string{topic, "failed"}, Value: float64(stats.Failed)},
+			metrics.Sample{LabelValues: []string{topic, "spooled"}, Value: float64(stats.Spooled)},
+			metrics.Sample{LabelValues: []string{topic, "dropped"}, Value: float64(stats.Dropped)},
+		)
+	}
+	return samples
+}
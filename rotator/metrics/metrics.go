@@ -0,0 +1,338 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultRegistry is exposed by Handler, all New* functions register metrics in it
+var DefaultRegistry = NewRegistry()
+
+// Sample is a single value of a metric reported by collector function
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+type collector interface {
+	name() string
+	write(buffer *bytes.Buffer)
+}
+
+// Registry keeps metrics and writes them in Prometheus text format
+type Registry struct {
+	lock       sync.Mutex
+	collectors map[string]collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]collector)}
+}
+
+func (r *Registry) register(c collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, exists := r.collectors[c.name()]; exists {
+		panic(fmt.Sprintf("metric %s is already registered", c.name()))
+	}
+	r.collectors[c.name()] = c
+}
+
+// WriteText writes all metrics sorted by name
+func (r *Registry) WriteText(buffer *bytes.Buffer) {
+	r.lock.Lock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	collectors := r.collectors
+	r.lock.Unlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		collectors[name].write(buffer)
+	}
+}
+
+// Handler exposes DefaultRegistry for Prometheus
+func Handler(w http.ResponseWriter, r *http.Request) {
+	var buffer bytes.Buffer
+	DefaultRegistry.WriteText(&buffer)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buffer.Bytes())
+}
+
+// vec keeps metric children by label values
+type vec struct {
+	metricName string
+	help       string
+	metricType string
+	labelNames []string
+
+	lock     sync.RWMutex
+	children map[string]interface{}
+	newChild func() interface{}
+}
+
+func (v *vec) name() string {
+	return v.metricName
+}
+
+func (v *vec) child(labelValues []string) interface{} {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", v.metricName, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	v.lock.RLock()
+	child, exists := v.children[key]
+	v.lock.RUnlock()
+	if exists {
+		return child
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	child, exists = v.children[key]
+	if !exists {
+		child = v.newChild()
+		v.children[key] = child
+	}
+	return child
+}
+
+// sortedChildren returns label values and children sorted by label values
+func (v *vec) sortedChildren() ([][]string, []interface{}) {
+	v.lock.RLock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	labelValues := make([][]string, len(keys))
+	children := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if len(v.labelNames) > 0 {
+			labelValues[i] = strings.Split(key, "\xff")
+		}
+		children[i] = v.children[key]
+	}
+	v.lock.RUnlock()
+	return labelValues, children
+}
+
+func (v *vec) writeHeader(buffer *bytes.Buffer) {
+	fmt.Fprintf(buffer, "# HELP %s %s\n", v.metricName, escapeHelp(v.help))
+	fmt.Fprintf(buffer, "# TYPE %s %s\n", v.metricName, v.metricType)
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	vec
+}
+
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{vec{
+		metricName: name,
+		help:       help,
+		metricType: "counter",
+		labelNames: labelNames,
+		children:   make(map[string]interface{}),
+		newChild:   func() interface{} { return new(float64Value) },
+	}}
+	DefaultRegistry.register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	c.child(labelValues).(*float64Value).add(value)
+}
+
+func (c *CounterVec) write(buffer *bytes.Buffer) {
+	c.writeHeader(buffer)
+	labelValues, children := c.sortedChildren()
+	for i, child := range children {
+		writeSample(buffer, c.metricName, c.labelNames, labelValues[i], "", "", child.(*float64Value).get())
+	}
+}
+
+// HistogramVec counts observations in cumulative buckets, partitioned by labels
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	h := &HistogramVec{buckets: buckets}
+	h.vec = vec{
+		metricName: name,
+		help:       help,
+		metricType: "histogram",
+		labelNames: labelNames,
+		children:   make(map[string]interface{}),
+		newChild: func() interface{} {
+			return &histogram{counts: make([]uint64, len(buckets))}
+		},
+	}
+	DefaultRegistry.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	child := h.child(labelValues).(*histogram)
+	for i, bound := range h.buckets {
+		if value <= bound {
+			atomic.AddUint64(&child.counts[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&child.count, 1)
+	child.sum.add(value)
+}
+
+func (h *HistogramVec) write(buffer *bytes.Buffer) {
+	h.writeHeader(buffer)
+	labelValues, children := h.sortedChildren()
+	for i, c := range children {
+		child := c.(*histogram)
+
+		var cumulative uint64
+		for j, bound := range h.buckets {
+			cumulative += atomic.LoadUint64(&child.counts[j])
+			writeSample(buffer, h.metricName+"_bucket", h.labelNames, labelValues[i],
+				"le", formatFloat(bound), float64(cumulative))
+		}
+		count := atomic.LoadUint64(&child.count)
+		writeSample(buffer, h.metricName+"_bucket", h.labelNames, labelValues[i], "le", "+Inf", float64(count))
+		writeSample(buffer, h.metricName+"_sum", h.labelNames, labelValues[i], "", "", child.sum.get())
+		writeSample(buffer, h.metricName+"_count", h.labelNames, labelValues[i], "", "", float64(count))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64Value
+}
+
+// FuncCollector reports values computed on every scrape, e.g. serving data age
+type FuncCollector struct {
+	vec
+	collect func() []Sample
+}
+
+// NewGaugeFunc registers a gauge whose samples are returned by collect
+func NewGaugeFunc(name, help string, collect func() []Sample, labelNames ...string) *FuncCollector {
+	return newFuncCollector(name, help, "gauge", collect, labelNames)
+}
+
+// NewCounterFunc registers a counter maintained elsewhere, e.g. kafka delivery stats
+func NewCounterFunc(name, help string, collect func() []Sample, labelNames ...string) *FuncCollector {
+	return newFuncCollector(name, help, "counter", collect, labelNames)
+}
+
+func newFuncCollector(name, help, metricType string, collect func() []Sample, labelNames []string) *FuncCollector {
+	f := &FuncCollector{
+		vec: vec{
+			metricName: name,
+			help:       help,
+			metricType: metricType,
+			labelNames: labelNames,
+		},
+		collect: collect,
+	}
+	DefaultRegistry.register(f)
+	return f
+}
+
+func (f *FuncCollector) write(buffer *bytes.Buffer) {
+	f.writeHeader(buffer)
+	for _, sample := range f.collect() {
+		writeSample(buffer, f.metricName, f.labelNames, sample.LabelValues, "", "", sample.Value)
+	}
+}
+
+// float64Value is a float64 updated atomically
+type float64Value struct {
+	bits uint64
+}
+
+func (f *float64Value) add(value float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		updated := math.Float64bits(math.Float64frombits(old) + value)
+		if atomic.CompareAndSwapUint64(&f.bits, old, updated) {
+			return
+		}
+	}
+}
+
+func (f *float64Value) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
+
+func writeSample(
+	buffer *bytes.Buffer, name string, labelNames, labelValues []string, extraName, extraValue string, value float64,
+) {
+	buffer.WriteString(name)
+	if len(labelNames) > 0 || extraName != "" {
+		buffer.WriteByte('{')
+		for i, labelName := range labelNames {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			var labelValue string
+			if i < len(labelValues) {
+				labelValue = labelValues[i]
+			}
+			fmt.Fprintf(buffer, `%s="%s"`, labelName, escapeLabelValue(labelValue))
+		}
+		if extraName != "" {
+			if len(labelNames) > 0 {
+				buffer.WriteByte(',')
+			}
+			fmt.Fprintf(buffer, `%s="%s"`, extraName, extraValue)
+		}
+		buffer.WriteByte('}')
+	}
+	buffer.WriteByte(' ')
+	buffer.WriteString(formatFloat(value))
+	buffer.WriteByte('\n')
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return helpReplacer.Replace(help)
+}
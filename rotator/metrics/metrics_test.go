@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTextExposition(t *testing.T) {
+	saved := DefaultRegistry
+	DefaultRegistry = NewRegistry()
+	defer func() { DefaultRegistry = saved }()
+
+	requests := NewCounterVec("test_requests_total", "Requests", "handler", "outcome")
+	requests.Inc("/rotator", "filled")
+	requests.Add(2, "/rotator", "no_fill")
+	requests.Inc(`/a"b`, "filled")
+
+	duration := NewHistogramVec("test_duration_seconds", "Latency", []float64{0.1, 1}, "handler")
+	duration.Observe(0.05, "/rotator")
+	duration.Observe(0.5, "/rotator")
+	duration.Observe(5, "/rotator")
+
+	NewGaugeFunc("test_age_seconds", "Age", func() []Sample {
+		return []Sample{{Value: 1.5}}
+	})
+
+	var buffer bytes.Buffer
+	DefaultRegistry.WriteText(&buffer)
+
+	expected := `# HELP test_age_seconds Age
+# TYPE test_age_seconds gauge
+test_age_seconds 1.5
+# HELP test_duration_seconds Latency
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{handler="/rotator",le="0.1"} 1
+test_duration_seconds_bucket{handler="/rotator",le="1"} 2
+test_duration_seconds_bucket{handler="/rotator",le="+Inf"} 3
+test_duration_seconds_sum{handler="/rotator"} 5.55
+test_duration_seconds_count{handler="/rotator"} 3
+# HELP test_requests_total Requests
+# TYPE test_requests_total counter
+test_requests_total{handler="/a\"b",outcome="filled"} 1
+test_requests_total{handler="/rotator",outcome="filled"} 1
+test_requests_total{handler="/rotator",outcome="no_fill"} 2
+`
+	if buffer.String() != expected {
+		t.Errorf("unexpected exposition:\n%s", buffer.String())
+	}
+}
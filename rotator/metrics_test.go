@@ -0,0 +1,27 @@
+package rotator
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/metrics"
+)
+
+func TestMetricsWithoutServingData(t *testing.T) {
+	defer func(servingData *data.ParsedServingData) { data.ServingData = servingData }(data.ServingData)
+	data.ServingData = nil
+
+	w := httptest.NewRecorder()
+	metrics.Handler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, "rotator_serving_data_version ") {
+			t.Errorf("serving data version is reported before serving data is created: %s", line)
+		}
+	}
+}
@@ -7,6 +7,12 @@ import (
 	"bitbucket.org/tapgerine/traffic_rotator/rotator/redis_handler"
 )
 
+// DomainsListLookup returns type of the domain in domains list stored under listKey: "white" or "black",
+// error means domain is not in the list. Lists are kept in redis, simulations replace the lookup.
+var DomainsListLookup = func(listKey, domain string) (string, error) {
+	return redis_handler.RedisConnection.HGet(listKey, domain).Result()
+}
+
 type PublisherLink struct {
 	Data data.PublisherLinkData
 }
@@ -22,7 +28,7 @@ func (p *PublisherLink) init(id string) error {
 
 func (p *PublisherLink) IsDomainAllowForThisLink(domain string) bool {
 	if p.Data.DomainsListID > 0 {
-		domainsListItem, err := redis_handler.RedisConnection.HGet(fmt.Sprintf("domains:%d", p.Data.DomainsListID), domain).Result()
+		domainsListItem, err := DomainsListLookup(fmt.Sprintf("domains:%d", p.Data.DomainsListID), domain)
 
 		if p.Data.DomainsListType == "white" && !(err == nil && domainsListItem == "white") {
 			// White list activated. Domain is not in the list
@@ -43,3 +49,7 @@ func (p *PublisherLink) GetPublisherID() (uint64, error) {
 func (p *PublisherLink) GetAdTagIDs() ([]string, error) {
 	return data.ServingData.GetAdTagIDsForPublisherLink(p.Data.ID)
 }
+
+func (p *PublisherLink) GetAdTags() ([]data.AdTagEntry, error) {
+	return data.ServingData.GetAdTagsForPublisherLink(p.Data.ID)
+}
@@ -0,0 +1,130 @@
+package request_context
+
+const (
+	OutcomeFilled   = "filled"
+	OutcomeNoFill   = "no_fill"
+	OutcomeRejected = "rejected"
+	OutcomeError    = "error"
+)
+
+// FilterOutcome tells how many ad tags a filter let through
+type FilterOutcome struct {
+	Name     string
+	Passed   int
+	Rejected int
+}
+
+// Decision describes how request was served. RequestContext keeps a pointer to it,
+// so it is shared by all copies of the context.
+type Decision struct {
+	Outcome           string
+	Reason            string
+	SelectionStrategy string
+	Candidates        int
+	SelectedAdTagIDs  []string
+	Filters           []FilterOutcome
+	// Trace is nil unless request asked for a decision trace
+	Trace *Trace
+}
+
+// Reject is used when request is invalid or not allowed, before ad tags are selected
+func (d *Decision) Reject(reason string) {
+	d.Outcome = OutcomeRejected
+	d.Reason = reason
+}
+
+func (d *Decision) NoFill(reason string) {
+	d.Outcome = OutcomeNoFill
+	d.Reason = reason
+}
+
+func (d *Decision) Fail(reason string) {
+	d.Outcome = OutcomeError
+	d.Reason = reason
+}
+
+func (d *Decision) Fill(selectionStrategy string, adTagIDs ...string) {
+	d.Outcome = OutcomeFilled
+	d.Reason = ""
+	d.SelectionStrategy = selectionStrategy
+	d.SelectedAdTagIDs = adTagIDs
+	d.TraceSelected(adTagIDs...)
+}
+
+func (d *Decision) AddFilter(name string, passed, rejected int) {
+	d.Filters = append(d.Filters, FilterOutcome{Name: name, Passed: passed, Rejected: rejected})
+}
+
+// StartTrace makes decision collect per candidate verdicts, it is used for debug requests only
+func (d *Decision) StartTrace() {
+	d.Trace = &Trace{candidates: make(map[string]*TraceCandidate)}
+}
+
+func (d *Decision) Tracing() bool {
+	return d != nil && d.Trace != nil
+}
+
+// TraceVerdict records filter verdict for a candidate, reason explains rejection
+func (d *Decision) TraceVerdict(candidateID, filter string, passed bool, reason string) {
+	if !d.Tracing() {
+		return
+	}
+	candidate := d.Trace.candidate(candidateID)
+	candidate.Verdicts = append(candidate.Verdicts, TraceVerdict{Filter: filter, Passed: passed, Reason: reason})
+	if !passed {
+		candidate.Passed = false
+	}
+}
+
+// TraceWeight records weight a selector gave to a candidate, phase tells how the weight was used
+func (d *Decision) TraceWeight(candidateID string, weight float64, phase string) {
+	if !d.Tracing() {
+		return
+	}
+	candidate := d.Trace.candidate(candidateID)
+	candidate.Weight = weight
+	candidate.Phase = phase
+}
+
+func (d *Decision) TraceSelected(candidateIDs ...string) {
+	if !d.Tracing() {
+		return
+	}
+	for _, id := range candidateIDs {
+		d.Trace.candidate(id).Selected = true
+	}
+}
+
+// Trace explains a decision candidate by candidate
+type Trace struct {
+	Candidates []*TraceCandidate `json:"candidates"`
+
+	candidates map[string]*TraceCandidate
+}
+
+// TraceCandidate is an ad tag or a DSP considered for the request
+type TraceCandidate struct {
+	ID       string         `json:"id"`
+	Passed   bool           `json:"passed"`
+	Verdicts []TraceVerdict `json:"verdicts,omitempty"`
+	Weight   float64        `json:"weight,omitempty"`
+	Phase    string         `json:"phase,omitempty"`
+	Selected bool           `json:"selected"`
+}
+
+type TraceVerdict struct {
+	Filter string `json:"filter"`
+	Passed bool   `json:"passed"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// candidate keeps candidates in the order they were first traced
+func (t *Trace) candidate(id string) *TraceCandidate {
+	candidate, exists := t.candidates[id]
+	if !exists {
+		candidate = &TraceCandidate{ID: id, Passed: true}
+		t.candidates[id] = candidate
+		t.Candidates = append(t.Candidates, candidate)
+	}
+	return candidate
+}
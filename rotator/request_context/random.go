@@ -0,0 +1,52 @@
+package request_context
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	seedsLock sync.Mutex
+	seeds     = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// NewRandomSeed returns seed for random source of a new request
+func NewRandomSeed() int64 {
+	seedsLock.Lock()
+	defer seedsLock.Unlock()
+	return seeds.Int63()
+}
+
+// NewRandom returns random source seeded with the seed. Sequence of a seed never changes,
+// so random choices of a request could be reproduced from its logged seed.
+func NewRandom(seed int64) *rand.Rand {
+	return rand.New(&splitMixSource{state: uint64(seed)})
+}
+
+// SeedRandom sets random source of the request, selection and auction code must use it instead of math/rand
+func (r *RequestContext) SeedRandom(seed int64) {
+	r.RandomSeed = seed
+	r.Random = NewRandom(seed)
+}
+
+// splitMixSource is SplitMix64 generator, unlike rand.NewSource it is cheap to create for every request
+type splitMixSource struct {
+	state uint64
+}
+
+func (s *splitMixSource) Seed(seed int64) {
+	s.state = uint64(seed)
+}
+
+func (s *splitMixSource) Uint64() uint64 {
+	s.state += 0x9e3779b97f4a7c15
+	z := s.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *splitMixSource) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
@@ -0,0 +1,14 @@
+package request_context
+
+import "testing"
+
+// Logged seeds must replay the same choices after upgrades, so the sequence of a seed is fixed
+func TestRandomSequenceIsStable(t *testing.T) {
+	random := NewRandom(1)
+	if value := random.Uint64(); value != 10451216379200822465 {
+		t.Errorf("unexpected first value %d", value)
+	}
+	if first, second := random.Intn(1000), random.Intn(1000); first != 128 || second != 535 {
+		t.Errorf("unexpected values %d, %d", first, second)
+	}
+}
@@ -1,6 +1,7 @@
 package request_context
 
 import (
+	"math/rand"
 	"net"
 	"net/http"
 
@@ -9,6 +10,8 @@ import (
 
 	"fmt"
 
+	"time"
+
 	"github.com/mssola/user_agent"
 	uuid "github.com/satori/go.uuid"
 )
@@ -36,6 +39,15 @@ type RequestContext struct {
 	DevicePlatformType   string
 	VastVersion          int
 	DoNotTrack           int
+	Endpoint             string
+	ReceivedAt           time.Time
+	Decision             *Decision
+	// Random is the only random source selection and auction code may use, see SeedRandom
+	Random     *rand.Rand
+	RandomSeed int64
+	// Experiment and ExperimentArm are set if publisher link traffic is split by an experiment
+	Experiment    string
+	ExperimentArm string
 }
 
 type UserContext struct {
@@ -69,6 +81,14 @@ type UserAgentOS struct {
 	Name string
 }
 
+// UserKey identifies user by IP and user agent, it is empty if IP is unknown
+func (r *RequestContext) UserKey() string {
+	if r.User.IP == nil {
+		return ""
+	}
+	return r.User.IP.String() + "|" + r.User.UserAgentString
+}
+
 func (r *RequestContext) ParseIP(ipFromRequest string, req *http.Request) {
 	ipFromRequest = strings.TrimSpace(ipFromRequest)
 	if ipFromRequest != "" {
@@ -97,6 +117,7 @@ func (r *RequestContext) ParseGeo() error {
 func (r *RequestContext) ParseUserAgent() {
 	if r.User.UserAgentString == "" {
 		r.User.UserAgent.DeviceType = "undefined"
+		r.DevicePlatformType = r.User.UserAgent.DeviceType
 		return
 	}
 
@@ -108,6 +129,8 @@ func (r *RequestContext) ParseUserAgent() {
 	} else {
 		r.User.UserAgent.DeviceType = "desktop"
 	}
+	// Platform of publisher link may override it, see SetRequestPlatform
+	r.DevicePlatformType = r.User.UserAgent.DeviceType
 
 	r.User.UserAgent.IsBot = ua.Bot()
 	r.User.UserAgent.OS.Name = ua.OS()
@@ -0,0 +1,155 @@
+package rotator
+
+import (
+	"net/http"
+	"time"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/message_format"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/request_context"
+)
+
+// Selection strategies reported in request events. Selectors are reported by their names,
+// ranked selections of VPAID responses have "_many" suffix.
+const (
+	strategyDirect         = "direct"
+	strategyERPR           = "erpr"
+	strategyFillRate       = "fill_rate"
+	strategyDomainFillRate = "domain_fill_rate"
+	strategyThompson       = "thompson"
+	strategyGeoFallback    = "geo_fallback_random"
+	strategyGeoFallbackAll = "geo_fallback_all"
+	strategyLegacyERPR     = "legacy_erpr"
+	strategyLegacyERPRMany = "legacy_erpr_many"
+	strategyRTBInit        = "rtb_init"
+	strategyRTBAuction     = "rtb_auction"
+)
+
+// Reasons of requests which were not filled
+const (
+	reasonUnknown            = "unknown"
+	reasonInvalidRequest     = "invalid_request"
+	reasonNoPublisherLink    = "no_publisher_link"
+	reasonNoPrice            = "no_price"
+	reasonDomainBlocked      = "domain_blocked"
+	reasonNoAdTags           = "no_ad_tags"
+	reasonAllFiltered        = "all_filtered"
+	reasonNothingSelected    = "nothing_selected"
+	reasonResponseGeneration = "response_generation"
+	reasonNoBids             = "no_bids"
+	reasonDebugTrace         = "debug_trace"
+)
+
+// beginRequest prepares context for the request event, handlers must use returned writer
+// and defer finishRequest with it. Writer is replaced for requests asking for a decision trace.
+func beginRequest(
+	w http.ResponseWriter, requestContext *request_context.RequestContext, endpoint string, receivedAt time.Time,
+) http.ResponseWriter {
+	requestContext.Endpoint = endpoint
+	requestContext.ReceivedAt = receivedAt
+	requestContext.Decision = &request_context.Decision{}
+	w = startDecisionTrace(w, requestContext)
+	requestContext.SeedRandom(requestRandomSeed(requestContext))
+	return w
+}
+
+// finishRequest sends request event and writes decision trace if it was requested
+func finishRequest(w http.ResponseWriter, requestContext *request_context.RequestContext) {
+	sendRequestEvent(requestContext)
+	if tracingWriter, ok := w.(*tracingResponseWriter); ok {
+		writeDecisionTrace(tracingWriter, requestContext)
+	}
+}
+
+// sendRequestEvent sends canonical request event once the decision is final
+func sendRequestEvent(requestContext *request_context.RequestContext) {
+	decision := requestContext.Decision
+	if decision == nil {
+		decision = &request_context.Decision{}
+	}
+	if decision.Outcome == "" {
+		decision.Reject(reasonUnknown)
+	}
+	// Debug traced requests are not real traffic
+	if !decision.Tracing() {
+		observeRequest(requestContext, decision)
+	}
+
+	msg := message_format.RequestEvent{
+		RequestID:         requestContext.RequestID.String(),
+		Timestamp:         requestContext.ReceivedAt.Unix(),
+		Endpoint:          requestContext.Endpoint,
+		RequestType:       requestContext.Type,
+		ResponseType:      requestContext.ResponseType,
+		VastVersion:       requestContext.VastVersion,
+		Outcome:           decision.Outcome,
+		Reason:            decision.Reason,
+		PublisherID:       requestContext.PublisherID,
+		TargetingID:       requestContext.PublisherTargetingID,
+		PublisherPrice:    requestContext.PublisherPrice,
+		Platform:          requestContext.RequestPlatform,
+		DeviceType:        requestContext.DevicePlatformType,
+		GeoCountry:        requestContext.User.Geo.Country.ISOCode,
+		Domain:            requestContext.Domain,
+		AppName:           requestContext.AppName,
+		BundleID:          requestContext.BundleID,
+		SelectionStrategy: decision.SelectionStrategy,
+		SelectedAdTagIDs:  decision.SelectedAdTagIDs,
+		Candidates:        decision.Candidates,
+		LatencyMicros:     int64(time.Since(requestContext.ReceivedAt) / time.Microsecond),
+		RandomSeed:        requestContext.RandomSeed,
+		Experiment:        requestContext.Experiment,
+		ExperimentArm:     requestContext.ExperimentArm,
+		Debug:             decision.Tracing(),
+	}
+	for _, filter := range decision.Filters {
+		msg.Filters = append(msg.Filters, message_format.RequestEventFilter{
+			Name:     filter.Name,
+			Passed:   filter.Passed,
+			Rejected: filter.Rejected,
+		})
+	}
+
+	sendEvent(EventTypeRequestEvents, &msg, requestContext.ReceivedAt, requestContextKeys(*requestContext))
+}
+
+// applyFilter runs legacy filter, which blanks keys of rejected ad tags, and records how many ad tags it rejected
+func applyFilter(
+	requestContext request_context.RequestContext, name string, adTags *map[string]data.AdTagData, adTagKeys *[]string,
+	filter func(request_context.RequestContext, *map[string]data.AdTagData, *[]string),
+) {
+	var keysBefore []string
+	if requestContext.Decision.Tracing() {
+		keysBefore = append(keysBefore, *adTagKeys...)
+	}
+
+	passedBefore := countNotEmpty(*adTagKeys)
+	filter(requestContext, adTags, adTagKeys)
+	passedAfter := countNotEmpty(*adTagKeys)
+	requestContext.Decision.AddFilter(name, passedAfter, passedBefore-passedAfter)
+
+	// Legacy filters do not explain rejections
+	for i, key := range keysBefore {
+		if key != "" {
+			requestContext.Decision.TraceVerdict(key, name, (*adTagKeys)[i] != "", "")
+		}
+	}
+}
+
+func countNotEmpty(keys []string) int {
+	var count int
+	for _, key := range keys {
+		if key != "" {
+			count++
+		}
+	}
+	return count
+}
+
+func adTagContextIDs(adTags []*AdTagContext) []string {
+	ids := make([]string, len(adTags))
+	for i, adTag := range adTags {
+		ids[i] = adTag.ID
+	}
+	return ids
+}
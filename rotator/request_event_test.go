@@ -0,0 +1,77 @@
+package rotator
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/event_sink"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/message_format"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/metrics"
+)
+
+func TestRequestEventOnRejectedRequest(t *testing.T) {
+	sink := event_sink.NewMemorySink()
+	Events = sink
+	defer func() { Events = event_sink.DiscardSink{} }()
+
+	w := httptest.NewRecorder()
+	AdRotationHandler(w, httptest.NewRequest("GET", "/rotator", nil))
+
+	events := sink.Events(EventTypeRequestEvents)
+	if len(events) != 1 {
+		t.Fatalf("expected 1 request event, got %d", len(events))
+	}
+
+	var event message_format.RequestEvent
+	if err := message_format.Decode(events[0].Payload, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Endpoint != "/rotator" || event.Outcome != "rejected" || event.Reason != reasonInvalidRequest {
+		t.Errorf("unexpected request event %+v", event)
+	}
+	if events[0].Keys[KafkaKeyRequestID] != event.RequestID {
+		t.Errorf("request event is not keyed by request id")
+	}
+}
+
+func TestTracedRequestEventIsMarkedDebug(t *testing.T) {
+	sink := event_sink.NewMemorySink()
+	Events = sink
+	defer func() { Events = event_sink.DiscardSink{} }()
+	DebugTraceKey = []byte("secret")
+	defer func() { DebugTraceKey = nil }()
+
+	requestMetrics := func() string {
+		w := httptest.NewRecorder()
+		metrics.Handler(w, httptest.NewRequest("GET", "/metrics", nil))
+		var lines []string
+		for _, line := range strings.Split(w.Body.String(), "\n") {
+			if strings.HasPrefix(line, "rotator_requests_total{") {
+				lines = append(lines, line)
+			}
+		}
+		return strings.Join(lines, "\n")
+	}
+	metricsBefore := requestMetrics()
+
+	r := httptest.NewRequest("GET", "/rotator", nil)
+	r.Header.Set(debugTraceHeader, "1")
+	r.Header.Set("X-Admin-Token", "secret")
+	AdRotationHandler(httptest.NewRecorder(), r)
+
+	events := sink.Events(EventTypeRequestEvents)
+	if len(events) != 1 {
+		t.Fatalf("expected 1 request event, got %d", len(events))
+	}
+	var event message_format.RequestEvent
+	if err := message_format.Decode(events[0].Payload, &event); err != nil {
+		t.Fatal(err)
+	}
+	if !event.Debug {
+		t.Error("request event of traced request is not marked as debug")
+	}
+	if requestMetrics() != metricsBefore {
+		t.Error("traced request was counted in metrics")
+	}
+}
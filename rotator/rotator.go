@@ -33,17 +33,19 @@ func SinglePageUserData(w http.ResponseWriter, r *http.Request) {
 func AdRotationHandler(w http.ResponseWriter, r *http.Request) {
 	timestamp := time.Now().UTC()
 
-	// Logging request into redis
-	//hr, min, _ := timestamp.Clock()
-	//redis_handler.RedisConnection.HIncrBy(
-	//	fmt.Sprintf("requests:%s", timestamp.Format("2006-01-02")),
-	//	strconv.Itoa(hr*60+min),
-	//	1,
-	//)
+	requestContext := &request_context.RequestContext{
+		Request:   r,
+		Type:      "direct",
+		RequestID: uuid.NewV4(),
+		User:      request_context.UserContext{},
+	}
+	w = beginRequest(w, requestContext, "/rotator", timestamp)
+	defer finishRequest(w, requestContext)
 
 	adTagPubID := r.URL.Query().Get("adtagpubid")
 	if adTagPubID == "" {
 		w.WriteHeader(204)
+		requestContext.Decision.Reject(reasonInvalidRequest)
 		log.WithField("url", r.URL.String()).Warn("No adtagpubid in request")
 		return
 	}
@@ -53,21 +55,20 @@ func AdRotationHandler(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		w.WriteHeader(204)
+		requestContext.Decision.NoFill(reasonNoAdTags)
 		return
 	}
+	requestContext.Decision.Candidates = 1
+	requestContext.PublisherID = adTag.PublisherID
 
 	if (!adTag.IsActive || !adTag.IsAdTagPubActive) && !adTag.IsTest {
 		w.WriteHeader(204)
 		w.Header().Set("X-Not-Active", "true")
+		requestContext.Decision.AddFilter("activity", 0, 1)
+		requestContext.Decision.NoFill(reasonAllFiltered)
 		return
 	}
 
-	requestContext := &request_context.RequestContext{
-		Type:      "direct",
-		RequestID: uuid.NewV4(),
-		User:      request_context.UserContext{},
-	}
-
 	// Trying to resolve user data
 	ipParameterMapping, err := data.ServingData.GetOurPlatformParametersMapByNameAndID("ip", adTag.AdvertiserPlatformTypeID, "desktop")
 	if err != nil {
@@ -102,8 +103,8 @@ func AdRotationHandler(w http.ResponseWriter, r *http.Request) {
 	originalURL.RawQuery = mergedQuery.Encode()
 
 	SendRequestMessageToKafka(adTagPubID, requestContext.RequestID, timestamp,
-		requestContext.User.Geo.Country.ISOCode, requestContext.User.UserAgent.DeviceType,
-		requestContext.Domain,
+		requestContext.User.Geo.Country.ISOCode, requestContext.DevicePlatformType,
+		requestContext.Domain, requestContext.Decision.Tracing(),
 	)
 
 	if adTag.SupportsVast {
@@ -116,26 +117,25 @@ func AdRotationHandler(w http.ResponseWriter, r *http.Request) {
 			EncryptionKey,
 			requestContext.Type,
 			requestContext.User.Geo.Country.ISOCode,
-			requestContext.User.UserAgent.DeviceType,
+			requestContext.DevicePlatformType,
 			"", requestContext.Domain, "", "", 2,
 		)
 		if err != nil {
 			w.WriteHeader(204)
+			requestContext.Decision.Fail(reasonResponseGeneration)
 			// TODO: add error header mb?
 			log.WithField("url", r.URL.String()).WithError(err).Warn()
 			return
 		}
 
+		requestContext.ResponseType = "vast"
+		requestContext.VastVersion = 2
+		requestContext.Decision.Fill(strategyDirect, adTagPubID)
 		w.Header().Set("Content-Type", "application/xml")
 		w.Write([]byte(generatedVast))
 	} else {
+		requestContext.ResponseType = "redirect"
+		requestContext.Decision.Fill(strategyDirect, adTagPubID)
 		http.Redirect(w, r, originalURL.String(), 302)
 	}
-
-	//timePassed := time.Now().UTC().Sub(timestamp)
-	//redis_handler.RedisConnection.HIncrBy(
-	//	fmt.Sprintf("requests:%s:time", timestamp.Format("2006-01-02")),
-	//	getLogTimePassed(timePassed),
-	//	1,
-	//)
 }
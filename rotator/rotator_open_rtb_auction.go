@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"math/rand"
 	"net/http"
+	"sync"
 	"time"
 
 	"io/ioutil"
@@ -17,9 +18,18 @@ import (
 	"github.com/bsm/openrtb"
 )
 
+const (
+	// defaultBidFloorMargin is added to publisher price, so every won auction has a margin
+	defaultBidFloorMargin = 0.5
+	defaultBidTimeout     = 300 * time.Millisecond
+)
+
 var bidResponseTimeout = []byte("timeout")
 var bidResponseEmpty = []byte("empty")
 
+// bidRequestsInFlight tracks outstanding requests to DSPs, so they could be drained on shutdown
+var bidRequestsInFlight sync.WaitGroup
+
 type BidResponseMetadata struct {
 	BidResponseJSON []byte
 	AdvertiserID    uint64
@@ -41,8 +51,11 @@ type BidResponseItem struct {
 func AdRotationOpenRTBProcessorHandler(w http.ResponseWriter, r *http.Request) {
 	timestamp := time.Now().UTC()
 	requestContext, err := parseRequest(r)
+	w = beginRequest(w, &requestContext, "/rotator/target/bidder_processor", timestamp)
+	defer finishRequest(w, &requestContext)
 	if err != nil {
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.Reject(reasonInvalidRequest)
 		log.WithField("url", r.URL.String()).Warn(err)
 		return
 	}
@@ -50,12 +63,15 @@ func AdRotationOpenRTBProcessorHandler(w http.ResponseWriter, r *http.Request) {
 	var publisherLink PublisherLink
 	if err = publisherLink.init(requestContext.PublisherTargetingID); err != nil {
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.Reject(reasonNoPublisherLink)
 		return
 	}
+	publisherLink.enrollInExperiment(&requestContext, true)
 	requestContext.SetRequestPlatform(publisherLink.Data.Platform)
 	publisherID, err := publisherLink.GetPublisherID()
 	if err != nil {
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.Reject(reasonNoPublisherLink)
 		log.WithField("url", r.URL.String()).WithError(err).Warn()
 		SendRTBEventMessageToKafka(requestContext, "init_error", timestamp)
 		return
@@ -64,12 +80,14 @@ func AdRotationOpenRTBProcessorHandler(w http.ResponseWriter, r *http.Request) {
 
 	SendRTBEventMessageToKafka(requestContext, "auction", timestamp)
 
-	bidFloor := requestContext.PublisherPrice + 0.5
-	bidRequest := composeBidRequest(&requestContext, bidFloor)
+	bidFloorMargin, bidTimeout := auctionSettingsForLink(publisherLink.Data)
+	bidFloor := requestContext.PublisherPrice + bidFloorMargin
+	bidRequest := composeBidRequest(&requestContext, bidFloor, bidTimeout)
 
 	bidRequestJSON, err := json.Marshal(bidRequest)
 	if err != nil {
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.Fail(reasonInvalidRequest)
 		log.WithField("url", r.URL.String()).WithError(err).Warn()
 		return
 	}
@@ -77,14 +95,27 @@ func AdRotationOpenRTBProcessorHandler(w http.ResponseWriter, r *http.Request) {
 	dspList, err := data.ServingData.GetDSPAdvertisersList()
 	if err != nil {
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.NoFill(reasonNoBids)
 		log.WithField("url", r.URL.String()).WithError(err).Warn()
 		return
 	}
 
+	requestContext.Decision.Candidates = len(dspList)
+	if requestContext.Decision.Tracing() {
+		// Debug traced requests are not real traffic, DSPs must not bid on them
+		traceSkippedDSPs(requestContext, dspList)
+		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.NoFill(reasonDebugTrace)
+		return
+	}
 	bidResponsesChannel := make(chan BidResponseMetadata, len(dspList))
 
 	for _, dsp := range dspList {
-		go makeBidRequest(dsp.RTBIntegrationUrl, bidRequestJSON, dsp.ID, bidResponsesChannel)
+		bidRequestsInFlight.Add(1)
+		go func(dsp data.AdvertiserData) {
+			defer bidRequestsInFlight.Done()
+			makeBidRequest(dsp.RTBIntegrationUrl, bidRequestJSON, dsp.ID, bidTimeout, bidResponsesChannel)
+		}(dsp)
 		//go makeBidRequest("http://localhost:8082/http_test", bidRequestJSON, dsp.ID, bidResponsesChannel)
 	}
 
@@ -95,17 +126,7 @@ func AdRotationOpenRTBProcessorHandler(w http.ResponseWriter, r *http.Request) {
 
 	if validBidResponsesCount > 0 {
 		bidWin = bidResponseList[maxBidIndex]
-		if secondMaxBid > 0 {
-			bidWinSecondPrice = secondMaxBid + 0.01
-			if bidWinSecondPrice > bidWin.BidResponse.SeatBid[0].Bid[0].Price {
-				bidWinSecondPrice = bidWin.BidResponse.SeatBid[0].Bid[0].Price
-			}
-		} else {
-			//bidWinSecondPrice = bidWin.BidResponse.SeatBid[0].Bid[0].Price
-			minimumPrice := bidFloor + 0.01
-			maximumPrice := bidWin.BidResponse.SeatBid[0].Bid[0].Price
-			bidWinSecondPrice = rand.Float64()*(maximumPrice-minimumPrice) + minimumPrice
-		}
+		bidWinSecondPrice = secondPrice(requestContext.Random, bidFloor, bidWin.BidResponse.SeatBid[0].Bid[0].Price, secondMaxBid)
 
 		bidResponseList[maxBidIndex].BidWin = 1
 		bidResponseList[maxBidIndex].SecondPrice = bidWinSecondPrice
@@ -114,9 +135,11 @@ func AdRotationOpenRTBProcessorHandler(w http.ResponseWriter, r *http.Request) {
 	for _, bidResponse := range bidResponseList {
 		SendRTBBidRequestMessageToKafka(requestContext, bidResponse, timestamp)
 	}
+	traceBidResponses(requestContext, bidResponseList)
 
 	if validBidResponsesCount == 0 {
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.NoFill(reasonNoBids)
 		return
 	}
 
@@ -130,16 +153,49 @@ func AdRotationOpenRTBProcessorHandler(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.Fail(reasonResponseGeneration)
 		log.WithField("url", r.URL.String()).Warn(err)
 		return
 	}
 
+	requestContext.Decision.Fill(strategyRTBAuction)
 	w.Header().Set("Content-type", "application/json")
 	//w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Write(response)
 	return
 }
 
+// auctionSettingsForLink returns bid floor margin and DSP timeout of the link auction,
+// each of them is default if the link does not set it
+func auctionSettingsForLink(publisherLink data.PublisherLinkData) (float64, time.Duration) {
+	margin, timeout := defaultBidFloorMargin, defaultBidTimeout
+	auction := publisherLink.Auction
+	if auction == nil {
+		return margin, timeout
+	}
+	if auction.BidFloorMargin != nil {
+		margin = *auction.BidFloorMargin
+	}
+	if auction.TimeoutMs != nil && *auction.TimeoutMs > 0 {
+		timeout = time.Duration(*auction.TimeoutMs) * time.Millisecond
+	}
+	return margin, timeout
+}
+
+// secondPrice is the price winner pays: a cent above the second bid, not more than its own bid.
+// If there was only one bid, the price is a random one between bid floor and the bid.
+func secondPrice(random *rand.Rand, bidFloor, winPrice, secondMaxBid float64) float64 {
+	if secondMaxBid > 0 {
+		price := secondMaxBid + 0.01
+		if price > winPrice {
+			price = winPrice
+		}
+		return price
+	}
+	minimumPrice := bidFloor + 0.01
+	return random.Float64()*(winPrice-minimumPrice) + minimumPrice
+}
+
 func collectBidResponses(bidRequestsCount int, bidFloor float64, bidResponsesChannel <-chan BidResponseMetadata) (int, []BidResponseItem, int, float64) {
 	var bidResponseList []BidResponseItem
 	bidResponseList = make([]BidResponseItem, bidRequestsCount)
@@ -163,6 +219,7 @@ func collectBidResponses(bidRequestsCount int, bidFloor float64, bidResponsesCha
 			// TODO: add logic for finding correct bid responses
 			err := json.Unmarshal(b.BidResponseJSON, &bidResponse)
 			if err != nil {
+				observeDSPResponse(b.AdvertiserID, dspResultInvalid)
 				log.WithField("json", string(b.BidResponseJSON)).WithError(err).Warn()
 				continue
 			}
@@ -175,7 +232,9 @@ func collectBidResponses(bidRequestsCount int, bidFloor float64, bidResponsesCha
 
 			if bidFloor > bidPrice {
 				bidFloorError = true
+				observeDSPResponse(b.AdvertiserID, dspResultBelowFloor)
 			} else {
+				observeDSPResponse(b.AdvertiserID, dspResultBid)
 				if bidPrice > maxBid {
 					secondMaxBid = maxBid
 					maxBid = bidPrice
@@ -196,17 +255,20 @@ func collectBidResponses(bidRequestsCount int, bidFloor float64, bidResponsesCha
 
 		if isTimeout {
 			bidResponseList[i].BidTimeout = 1
+			observeDSPResponse(b.AdvertiserID, dspResultTimeout)
 		}
 		if isEmpty {
 			bidResponseList[i].BidEmpty = 1
+			observeDSPResponse(b.AdvertiserID, dspResultEmpty)
 		}
 	}
 
 	return validBidResponsesCount, bidResponseList, maxBidIndex, secondMaxBid
 }
 
-func makeBidRequest(url_ string, bidRequest []byte, advertiserID uint64, ch chan<- BidResponseMetadata) {
-	ctx, _ := context.WithTimeout(context.Background(), 300*time.Millisecond)
+func makeBidRequest(url_ string, bidRequest []byte, advertiserID uint64, timeout time.Duration, ch chan<- BidResponseMetadata) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 	req, _ := http.NewRequest("POST", url_, bytes.NewBuffer(bidRequest))
 	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", "application/json")
@@ -251,11 +313,27 @@ func makeBidRequest(url_ string, bidRequest []byte, advertiserID uint64, ch chan
 	}
 }
 
-func composeBidRequest(requestContext *request_context.RequestContext, bidFloor float64) openrtb.BidRequest {
+// WaitForBidRequests blocks until all outstanding bid requests are finished or context is done
+func WaitForBidRequests(ctx context.Context) error {
+	finished := make(chan struct{})
+	go func() {
+		bidRequestsInFlight.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func composeBidRequest(requestContext *request_context.RequestContext, bidFloor float64, timeout time.Duration) openrtb.BidRequest {
 	bidRequest := openrtb.BidRequest{
 		ID:          requestContext.RequestID.String(),
 		Cur:         []string{"USD"},
-		TMax:        300,
+		TMax:        int(timeout / time.Millisecond),
 		AuctionType: 2,
 		Imp: []openrtb.Impression{
 			{
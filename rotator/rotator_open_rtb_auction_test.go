@@ -0,0 +1,53 @@
+package rotator
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/request_context"
+)
+
+func TestSecondPrice(t *testing.T) {
+	random := request_context.NewRandom(7)
+
+	if price := secondPrice(random, 1, 3, 2); price != 2.01 {
+		t.Errorf("expected a cent above second bid, got %f", price)
+	}
+	if price := secondPrice(random, 1, 3, 3); price != 3 {
+		t.Errorf("expected price not above winner bid, got %f", price)
+	}
+
+	// Single bid is priced randomly, the same seed gives the same price
+	price := secondPrice(request_context.NewRandom(7), 1, 3, 0)
+	if price < 1.01 || price > 3 {
+		t.Errorf("expected price between bid floor and bid, got %f", price)
+	}
+	if replayed := secondPrice(request_context.NewRandom(7), 1, 3, 0); replayed != price {
+		t.Errorf("expected seed to reproduce price %f, got %f", price, replayed)
+	}
+}
+
+func TestAuctionSettingsForLink(t *testing.T) {
+	var timeoutOnly, marginOnly data.AuctionSettings
+	json.Unmarshal([]byte(`{"timeout_ms": 150}`), &timeoutOnly)
+	json.Unmarshal([]byte(`{"bid_floor_margin": 0.2}`), &marginOnly)
+
+	if margin, timeout := auctionSettingsForLink(data.PublisherLinkData{}); margin != defaultBidFloorMargin || timeout != defaultBidTimeout {
+		t.Errorf("expected default settings, got margin %f, timeout %s", margin, timeout)
+	}
+	if margin, timeout := auctionSettingsForLink(data.PublisherLinkData{Auction: &timeoutOnly}); margin != defaultBidFloorMargin || timeout != 150*time.Millisecond {
+		t.Errorf("expected default margin and own timeout, got margin %f, timeout %s", margin, timeout)
+	}
+
+	// Arm overriding only timeout keeps margin of the link
+	arm := data.ExperimentArm{Name: "fast", Auction: &timeoutOnly}
+	publisherLink := arm.Apply(data.PublisherLinkData{Auction: &marginOnly})
+	if margin, timeout := auctionSettingsForLink(publisherLink); margin != 0.2 || timeout != 150*time.Millisecond {
+		t.Errorf("expected margin of the link and timeout of the arm, got margin %f, timeout %s", margin, timeout)
+	}
+	if marginOnly.TimeoutMs != nil {
+		t.Error("arm modified settings of the link")
+	}
+}
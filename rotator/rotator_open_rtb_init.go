@@ -4,7 +4,6 @@ import (
 	"net/http"
 	"time"
 
-	"bitbucket.org/tapgerine/traffic_rotator/rotator/redis_handler"
 	"bitbucket.org/tapgerine/traffic_rotator/rotator/vast"
 	log "github.com/Sirupsen/logrus"
 )
@@ -13,8 +12,11 @@ func AdRotationOpenRTBInitHandler(w http.ResponseWriter, r *http.Request) {
 	timestamp := time.Now().UTC()
 
 	requestContext, err := parseRequest(r)
+	w = beginRequest(w, &requestContext, "/rotator/target/bidder_init", timestamp)
+	defer finishRequest(w, &requestContext)
 	if err != nil {
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.Reject(reasonInvalidRequest)
 		log.WithField("url", r.URL.String()).Warn(err)
 		SendRTBEventMessageToKafka(requestContext, "init_error", timestamp)
 		return
@@ -23,13 +25,16 @@ func AdRotationOpenRTBInitHandler(w http.ResponseWriter, r *http.Request) {
 	var publisherLink PublisherLink
 	if err = publisherLink.init(requestContext.PublisherTargetingID); err != nil {
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.Reject(reasonNoPublisherLink)
 		SendRTBEventMessageToKafka(requestContext, "init_error", timestamp)
 		return
 	}
+	publisherLink.enrollInExperiment(&requestContext, true)
 	requestContext.SetRequestPlatform(publisherLink.Data.Platform)
 	publisherID, err := publisherLink.GetPublisherID()
 	if err != nil {
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.Reject(reasonNoPublisherLink)
 		log.WithField("url", r.URL.String()).WithError(err).Warn()
 		SendRTBEventMessageToKafka(requestContext, "init_error", timestamp)
 		return
@@ -37,10 +42,11 @@ func AdRotationOpenRTBInitHandler(w http.ResponseWriter, r *http.Request) {
 	requestContext.PublisherID = publisherID
 
 	// Checking default domain black list
-	domainsListItem, err := redis_handler.RedisConnection.HGet(defaultDomainBlackListKey, requestContext.Domain).Result()
+	domainsListItem, err := DomainsListLookup(defaultDomainBlackListKey, requestContext.Domain)
 	if err == nil && domainsListItem == "black" {
 		// Black list activated. Domain is in the list
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.Reject(reasonDomainBlocked)
 		SendRTBEventMessageToKafka(requestContext, "init_error", timestamp)
 		return
 	}
@@ -49,6 +55,7 @@ func AdRotationOpenRTBInitHandler(w http.ResponseWriter, r *http.Request) {
 	isAllowed := publisherLink.IsDomainAllowForThisLink(requestContext.Domain)
 	if !isAllowed {
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.Reject(reasonDomainBlocked)
 		SendRTBEventMessageToKafka(requestContext, "init_error", timestamp)
 		return
 	}
@@ -56,11 +63,13 @@ func AdRotationOpenRTBInitHandler(w http.ResponseWriter, r *http.Request) {
 	response, err := vast.GenerateVASTVPAIDForOpenRTB(requestContext)
 	if err != nil {
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.Fail(reasonResponseGeneration)
 		log.WithField("url", r.URL.String()).WithError(err).Warn()
 		SendRTBEventMessageToKafka(requestContext, "init_error", timestamp)
 		return
 	}
 
+	requestContext.Decision.Fill(strategyRTBInit)
 	SendRTBEventMessageToKafka(requestContext, "init", timestamp)
 
 	w.Header().Set("Content-Type", "application/xml")
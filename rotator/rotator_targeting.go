@@ -1,9 +1,8 @@
 package rotator
 
 import (
-	"math/rand"
 	"net/http"
-	"strconv"
+	"sort"
 	"time"
 
 	"fmt"
@@ -11,7 +10,6 @@ import (
 	"net/url"
 
 	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
-	"bitbucket.org/tapgerine/traffic_rotator/rotator/redis_handler"
 	"bitbucket.org/tapgerine/traffic_rotator/rotator/request_context"
 	"bitbucket.org/tapgerine/traffic_rotator/rotator/vast"
 	log "github.com/Sirupsen/logrus"
@@ -26,10 +24,13 @@ type AdTagContext struct {
 	GeoConfig             AdTagContextGeo
 	IsPeriodOfStudy       bool
 	IsPeriodOfStudyPassed bool
-	GeoCheckFailed        bool
-	StudyLeft             int64
-	ERPR                  float64
-	FillRate              float64
+	// FallbackOnly is set for ad tags which failed only fallback filters of the pipeline
+	FallbackOnly bool
+	StudyLeft    int64
+	ERPR         float64
+	FillRate     float64
+	// SelectionWeight is the weight selector used for the ad tag, it is reported in decision traces
+	SelectionWeight float64
 }
 
 type AdTagContextGeo struct {
@@ -41,17 +42,12 @@ type AdTagContextGeo struct {
 func AdRotationTargetingHandlerV2(w http.ResponseWriter, r *http.Request) {
 	timestamp := time.Now().UTC()
 
-	// Logging request into redis
-	hr, min, _ := timestamp.Clock()
-	redis_handler.RedisConnection.HIncrBy(
-		fmt.Sprintf("requests:targeting_v2:%s", timestamp.Format("2006-01-02")),
-		strconv.Itoa(hr*60+min),
-		1,
-	)
-
 	requestContext, err := parseRequest(r)
+	w = beginRequest(w, &requestContext, "/rotator/target/v2", timestamp)
+	defer finishRequest(w, &requestContext)
 	if err != nil {
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.Reject(reasonInvalidRequest)
 		log.WithField("url", r.URL.String()).Warn(err)
 		return
 	}
@@ -60,24 +56,29 @@ func AdRotationTargetingHandlerV2(w http.ResponseWriter, r *http.Request) {
 	err = publisherLink.init(requestContext.PublisherTargetingID)
 	if err != nil {
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.Reject(reasonNoPublisherLink)
 		return
 	}
+	publisherLink.enrollInExperiment(&requestContext, false)
+	requestContext.PublisherID, _ = publisherLink.GetPublisherID()
 	requestContext.SetRequestPlatform(publisherLink.Data.Platform)
 	if requestContext.PriceParsingError == ErrPriceParsing {
 		if publisherLink.Data.Price > 0.0 {
 			requestContext.PublisherPrice = publisherLink.Data.Price
 		} else {
 			w.WriteHeader(http.StatusNoContent)
+			requestContext.Decision.Reject(reasonNoPrice)
 			log.WithField("url", r.URL.String()).Warn(fmt.Sprintf("Price was not set, targeting_id = %s", requestContext.PublisherTargetingID))
 			return
 		}
 	}
 
 	// Checking default domain black list
-	domainsListItem, err := redis_handler.RedisConnection.HGet(defaultDomainBlackListKey, requestContext.Domain).Result()
+	domainsListItem, err := DomainsListLookup(defaultDomainBlackListKey, requestContext.Domain)
 	if err == nil && domainsListItem == "black" {
 		// Black list activated. Domain is in the list
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.Reject(reasonDomainBlocked)
 		return
 	}
 
@@ -85,131 +86,82 @@ func AdRotationTargetingHandlerV2(w http.ResponseWriter, r *http.Request) {
 	isAllowed := publisherLink.IsDomainAllowForThisLink(requestContext.Domain)
 	if !isAllowed {
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.Reject(reasonDomainBlocked)
 		return
 	}
 
-	// Getting a list of available ad tag ids for this publisher link
-	adTagIDs, err := publisherLink.GetAdTagIDs()
-	if err != nil {
-		w.WriteHeader(http.StatusNoContent)
-		return
-	}
-
-	adTags, err := data.ServingData.GetAdTagsByIDs(adTagIDs)
+	// Getting a list of available ad tags for this publisher link
+	adTags, err := publisherLink.GetAdTags()
 	if err != nil {
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.NoFill(reasonNoAdTags)
 		return
 	}
+	requestContext.Decision.Candidates = len(adTags)
 
 	var adTagContextList []*AdTagContext
 	adTagContextList = make([]*AdTagContext, len(adTags))
-	var i int
-	for id, tag := range adTags {
-		adTagContextList[i] = &AdTagContext{ID: id, Data: tag, AllChecksPassed: true}
-		i++
+	for i, adTag := range adTags {
+		adTagContextList[i] = &AdTagContext{ID: adTag.ID, Data: adTag.Data, AllChecksPassed: true}
 	}
 
-	filterAdTagsByPriceV2(requestContext, adTagContextList)
-
-	if requestContext.RequestPlatform == "desktop" {
-		filterAdTagsByDeviceTypeV2(requestContext, adTagContextList)
-	}
-
-	filterAdTagsByRequiredParameters(requestContext, adTagContextList)
-	filterAdTagsByDomainLists(requestContext, adTagContextList)
-	// For now geo check should be last one
-	filterAdTagsByGeoV3(requestContext, adTagContextList)
-	//filterAdTagsByGeoV2(requestContext, adTagContextList)
-
-	var tagsPassedFiltersCount int
-	var tagsNotPassedGeoFilterCount int
-	for _, adTag := range adTagContextList {
-		if adTag.AllChecksPassed {
-			tagsPassedFiltersCount++
-		} else if adTag.GeoCheckFailed {
-			tagsNotPassedGeoFilterCount++
-		}
-	}
-
-	var adTagContextAfterFilters []*AdTagContext
-	var isOnlyTagsWithGeoCheckFailedLeft bool
-	var adTagContextAfterFiltersLen int
-	if tagsPassedFiltersCount == 0 && tagsNotPassedGeoFilterCount > 0 {
-		adTagContextAfterFiltersLen = tagsNotPassedGeoFilterCount
-		isOnlyTagsWithGeoCheckFailedLeft = true
-	} else {
-		adTagContextAfterFiltersLen = tagsPassedFiltersCount
-	}
-	adTagContextAfterFilters = make([]*AdTagContext, adTagContextAfterFiltersLen)
-
-	var adTagContextAfterFiltersCount int
-	for _, adTag := range adTagContextList {
-		// Even if all tags failed checks except last one (geo), we still could select some tags for serving
-		if tagsPassedFiltersCount == 0 && tagsNotPassedGeoFilterCount > 0 && adTag.GeoCheckFailed {
-			adTagContextAfterFilters[adTagContextAfterFiltersCount] = adTag
-			adTagContextAfterFiltersCount++
-		} else if adTag.AllChecksPassed {
-			adTagContextAfterFilters[adTagContextAfterFiltersCount] = adTag
-			adTagContextAfterFiltersCount++
-		}
-	}
+	adTagContextAfterFilters, isFallback := filterPipelineForLink(publisherLink.Data).Run(requestContext, adTagContextList)
+	adTagContextAfterFiltersCount := len(adTagContextAfterFilters)
 
 	if adTagContextAfterFiltersCount == 0 {
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.NoFill(reasonAllFiltered)
 		notifyKafkaAboutEmptyResponse(requestContext, timestamp)
 		return
 	}
 
 	var response string
 
-	if requestContext.ResponseType == "vast" {
-		var selectedAdTag *AdTagContext
-		if isOnlyTagsWithGeoCheckFailedLeft {
-			i := rand.Intn(adTagContextAfterFiltersCount)
-			selectedAdTag = adTagContextAfterFilters[i]
-		} else {
-			if publisherLink.Data.Optimization == "erpr" {
-				selectedAdTag = selectAdTagByERPRV3(adTagContextAfterFilters, requestContext.PublisherTargetingID, publisherLink.Data.StudyRequests)
-			} else if publisherLink.Data.Optimization == "fill_rate" {
-				selectedAdTag = selectAdTagByFillRate(adTagContextAfterFilters, requestContext.PublisherTargetingID, publisherLink.Data.StudyRequests)
-			} else {
-				selectedAdTag = selectAdTagByDomainFillRate(adTagContextAfterFilters, requestContext.PublisherTargetingID, requestContext.Domain, publisherLink.Data.StudyRequests)
-			}
+	selectorName, selector, params := selectorForLink(publisherLink.Data, requestContext.PublisherTargetingID)
+	strategy, selectedAdTags := selectAdTags(requestContext, selectorName, selector, params, adTagContextAfterFilters, isFallback)
+	traceSelection(requestContext, adTagContextAfterFilters, isFallback)
 
-			//if requestContext.PublisherTargetingID == "OaIsmaWJ" || requestContext.PublisherTargetingID == "rKbNUciT" {
-			//	selectedAdTag = selectAdTagByERPRV4(adTagContextAfterFilters, requestContext.PublisherTargetingID, requestContext.Domain)
-			//} else {
-			//	selectedAdTag = selectAdTagByERPRV3(adTagContextAfterFilters, requestContext.PublisherTargetingID)
-			//}
-		}
+	if requestContext.ResponseType == "vast" {
 		// TODO: if no tags selected - choose random
-		if selectedAdTag == nil {
+		if len(selectedAdTags) == 0 {
 			w.WriteHeader(http.StatusNoContent)
+			requestContext.Decision.NoFill(reasonNothingSelected)
 			notifyKafkaAboutEmptyResponse(requestContext, timestamp)
 			return
 		}
+		selectedAdTag := selectedAdTags[0]
 
 		response, err = generateVASTResponse(requestContext, selectedAdTag.Data, selectedAdTag.ID)
 		if err != nil {
 			w.WriteHeader(http.StatusNoContent)
+			requestContext.Decision.Fail(reasonResponseGeneration)
 			notifyKafkaAboutEmptyResponse(requestContext, timestamp)
 			log.WithField("url", r.URL.String()).WithError(err).Warn()
 			return
 		}
+		requestContext.Decision.Fill(strategy, selectedAdTag.ID)
+		if recordsFeedback(requestContext, selector) {
+			Feedback.RecordRequest(requestContext.RequestID.String(), FeedbackKey{
+				TargetingID: requestContext.PublisherTargetingID,
+				AdTagID:     selectedAdTag.ID,
+				Country:     requestContext.User.Geo.Country.ISOCode,
+				Domain:      requestContext.Domain,
+			}, timestamp)
+		}
 		SendRequestTargetedMessageToKafka(
 			selectedAdTag.ID, requestContext.RequestID, timestamp, requestContext.User.Geo.Country.ISOCode,
 			requestContext.DevicePlatformType, selectedAdTag.Data.PublisherID, "targeting",
 			requestContext.PublisherTargetingID, requestContext.Domain,
 			requestContext.AppName, requestContext.BundleID,
+			requestContext.Experiment, requestContext.ExperimentArm, requestContext.Decision.Tracing(),
 		)
 
 	} else if requestContext.ResponseType == "vpaid" {
-		var selectedAdTags []*AdTagContext
-		if isOnlyTagsWithGeoCheckFailedLeft {
-			// TODO: this about limitation
-			selectedAdTags = adTagContextAfterFilters
-		} else {
-			selectedAdTags = selectManyAdTagsByERPRV2(adTagContextAfterFilters, requestContext.PublisherTargetingID, 10)
+		if len(selectedAdTags) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			requestContext.Decision.NoFill(reasonNothingSelected)
+			notifyKafkaAboutEmptyResponse(requestContext, timestamp)
+			return
 		}
 
 		selectedAdTagsMap := make(map[string]data.AdTagData, len(selectedAdTags))
@@ -222,10 +174,15 @@ func AdRotationTargetingHandlerV2(w http.ResponseWriter, r *http.Request) {
 
 		if err != nil {
 			w.WriteHeader(http.StatusNoContent)
+			requestContext.Decision.Fail(reasonResponseGeneration)
 			// TODO: add error header mb?
 			log.WithField("url", r.URL.String()).WithError(err).Warn()
 			return
 		}
+		requestContext.Decision.Fill(strategy, adTagContextIDs(selectedAdTags)...)
+		if recordsFeedback(requestContext, selector) {
+			Feedback.ExpectRequests(requestContext.RequestID.String(), feedbackKeys(requestContext, selectedAdTags), timestamp)
+		}
 		publisherID, err := data.ServingData.GetPublisherIDByTargetingID(requestContext.PublisherTargetingID)
 		if err != nil {
 			//w.WriteHeader(http.StatusNoContent)
@@ -237,20 +194,61 @@ func AdRotationTargetingHandlerV2(w http.ResponseWriter, r *http.Request) {
 			requestContext.DevicePlatformType, publisherID, "vpaid",
 			requestContext.PublisherTargetingID, requestContext.Domain,
 			requestContext.AppName, requestContext.BundleID,
+			requestContext.Experiment, requestContext.ExperimentArm, requestContext.Decision.Tracing(),
 		)
 	}
 
 	w.Header().Set("Content-Type", "application/xml")
 	w.Write([]byte(response))
+}
 
-	timePassed := time.Now().UTC().Sub(timestamp)
+// selectAdTags selects ad tags which passed filters: one ad tag for VAST responses,
+// ad tags in waterfall order for VPAID ones. Returned strategy is reported in decision.
+func selectAdTags(
+	requestContext request_context.RequestContext, selectorName string, selector Selector, params SelectorParams,
+	adTags []*AdTagContext, isFallback bool,
+) (string, []*AdTagContext) {
+	if requestContext.ResponseType == "vpaid" {
+		if isFallback {
+			// TODO: this about limitation
+			return strategyGeoFallbackAll, adTags
+		}
+		rankingName, ranking := rankingSelector(selectorName, selector, params)
+		return rankingName + "_many", ranking.Rank(requestContext, adTags, params)
+	}
 
-	redis_handler.RedisConnection.HIncrBy(
-		fmt.Sprintf("requests:targeting:%s:time", timestamp.Format("2006-01-02")),
-		getLogTimePassed(timePassed),
-		1,
-	)
+	if isFallback {
+		return strategyGeoFallback, []*AdTagContext{adTags[requestContext.Random.Intn(len(adTags))]}
+	}
+	selectedAdTag := selector.Select(requestContext, adTags, params)
+	if selectedAdTag == nil {
+		return selectorName, nil
+	}
+	return selectorName, []*AdTagContext{selectedAdTag}
+}
 
+// recordsFeedback tells if requests should be recorded for live feedback,
+// only selectors consulting it need them. Debug traced requests are never recorded.
+func recordsFeedback(requestContext request_context.RequestContext, selector Selector) bool {
+	if !IsFeedbackRecorded || requestContext.Decision.Tracing() {
+		return false
+	}
+	_, isFeedbackSelector := selector.(feedbackSelector)
+	return isFeedbackSelector
+}
+
+// feedbackKeys returns live feedback keys of ad tags in the request segment
+func feedbackKeys(requestContext request_context.RequestContext, adTags []*AdTagContext) []FeedbackKey {
+	keys := make([]FeedbackKey, len(adTags))
+	for i, adTag := range adTags {
+		keys[i] = FeedbackKey{
+			TargetingID: requestContext.PublisherTargetingID,
+			AdTagID:     adTag.ID,
+			Country:     requestContext.User.Geo.Country.ISOCode,
+			Domain:      requestContext.Domain,
+		}
+	}
+	return keys
 }
 
 func notifyKafkaAboutEmptyResponse(requestContext request_context.RequestContext, timestamp time.Time) {
@@ -271,12 +269,7 @@ func notifyKafkaAboutEmptyResponse(requestContext request_context.RequestContext
 		requestContext.DevicePlatformType, publisherID, requestType,
 		requestContext.PublisherTargetingID, requestContext.Domain,
 		requestContext.AppName, requestContext.BundleID,
-	)
-	timePassed := time.Now().UTC().Sub(timestamp)
-	redis_handler.RedisConnection.HIncrBy(
-		fmt.Sprintf("requests:targeting:%s:time", timestamp.Format("2006-01-02")),
-		getLogTimePassed(timePassed),
-		1,
+		requestContext.Experiment, requestContext.ExperimentArm, requestContext.Decision.Tracing(),
 	)
 	return
 }
@@ -285,27 +278,25 @@ func notifyKafkaAboutEmptyResponse(requestContext request_context.RequestContext
 func AdRotationTargetingHandler(w http.ResponseWriter, r *http.Request) {
 	timestamp := time.Now().UTC()
 
-	// Logging request into redis
-	hr, min, _ := timestamp.Clock()
-	redis_handler.RedisConnection.HIncrBy(
-		fmt.Sprintf("requests:targeting:%s", timestamp.Format("2006-01-02")),
-		strconv.Itoa(hr*60+min),
-		1,
-	)
-
 	requestContext, err := parseRequest(r)
+	w = beginRequest(w, &requestContext, "/rotator/target", timestamp)
+	defer finishRequest(w, &requestContext)
 	if err != nil {
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.Reject(reasonInvalidRequest)
 		log.WithField("url", r.URL.String()).Warn(err)
 		return
 	}
+	requestContext.PublisherID, _ = data.ServingData.GetPublisherIDByTargetingID(requestContext.PublisherTargetingID)
 
-	adTags, err := data.ServingData.GetAllAdTags()
+	adTags, err := data.ServingData.GetAdTagsByPublisherTargetingID(requestContext.PublisherTargetingID)
 	if err != nil {
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.NoFill(reasonNoAdTags)
 		log.WithField("url", r.URL.String()).Warn(err)
 		return
 	}
+	requestContext.Decision.Candidates = len(adTags)
 
 	var adTagsKeys []string
 	adTagsKeys = make([]string, len(adTags))
@@ -315,12 +306,11 @@ func AdRotationTargetingHandler(w http.ResponseWriter, r *http.Request) {
 		i++
 	}
 
-	filterAdTagsByPublisher(requestContext, &adTags, &adTagsKeys)
-	filterAdTagsForTargeting(requestContext, &adTags, &adTagsKeys)
-	filterAdTagsByActivity(requestContext, &adTags, &adTagsKeys)
-	filterAdTagsByPrice(requestContext, &adTags, &adTagsKeys)
-	filterAdTagsByGeo(requestContext, &adTags, &adTagsKeys)
-	filterAdTagsByDeviceType(requestContext, &adTags, &adTagsKeys)
+	applyFilter(requestContext, "targeting", &adTags, &adTagsKeys, filterAdTagsForTargeting)
+	applyFilter(requestContext, "activity", &adTags, &adTagsKeys, filterAdTagsByActivity)
+	applyFilter(requestContext, "price", &adTags, &adTagsKeys, filterAdTagsByPrice)
+	applyFilter(requestContext, "geo", &adTags, &adTagsKeys, filterAdTagsByGeo)
+	applyFilter(requestContext, "device_type", &adTags, &adTagsKeys, filterAdTagsByDeviceType)
 
 	var adTagsKeysAfterFilter []string
 	for _, key := range adTagsKeys {
@@ -331,6 +321,7 @@ func AdRotationTargetingHandler(w http.ResponseWriter, r *http.Request) {
 
 	if len(adTagsKeysAfterFilter) == 0 {
 		w.WriteHeader(http.StatusNoContent)
+		requestContext.Decision.NoFill(reasonAllFiltered)
 		publisherID, err := data.ServingData.GetPublisherIDByTargetingID(requestContext.PublisherTargetingID)
 		if err != nil {
 			//w.WriteHeader(http.StatusNoContent)
@@ -345,15 +336,10 @@ func AdRotationTargetingHandler(w http.ResponseWriter, r *http.Request) {
 
 		SendRequestTargetedMessageToKafka(
 			"", requestContext.RequestID, timestamp, requestContext.User.Geo.Country.ISOCode,
-			requestContext.User.UserAgent.DeviceType, publisherID, requestType,
+			requestContext.DevicePlatformType, publisherID, requestType,
 			requestContext.PublisherTargetingID, requestContext.Domain,
 			requestContext.AppName, requestContext.BundleID,
-		)
-		timePassed := time.Now().UTC().Sub(timestamp)
-		redis_handler.RedisConnection.HIncrBy(
-			fmt.Sprintf("requests:targeting:%s:time", timestamp.Format("2006-01-02")),
-			getLogTimePassed(timePassed),
-			1,
+			requestContext.Experiment, requestContext.ExperimentArm, requestContext.Decision.Tracing(),
 		)
 		return
 	}
@@ -361,19 +347,22 @@ func AdRotationTargetingHandler(w http.ResponseWriter, r *http.Request) {
 	var response string
 
 	if requestContext.ResponseType == "vast" {
-		adTagPubID, adTag := selectAdTagByERPR(&adTags, adTagsKeysAfterFilter, requestContext.User.Geo.Country.ISOCode)
+		adTagPubID, adTag := selectAdTagByERPR(requestContext.Random, &adTags, adTagsKeysAfterFilter, requestContext.User.Geo.Country.ISOCode)
 		response, err = generateVASTResponse(requestContext, adTag, adTagPubID)
 		if err != nil {
 			w.WriteHeader(http.StatusNoContent)
+			requestContext.Decision.Fail(reasonResponseGeneration)
 			// TODO: add error header mb?
 			log.WithField("url", r.URL.String()).WithError(err).Warn()
 			return
 		}
+		requestContext.Decision.Fill(strategyLegacyERPR, adTagPubID)
 		SendRequestTargetedMessageToKafka(
 			adTagPubID, requestContext.RequestID, timestamp, requestContext.User.Geo.Country.ISOCode,
-			requestContext.User.UserAgent.DeviceType, adTag.PublisherID, "targeting",
+			requestContext.DevicePlatformType, adTag.PublisherID, "targeting",
 			requestContext.PublisherTargetingID, requestContext.Domain,
 			requestContext.AppName, requestContext.BundleID,
+			requestContext.Experiment, requestContext.ExperimentArm, requestContext.Decision.Tracing(),
 		)
 
 	} else if requestContext.ResponseType == "vpaid" {
@@ -382,10 +371,17 @@ func AdRotationTargetingHandler(w http.ResponseWriter, r *http.Request) {
 
 		if err != nil {
 			w.WriteHeader(http.StatusNoContent)
+			requestContext.Decision.Fail(reasonResponseGeneration)
 			// TODO: add error header mb?
 			log.WithField("url", r.URL.String()).WithError(err).Warn()
 			return
 		}
+		selectedAdTagIDs := make([]string, 0, len(adTagsMap))
+		for adTagPubID := range adTagsMap {
+			selectedAdTagIDs = append(selectedAdTagIDs, adTagPubID)
+		}
+		sort.Strings(selectedAdTagIDs)
+		requestContext.Decision.Fill(strategyLegacyERPRMany, selectedAdTagIDs...)
 		publisherID, err := data.ServingData.GetPublisherIDByTargetingID(requestContext.PublisherTargetingID)
 		if err != nil {
 			//w.WriteHeader(http.StatusNoContent)
@@ -394,22 +390,15 @@ func AdRotationTargetingHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		SendRequestTargetedMessageToKafka(
 			"", requestContext.RequestID, timestamp, requestContext.User.Geo.Country.ISOCode,
-			requestContext.User.UserAgent.DeviceType, publisherID, "vpaid",
+			requestContext.DevicePlatformType, publisherID, "vpaid",
 			requestContext.PublisherTargetingID, requestContext.Domain,
 			requestContext.AppName, requestContext.BundleID,
+			requestContext.Experiment, requestContext.ExperimentArm, requestContext.Decision.Tracing(),
 		)
 	}
 
 	w.Header().Set("Content-Type", "application/xml")
 	w.Write([]byte(response))
-
-	timePassed := time.Now().UTC().Sub(timestamp)
-
-	redis_handler.RedisConnection.HIncrBy(
-		fmt.Sprintf("requests:targeting:%s:time", timestamp.Format("2006-01-02")),
-		getLogTimePassed(timePassed),
-		1,
-	)
 }
 
 func generateVASTVPAIDResponse(requestContext request_context.RequestContext, adTagsMap map[string]data.AdTagData) (string, error) {
@@ -448,7 +437,7 @@ func generateVASTResponse(requestContext request_context.RequestContext, adTag d
 		EncryptionKey,
 		requestContext.Type,
 		requestContext.User.Geo.Country.ISOCode,
-		requestContext.User.UserAgent.DeviceType,
+		requestContext.DevicePlatformType,
 		requestContext.PublisherTargetingID,
 		requestContext.Domain,
 		requestContext.AppName,
@@ -1,7 +1,82 @@
 package rotator
 
-import "testing"
+import (
+	"encoding/json"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/request_context"
+)
+
+type staticServingDataSource []byte
+
+func (s staticServingDataSource) Name() string {
+	return "static"
+}
+
+func (s staticServingDataSource) Fetch() ([]byte, error) {
+	return s, nil
+}
+
+func useServingData(t *testing.T, syncData data.SyncData) {
+	raw, err := json.Marshal(syncData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.ServingData = data.NewParsedServingData(staticServingDataSource(raw), time.Hour)
+	if err := data.ServingData.Init(); err != nil {
+		t.Fatal(err)
+	}
+}
 
 func TestMapURL(t *testing.T) {
+	useServingData(t, data.SyncData{
+		Version: 1,
+		AdTags: map[string]data.AdTagData{
+			"1": {AdTagID: 1, URL: "http://ads.example.com/vast", Price: 1, AdvertiserPlatformTypeID: 1},
+		},
+		ParametersMapping: map[uint64]map[string]map[string]data.ParametersMapping{
+			1: {
+				"cb":      {"desktop": {OriginalShortcut: "cb", OriginalMacros: "{cb}"}},
+				"width":   {"desktop": {OriginalShortcut: "w", OriginalMacros: "{w}"}},
+				"ua":      {"desktop": {OriginalShortcut: "ua"}},
+				"ip":      {"desktop": {OriginalShortcut: "ip"}},
+				"page":    {"desktop": {OriginalShortcut: "url"}},
+				"missing": {"desktop": {OriginalShortcut: "m"}},
+			},
+		},
+	})
+
+	requestURL, _ := url.Parse("http://rotator.example.com/rotator/target/v2?cb=123&w={w}")
+	requestContext := request_context.RequestContext{
+		User: request_context.UserContext{
+			IP:              net.ParseIP("1.2.3.4"),
+			UserAgentString: "Mozilla/5.0",
+		},
+		Referrer: "http://site.example.com/page",
+	}
+
+	mapped, err := mapUrl(
+		"http://ads.example.com/vast?cb=[CB]&width=[W]&ua=[UA]&ip=[IP]&page=[URL]&missing=[M]&fixed=1",
+		*requestURL, 1, "desktop", requestContext,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Macros which were not replaced by publisher and missing values are dropped, unmapped parameters are kept
+	expected := "cb=123&fixed=1&ip=1.2.3.4&page=http%3A%2F%2Fsite.example.com%2Fpage&ua=Mozilla%2F5.0"
+	if mapped.RawQuery != expected {
+		t.Errorf("expected query %s, got %s", expected, mapped.RawQuery)
+	}
+	if mapped.Host != "ads.example.com" || mapped.Path != "/vast" {
+		t.Errorf("unexpected mapped url %s", mapped.String())
+	}
 
+	if _, err := mapUrl("http://ads.example.com/vast", *requestURL, 2, "desktop", requestContext); err == nil {
+		t.Error("expected error for unknown parameters mapping")
+	}
 }
@@ -0,0 +1,169 @@
+package rotator
+
+import (
+	"fmt"
+	"sort"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/request_context"
+)
+
+const (
+	// defaultSelector is used for links without optimization or with unknown one
+	defaultSelector = strategyDomainFillRate
+	// Ranked selection parameters, they could be overridden by publisher link optimization params
+	defaultMaxRankedAdTags   = 10
+	defaultRankStudyRequests = 1000
+)
+
+// Selector picks ad tags which passed filters. Select is used for VAST responses,
+// Rank returns ad tags in waterfall order for VPAID responses.
+type Selector interface {
+	Select(r request_context.RequestContext, adTags []*AdTagContext, params SelectorParams) *AdTagContext
+	Rank(r request_context.RequestContext, adTags []*AdTagContext, params SelectorParams) []*AdTagContext
+}
+
+// SelectorParams are publisher link settings of a selector
+type SelectorParams struct {
+	TargetingID   string
+	StudyRequests int64
+	// Params are publisher link optimization params, their meaning depends on selector
+	Params map[string]float64
+}
+
+// Get returns param value or defaultValue if it is not set
+func (p SelectorParams) Get(name string, defaultValue float64) float64 {
+	if value, exists := p.Params[name]; exists {
+		return value
+	}
+	return defaultValue
+}
+
+var selectors = make(map[string]Selector)
+
+// RegisterSelector makes selector available for publisher links by optimization name
+func RegisterSelector(name string, selector Selector) {
+	if _, exists := selectors[name]; exists {
+		panic(fmt.Sprintf("selector %s is already registered", name))
+	}
+	selectors[name] = selector
+}
+
+// SelectorNames returns names of registered selectors, serving data validation reports unknown ones
+func SelectorNames() []string {
+	names := make([]string, 0, len(selectors))
+	for name := range selectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// selectorForLink returns selector of link optimization and the name it is reported with
+func selectorForLink(publisherLink data.PublisherLinkData, targetingID string) (string, Selector, SelectorParams) {
+	name := publisherLink.Optimization
+	selector, exists := selectors[name]
+	if !exists {
+		name = defaultSelector
+		selector = selectors[name]
+	}
+	return name, selector, SelectorParams{
+		TargetingID:   targetingID,
+		StudyRequests: publisherLink.StudyRequests,
+		Params:        publisherLink.OptimizationParams,
+	}
+}
+
+// rankingSelector returns selector ranking VPAID waterfalls. They were always ranked by eRPR,
+// so link optimization ranks them only if link opts in with rank_by_optimization param.
+func rankingSelector(name string, selector Selector, params SelectorParams) (string, Selector) {
+	if params.Get("rank_by_optimization", 0) > 0 {
+		return name, selector
+	}
+	return strategyERPR, selectors[strategyERPR]
+}
+
+func init() {
+	RegisterSelector(strategyERPR, erprSelector{})
+	RegisterSelector(strategyFillRate, fillRateSelector{})
+	RegisterSelector(strategyDomainFillRate, domainFillRateSelector{})
+}
+
+type erprSelector struct{}
+
+func (erprSelector) Select(r request_context.RequestContext, adTags []*AdTagContext, params SelectorParams) *AdTagContext {
+	return selectAdTagByERPRV3(r.Random, adTags, params.TargetingID, params.StudyRequests)
+}
+
+func (erprSelector) Rank(r request_context.RequestContext, adTags []*AdTagContext, params SelectorParams) []*AdTagContext {
+	return rankAdTags(adTags, params, func(adTag *AdTagContext) float64 {
+		return adTag.Data.ERPRByTargetingID[params.TargetingID].ERPR
+	})
+}
+
+type fillRateSelector struct{}
+
+func (fillRateSelector) Select(r request_context.RequestContext, adTags []*AdTagContext, params SelectorParams) *AdTagContext {
+	return selectAdTagByFillRate(r.Random, adTags, params.TargetingID, params.StudyRequests)
+}
+
+func (fillRateSelector) Rank(r request_context.RequestContext, adTags []*AdTagContext, params SelectorParams) []*AdTagContext {
+	return rankAdTags(adTags, params, func(adTag *AdTagContext) float64 {
+		return adTag.Data.ERPRByTargetingID[params.TargetingID].FillRate
+	})
+}
+
+type domainFillRateSelector struct{}
+
+func (domainFillRateSelector) Select(r request_context.RequestContext, adTags []*AdTagContext, params SelectorParams) *AdTagContext {
+	return selectAdTagByDomainFillRate(r.Random, adTags, params.TargetingID, r.Domain, params.StudyRequests)
+}
+
+func (domainFillRateSelector) Rank(r request_context.RequestContext, adTags []*AdTagContext, params SelectorParams) []*AdTagContext {
+	return rankAdTags(adTags, params, func(adTag *AdTagContext) float64 {
+		if adTag.Data.ERPRByTargetingID[params.TargetingID].FillRate == 0 {
+			return 0
+		}
+		if domainFillRate, exists := adTag.Data.FillRateByTargetingIDAndDomain[params.TargetingID][r.Domain]; exists {
+			return domainFillRate.FillRate
+		}
+		return adTag.Data.ERPRByTargetingID[params.TargetingID].FillRate
+	})
+}
+
+// rankAdTags interleaves ad tags sorted by weight with ad tags in study sorted by study left,
+// ad tags without weight which finished study are not ranked.
+// Params: max_ad_tags (default 10) and rank_study_requests (default 1000).
+func rankAdTags(adTags []*AdTagContext, params SelectorParams, weight func(*AdTagContext) float64) []*AdTagContext {
+	maxAdTags := int(params.Get("max_ad_tags", defaultMaxRankedAdTags))
+	studyRequests := int64(params.Get("rank_study_requests", defaultRankStudyRequests))
+
+	var adTagsWithWeight, adTagsForStudy []*AdTagContext
+	for _, adTag := range adTags {
+		adTag.SelectionWeight = weight(adTag)
+		requests := adTag.Data.ERPRByTargetingID[params.TargetingID].Requests
+		if adTag.SelectionWeight > 0 {
+			adTagsWithWeight = append(adTagsWithWeight, adTag)
+		} else if requests <= studyRequests {
+			adTag.IsPeriodOfStudy = true
+			adTag.StudyLeft = studyRequests - requests
+			adTagsForStudy = append(adTagsForStudy, adTag)
+		}
+	}
+
+	sort.SliceStable(adTagsWithWeight, func(i, j int) bool {
+		return adTagsWithWeight[i].SelectionWeight > adTagsWithWeight[j].SelectionWeight
+	})
+	sort.Stable(sortedByStudy(adTagsForStudy))
+
+	ranked := make([]*AdTagContext, 0, maxAdTags)
+	for i := 0; len(ranked) < maxAdTags && (i < len(adTagsWithWeight) || i < len(adTagsForStudy)); i++ {
+		if i < len(adTagsWithWeight) {
+			ranked = append(ranked, adTagsWithWeight[i])
+		}
+		if i < len(adTagsForStudy) && len(ranked) < maxAdTags {
+			ranked = append(ranked, adTagsForStudy[i])
+		}
+	}
+	return ranked
+}
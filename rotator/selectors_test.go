@@ -0,0 +1,105 @@
+package rotator
+
+import (
+	"reflect"
+	"testing"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/request_context"
+)
+
+func newRankedAdTag(id string, erpr float64, requests int64) *AdTagContext {
+	return &AdTagContext{ID: id, Data: data.AdTagData{
+		ERPRByTargetingID: map[string]data.ERPRData{"link": {ERPR: erpr, Requests: requests}},
+	}}
+}
+
+func TestERPRSelectorRank(t *testing.T) {
+	requestContext := request_context.RequestContext{Decision: &request_context.Decision{}}
+	params := SelectorParams{TargetingID: "link", Params: map[string]float64{"max_ad_tags": 4}}
+
+	adTags := []*AdTagContext{
+		newRankedAdTag("low", 0.1, 5000),
+		newRankedAdTag("studied", 0, 5000),
+		newRankedAdTag("new", 0, 10),
+		newRankedAdTag("high", 0.5, 5000),
+		newRankedAdTag("newer", 0, 0),
+		newRankedAdTag("middle", 0.3, 5000),
+	}
+	ranked := adTagContextIDs(selectors[strategyERPR].Rank(requestContext, adTags, params))
+	if expected := []string{"high", "newer", "middle", "new"}; !reflect.DeepEqual(ranked, expected) {
+		t.Errorf("expected %v, got %v", expected, ranked)
+	}
+
+	// Ad tags with eRPR only are ranked too
+	adTags = []*AdTagContext{newRankedAdTag("low", 0.1, 5000), newRankedAdTag("high", 0.5, 5000)}
+	ranked = adTagContextIDs(selectors[strategyERPR].Rank(requestContext, adTags, params))
+	if expected := []string{"high", "low"}; !reflect.DeepEqual(ranked, expected) {
+		t.Errorf("expected %v, got %v", expected, ranked)
+	}
+}
+
+func TestSelectionIsReproducibleFromSeed(t *testing.T) {
+	params := SelectorParams{TargetingID: "link", StudyRequests: 1000}
+	newAdTag := func(id string, fillRate float64, requests int64) *AdTagContext {
+		return &AdTagContext{ID: id, Data: data.AdTagData{
+			ERPRByTargetingID: map[string]data.ERPRData{"link": {FillRate: fillRate, Requests: requests}},
+		}}
+	}
+	adTags := []*AdTagContext{newAdTag("a", 0.1, 5000), newAdTag("b", 0.2, 5000), newAdTag("c", 0.3, 5000)}
+
+	selections := func(seed int64) []string {
+		requestContext := request_context.RequestContext{Decision: &request_context.Decision{}}
+		requestContext.SeedRandom(seed)
+		var ids []string
+		for i := 0; i < 20; i++ {
+			ids = append(ids, selectors[strategyFillRate].Select(requestContext, adTags, params).ID)
+		}
+		return ids
+	}
+
+	if first, second := selections(42), selections(42); !reflect.DeepEqual(first, second) {
+		t.Errorf("same seed gave different selections %v and %v", first, second)
+	}
+	if first, second := selections(42), selections(43); reflect.DeepEqual(first, second) {
+		t.Errorf("different seeds gave the same selections %v", first)
+	}
+
+	// While there are ad tags in period of study, one of them is selected
+	adTags = append(adTags, newAdTag("new", 0, 10))
+	for _, id := range selections(42) {
+		if id != "new" {
+			t.Fatalf("expected ad tag in period of study to be selected, got %s", id)
+		}
+	}
+}
+
+func TestVPAIDWaterfallIsRankedByERPR(t *testing.T) {
+	requestContext := request_context.RequestContext{Decision: &request_context.Decision{}, ResponseType: "vpaid"}
+	newAdTags := func() []*AdTagContext {
+		adTags := []*AdTagContext{newRankedAdTag("low", 0.1, 5000), newRankedAdTag("high", 0.5, 5000)}
+		// Fill rate order is the opposite of eRPR one
+		for i, adTag := range adTags {
+			erpr := adTag.Data.ERPRByTargetingID["link"]
+			erpr.FillRate = 0.9 - float64(i)*0.5
+			adTag.Data.ERPRByTargetingID["link"] = erpr
+		}
+		return adTags
+	}
+
+	params := SelectorParams{TargetingID: "link"}
+	strategy, ranked := selectAdTags(
+		requestContext, strategyFillRate, selectors[strategyFillRate], params, newAdTags(), false,
+	)
+	if expected := []string{"high", "low"}; strategy != strategyERPR+"_many" || !reflect.DeepEqual(adTagContextIDs(ranked), expected) {
+		t.Errorf("expected %v ranked by eRPR, got %v ranked by %s", expected, adTagContextIDs(ranked), strategy)
+	}
+
+	params.Params = map[string]float64{"rank_by_optimization": 1}
+	strategy, ranked = selectAdTags(
+		requestContext, strategyFillRate, selectors[strategyFillRate], params, newAdTags(), false,
+	)
+	if expected := []string{"low", "high"}; strategy != strategyFillRate+"_many" || !reflect.DeepEqual(adTagContextIDs(ranked), expected) {
+		t.Errorf("expected %v ranked by fill rate, got %v ranked by %s", expected, adTagContextIDs(ranked), strategy)
+	}
+}
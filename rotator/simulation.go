@@ -0,0 +1,325 @@
+package rotator
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/request_context"
+	uuid "github.com/satori/go.uuid"
+)
+
+const defaultSimulationFeedbackSync = 10 * time.Second
+
+// SimulatedRequest is a request replayed by Simulation, it is read from request events or generated
+type SimulatedRequest struct {
+	Timestamp    time.Time
+	TargetingID  string
+	ResponseType string
+	Domain       string
+	Country      string
+	DeviceType   string
+	// Price is publisher price, price of publisher link is used if it is not set
+	Price float64
+}
+
+// SimulatedAdTag is traffic an ad tag got in a simulation, requests of VPAID waterfalls
+// are counted with probability the waterfall reached the ad tag
+type SimulatedAdTag struct {
+	Requests    float64 `json:"requests"`
+	Impressions float64 `json:"expected_impressions"`
+	Revenue     float64 `json:"expected_revenue"`
+	Share       float64 `json:"share"`
+}
+
+// SimulationReport sums expected outcomes of replayed requests
+type SimulationReport struct {
+	Strategy string `json:"strategy"`
+	Requests int    `json:"requests"`
+	// Rejected requests have unknown publisher link or blocked domain
+	Rejected int `json:"rejected"`
+	// NoFill requests had no ad tags after filters or selector selected none
+	NoFill      int     `json:"no_fill"`
+	Fallback    int     `json:"fallback"`
+	Impressions float64 `json:"expected_impressions"`
+	Revenue     float64 `json:"expected_revenue"`
+	FillRate    float64 `json:"fill_rate"`
+	ERPR        float64 `json:"erpr"`
+	// ExplorationShare is share of ad tag requests sent to ad tags in period of study
+	ExplorationShare float64                    `json:"exploration_share"`
+	AdTags           map[string]*SimulatedAdTag `json:"ad_tags"`
+
+	adTagRequests float64
+	explored      float64
+}
+
+// Simulation replays requests through the filter pipeline and a selector as if every publisher link
+// was switched to the strategy. Outcomes are expected values from historical stats of serving data:
+// an ad tag fills a request with its fill rate on the domain or on the link and brings its margin.
+// Sampled outcomes are fed into live feedback of the simulation, so selectors consulting it adapt as in production.
+// Domain lists are read with DomainsListLookup.
+type Simulation struct {
+	Strategy string
+	// Params override optimization params of publisher links
+	Params       map[string]float64
+	FeedbackSync time.Duration
+
+	selector Selector
+	feedback *LiveFeedback
+	random   *rand.Rand
+	query    string
+	lastSync time.Time
+	report   SimulationReport
+}
+
+// feedbackSelector is a selector consulting live feedback, simulations give it their own counters
+type feedbackSelector interface {
+	withFeedback(feedback *LiveFeedback) Selector
+}
+
+func NewSimulation(strategy string, params map[string]float64, seed int64) (*Simulation, error) {
+	selector, exists := selectors[strategy]
+	if !exists {
+		return nil, fmt.Errorf("unknown selector %s", strategy)
+	}
+	snapshot := data.ServingData.Snapshot()
+	if snapshot == nil {
+		return nil, data.ErrNotInitialized
+	}
+
+	s := &Simulation{
+		Strategy:     strategy,
+		Params:       params,
+		FeedbackSync: defaultSimulationFeedbackSync,
+		selector:     selector,
+		feedback:     NewLiveFeedback(defaultFeedbackWindow, defaultFeedbackBucketSize),
+		random:       request_context.NewRandom(seed),
+		query:        simulatedQuery(snapshot.Data),
+		report: SimulationReport{
+			Strategy: strategy,
+			AdTags:   make(map[string]*SimulatedAdTag),
+		},
+	}
+	if selector, ok := selector.(feedbackSelector); ok {
+		s.selector = selector.withFeedback(s.feedback)
+	}
+	return s, nil
+}
+
+// Replay serves the request and counts its expected outcome
+func (s *Simulation) Replay(request SimulatedRequest) error {
+	if request.Timestamp.IsZero() {
+		return errors.New("simulated request has no timestamp")
+	}
+	s.report.Requests++
+	s.syncFeedback(request.Timestamp)
+
+	publisherLink, err := data.ServingData.GetPublisherLinkDataByID(request.TargetingID)
+	if err != nil {
+		s.report.Rejected++
+		return nil
+	}
+	domainsListItem, err := DomainsListLookup(defaultDomainBlackListKey, request.Domain)
+	if (err == nil && domainsListItem == "black") || !(&PublisherLink{Data: publisherLink}).IsDomainAllowForThisLink(request.Domain) {
+		s.report.Rejected++
+		return nil
+	}
+
+	requestContext := s.requestContext(request, publisherLink)
+	adTags, err := data.ServingData.GetAdTagsForPublisherLink(publisherLink.ID)
+	if err != nil {
+		s.report.NoFill++
+		return nil
+	}
+	adTagContextList := make([]*AdTagContext, len(adTags))
+	for i, adTag := range adTags {
+		adTagContextList[i] = &AdTagContext{ID: adTag.ID, Data: adTag.Data, AllChecksPassed: true}
+	}
+
+	adTagContextAfterFilters, isFallback := filterPipelineForLink(publisherLink).Run(requestContext, adTagContextList)
+	if len(adTagContextAfterFilters) == 0 {
+		s.report.NoFill++
+		return nil
+	}
+
+	params := SelectorParams{
+		TargetingID:   publisherLink.ID,
+		StudyRequests: publisherLink.StudyRequests,
+		Params:        s.params(publisherLink),
+	}
+	_, selectedAdTags := selectAdTags(requestContext, s.Strategy, s.selector, params, adTagContextAfterFilters, isFallback)
+	if len(selectedAdTags) == 0 {
+		s.report.NoFill++
+		return nil
+	}
+	if isFallback {
+		s.report.Fallback++
+	}
+
+	// VAST response has one ad tag, VPAID waterfall goes on while ad tags do not fill
+	reach := 1.0
+	for _, adTag := range selectedAdTags {
+		fillRate, margin := simulatedOutcome(adTag, publisherLink.ID, request.Domain)
+		s.count(adTag, params, reach, fillRate, margin)
+		reach *= 1 - fillRate
+	}
+
+	requestID := requestContext.RequestID.String()
+	for _, adTag := range selectedAdTags {
+		fillRate, margin := simulatedOutcome(adTag, publisherLink.ID, request.Domain)
+		key := FeedbackKey{TargetingID: publisherLink.ID, AdTagID: adTag.ID, Country: request.Country, Domain: request.Domain}
+		s.feedback.RecordRequest(requestID, key, request.Timestamp)
+		if s.random.Float64() < fillRate {
+			s.feedback.RecordEvent(FeedbackEvent{
+				RequestID: requestID,
+				AdTagID:   adTag.ID,
+				Name:      feedbackEventImpression,
+				Revenue:   margin,
+				At:        request.Timestamp,
+			})
+			break
+		}
+	}
+	return nil
+}
+
+// Report returns totals of replayed requests
+func (s *Simulation) Report() SimulationReport {
+	report := s.report
+	report.AdTags = make(map[string]*SimulatedAdTag, len(s.report.AdTags))
+	for id, adTag := range s.report.AdTags {
+		adTagReport := *adTag
+		if s.report.adTagRequests > 0 {
+			adTagReport.Share = adTag.Requests / s.report.adTagRequests
+		}
+		report.AdTags[id] = &adTagReport
+	}
+	if report.Requests > 0 {
+		report.FillRate = report.Impressions / float64(report.Requests)
+		report.ERPR = report.Revenue / float64(report.Requests)
+	}
+	if report.adTagRequests > 0 {
+		report.ExplorationShare = report.explored / report.adTagRequests
+	}
+	return report
+}
+
+// TopAdTags returns ids of ad tags of the report by requests, most requested first
+func (r SimulationReport) TopAdTags(limit int) []string {
+	ids := make([]string, 0, len(r.AdTags))
+	for id := range r.AdTags {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if r.AdTags[ids[i]].Requests != r.AdTags[ids[j]].Requests {
+			return r.AdTags[ids[i]].Requests > r.AdTags[ids[j]].Requests
+		}
+		return ids[i] < ids[j]
+	})
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids
+}
+
+func (s *Simulation) requestContext(request SimulatedRequest, publisherLink data.PublisherLinkData) request_context.RequestContext {
+	requestContext := request_context.RequestContext{
+		Request:              &http.Request{Method: http.MethodGet, URL: &url.URL{RawQuery: s.query}},
+		Type:                 "targeting",
+		RequestID:            uuid.NewV4(),
+		PublisherTargetingID: publisherLink.ID,
+		PublisherPrice:       request.Price,
+		ResponseType:         request.ResponseType,
+		Domain:               request.Domain,
+		ReceivedAt:           request.Timestamp,
+		Decision:             &request_context.Decision{},
+	}
+	if requestContext.PublisherPrice == 0 {
+		requestContext.PublisherPrice = publisherLink.Price
+	}
+	if requestContext.ResponseType == "vpaid" {
+		requestContext.Type = "vpaid"
+	}
+	requestContext.User.Geo.Country.ISOCode = request.Country
+	requestContext.User.UserAgent.DeviceType = request.DeviceType
+	requestContext.DevicePlatformType = request.DeviceType
+	requestContext.SetRequestPlatform(publisherLink.Platform)
+	requestContext.SeedRandom(s.random.Int63())
+	return requestContext
+}
+
+func (s *Simulation) params(publisherLink data.PublisherLinkData) map[string]float64 {
+	if len(s.Params) == 0 {
+		return publisherLink.OptimizationParams
+	}
+	params := make(map[string]float64, len(publisherLink.OptimizationParams)+len(s.Params))
+	for name, value := range publisherLink.OptimizationParams {
+		params[name] = value
+	}
+	for name, value := range s.Params {
+		params[name] = value
+	}
+	return params
+}
+
+// count adds expected outcome of a request the ad tag got with probability reach
+func (s *Simulation) count(adTag *AdTagContext, params SelectorParams, reach, fillRate, margin float64) {
+	adTagReport, exists := s.report.AdTags[adTag.ID]
+	if !exists {
+		adTagReport = &SimulatedAdTag{}
+		s.report.AdTags[adTag.ID] = adTagReport
+	}
+	adTagReport.Requests += reach
+	adTagReport.Impressions += reach * fillRate
+	adTagReport.Revenue += reach * fillRate * margin
+
+	s.report.adTagRequests += reach
+	s.report.Impressions += reach * fillRate
+	s.report.Revenue += reach * fillRate * margin
+	if adTag.Data.ERPRByTargetingID[params.TargetingID].Requests <= params.StudyRequests {
+		s.report.explored += reach
+	}
+}
+
+// syncFeedback syncs live feedback counters every FeedbackSync of simulated time
+func (s *Simulation) syncFeedback(now time.Time) {
+	if s.lastSync.IsZero() {
+		s.lastSync = now
+	}
+	if now.Sub(s.lastSync) >= s.FeedbackSync {
+		s.feedback.Sync(now)
+		s.lastSync = now
+	}
+}
+
+// simulatedOutcome returns historical fill rate and margin of the ad tag on the domain or on the link
+func simulatedOutcome(adTag *AdTagContext, targetingID, domain string) (float64, float64) {
+	stats := adTag.Data.ERPRByTargetingID[targetingID]
+	if domainStats, exists := adTag.Data.FillRateByTargetingIDAndDomain[targetingID][domain]; exists {
+		if domainStats.Margin == 0 {
+			domainStats.Margin = stats.Margin
+		}
+		stats = domainStats
+	}
+	return stats.FillRate, stats.Margin
+}
+
+// simulatedQuery sets every mapped parameter, request logs do not keep query, so required parameters are assumed to be set
+func simulatedQuery(syncData data.SyncData) string {
+	query := url.Values{}
+	for _, parameters := range syncData.ParametersMapping {
+		for _, platforms := range parameters {
+			for _, parameter := range platforms {
+				if parameter.OriginalShortcut != "" {
+					query.Set(parameter.OriginalShortcut, "1")
+				}
+			}
+		}
+	}
+	return query.Encode()
+}
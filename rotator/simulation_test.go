@@ -0,0 +1,60 @@
+package rotator
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+)
+
+func TestSimulationWaterfall(t *testing.T) {
+	adTag := func(id uint64, fillRate float64) data.AdTagData {
+		return data.AdTagData{
+			AdTagID: id, URL: "http://ads.example.com/vast", Price: 2, AdvertiserPlatformTypeID: 1,
+			Targeting: data.AdTagTargeting{Geo: []string{"O1"}},
+			ERPRByTargetingID: map[string]data.ERPRData{
+				"link": {Requests: 5000, Impressions: int64(fillRate * 5000), FillRate: fillRate, Margin: 1},
+			},
+		}
+	}
+	useServingData(t, data.SyncData{
+		Version:                 1,
+		AdTags:                  map[string]data.AdTagData{"1": adTag(1, 0.5), "2": adTag(2, 0.2)},
+		ParametersMapping:       map[uint64]map[string]map[string]data.ParametersMapping{1: {}},
+		PublisherTargetingIDMap: map[string]uint64{"link": 10},
+		TargetingLinkAdTagsIDs:  map[string][]string{"link": {"1", "2"}},
+		PublisherLinks:          map[string]data.PublisherLinkData{"link": {ID: "link", Price: 1, Platform: "in-app"}},
+	})
+	defer func(lookup func(string, string) (string, error)) { DomainsListLookup = lookup }(DomainsListLookup)
+	DomainsListLookup = func(listKey, domain string) (string, error) {
+		return "", errors.New("no lists")
+	}
+
+	// Waterfalls are ranked by fill rate only if link opts in
+	simulation, err := NewSimulation(strategyFillRate, map[string]float64{"rank_by_optimization": 1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1500000000, 0)
+	for i := 0; i < 10; i++ {
+		simulation.Replay(SimulatedRequest{Timestamp: start.Add(time.Duration(i) * time.Second), TargetingID: "link", ResponseType: "vpaid"})
+	}
+	simulation.Replay(SimulatedRequest{Timestamp: start, TargetingID: "unknown", ResponseType: "vpaid"})
+
+	report := simulation.Report()
+	if report.Requests != 11 || report.Rejected != 1 {
+		t.Errorf("unexpected request counts %+v", report)
+	}
+	// Second ad tag gets requests which first one did not fill
+	if math.Abs(report.Impressions-10*(0.5+0.5*0.2)) > 1e-9 {
+		t.Errorf("unexpected expected impressions %f", report.Impressions)
+	}
+	if share := report.AdTags["2"].Share; math.Abs(share-1.0/3) > 1e-9 {
+		t.Errorf("unexpected traffic share of second ad tag %f", share)
+	}
+	if report.ExplorationShare != 0 {
+		t.Errorf("expected no exploration, got %f", report.ExplorationShare)
+	}
+}
@@ -5,12 +5,8 @@ import (
 
 	"sort"
 
-	"fmt"
-
 	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
-	"bitbucket.org/tapgerine/traffic_rotator/rotator/redis_handler"
 	"bitbucket.org/tapgerine/traffic_rotator/rotator/request_context"
-	log "github.com/Sirupsen/logrus"
 )
 
 type weightIntervals struct {
@@ -61,18 +57,6 @@ func (a sortedByStudy) Less(i, j int) bool {
 	return a[i].StudyLeft > a[j].StudyLeft
 }
 
-func filterAdTagsByPublisher(r request_context.RequestContext, adTags *map[string]data.AdTagData, adTagKeys *[]string) {
-	for index, key := range *adTagKeys {
-		if key == "" {
-			continue
-		}
-		adTag := (*adTags)[key]
-		if adTag.PublisherTargetingID != r.PublisherTargetingID {
-			(*adTagKeys)[index] = ""
-		}
-	}
-}
-
 func filterAdTagsForTargeting(r request_context.RequestContext, adTags *map[string]data.AdTagData, adTagKeys *[]string) {
 	for index, key := range *adTagKeys {
 		if key == "" {
@@ -171,14 +155,14 @@ func filterAdTagsByDeviceType(r request_context.RequestContext, adTags *map[stri
 	}
 }
 
-func selectRandomAdTag(adTags *map[string]data.AdTagData, filteredKeys []string) (string, data.AdTagData) {
-	i := rand.Intn(len(filteredKeys))
+func selectRandomAdTag(random *rand.Rand, adTags *map[string]data.AdTagData, filteredKeys []string) (string, data.AdTagData) {
+	i := random.Intn(len(filteredKeys))
 	selectedKey := filteredKeys[i]
 
 	return selectedKey, (*adTags)[selectedKey]
 }
 
-func selectAdTagByERPR(adTags *map[string]data.AdTagData, filteredKeys []string, userGeoCountry string) (string, data.AdTagData) {
+func selectAdTagByERPR(random *rand.Rand, adTags *map[string]data.AdTagData, filteredKeys []string, userGeoCountry string) (string, data.AdTagData) {
 	var totalERPR float64
 
 	adTagsWithoutERPR := make([]string, len(filteredKeys))
@@ -205,11 +189,11 @@ func selectAdTagByERPR(adTags *map[string]data.AdTagData, filteredKeys []string,
 		adTagsWithoutERPRChance = 30
 	}
 
-	chanceToWin := rand.Intn(100)
+	chanceToWin := random.Intn(100)
 
 	if adTagsWithoutERPRCounter > 0 && (adTagsWithoutERPRChance > chanceToWin || adTagsWithoutERPRCounter == len(filteredKeys) || adTagsWithERPRCounter == 0) {
 		// Ad tags without erpr won and we trying to select one
-		i := rand.Intn(adTagsWithoutERPRCounter)
+		i := random.Intn(adTagsWithoutERPRCounter)
 		adTagID := adTagsWithoutERPR[i]
 		return adTagID, (*adTags)[adTagID]
 	} else {
@@ -232,7 +216,7 @@ func selectAdTagByERPR(adTags *map[string]data.AdTagData, filteredKeys []string,
 			i++
 		}
 
-		randomWeight := rand.Float64() * totalIntervalsWeight
+		randomWeight := random.Float64() * totalIntervalsWeight
 
 		selectedAdTagID := ""
 		for _, interval := range erprIntervals {
@@ -261,68 +245,6 @@ func selectManyAdTagByERPR(adTags *map[string]data.AdTagData, filteredKeys []str
 	return result
 }
 
-func selectManyAdTagsByERPRV2(adTags []*AdTagContext, targetingID string, numberOfTags int) []*AdTagContext {
-	adTagsForStudy := make([]*AdTagContext, len(adTags))
-	adTagsWithERPR := make([]*AdTagContext, len(adTags))
-	var adTagsForStudyCounter, adTagsWithERPRCounter int
-
-	var totalERPR float64
-	var largestSliceLen int
-	for _, adTag := range adTags {
-		if adTag.Data.ERPRByTargetingID[targetingID].ERPR > 0 {
-			adTagsWithERPR[adTagsWithERPRCounter] = adTag
-			adTagsWithERPRCounter++
-
-			if adTagsWithERPRCounter > largestSliceLen {
-				largestSliceLen = adTagsWithERPRCounter
-			}
-
-			totalERPR += adTag.Data.ERPRByTargetingID[targetingID].ERPR
-		} else if adTag.Data.ERPRByTargetingID[targetingID].Requests <= 1000 {
-			adTag.StudyLeft = 1000 - adTag.Data.ERPRByTargetingID[targetingID].Requests
-			adTagsForStudy[adTagsForStudyCounter] = adTag
-			adTagsForStudyCounter++
-			if adTagsForStudyCounter > largestSliceLen {
-				largestSliceLen = adTagsForStudyCounter
-			}
-		}
-	}
-
-	adTagsWithERPR = adTagsWithERPR[:adTagsWithERPRCounter]
-	adTagsForStudy = adTagsForStudy[:adTagsForStudyCounter]
-
-	if adTagsForStudyCounter == 0 {
-		sort.Sort(sortedByStudy(adTagsForStudy))
-		return adTagsForStudy
-	} else if adTagsWithERPRCounter == 0 {
-		sort.Sort(sortedByERPR(adTagsWithERPR))
-		return adTagsWithERPR
-	}
-
-	sort.Sort(sortedByStudy(adTagsForStudy))
-	sort.Sort(sortedByERPR(adTagsWithERPR))
-
-	var sortedAdTags []*AdTagContext
-	sortedAdTags = make([]*AdTagContext, numberOfTags)
-	var sortedAdTagsLen int
-
-	for i := 0; i < largestSliceLen; i++ {
-		if i < adTagsWithERPRCounter {
-			sortedAdTags[sortedAdTagsLen] = adTagsWithERPR[i]
-			sortedAdTagsLen++
-		}
-		if i < adTagsForStudyCounter {
-			sortedAdTags[sortedAdTagsLen] = adTagsForStudy[i]
-			sortedAdTagsLen++
-		}
-		if sortedAdTagsLen >= numberOfTags {
-			break
-		}
-	}
-	return sortedAdTags[:sortedAdTagsLen]
-
-}
-
 func selectManyAdTagsByERPR(adTags []*AdTagContext, targetingID string, numberOfTags int) []*AdTagContext {
 	var totalERPR float64
 	adTagsWithoutERPR := make([]*AdTagContext, len(adTags))
@@ -386,7 +308,7 @@ func selectManyAdTagsByERPR(adTags []*AdTagContext, targetingID string, numberOf
 
 }
 
-func selectAdTagByDomainFillRate(adTags []*AdTagContext, targetingID string, domain string, studyRequests int64) *AdTagContext {
+func selectAdTagByDomainFillRate(random *rand.Rand, adTags []*AdTagContext, targetingID string, domain string, studyRequests int64) *AdTagContext {
 	adTagsForStudy := make([]*AdTagContext, len(adTags))
 	adTagsWithFillRate := make([]*AdTagContext, len(adTags))
 	var adTagsForStudyCounter, adTagsWithFillRateCounter int
@@ -403,11 +325,13 @@ func selectAdTagByDomainFillRate(adTags []*AdTagContext, targetingID string, dom
 				adTag.FillRate = adTag.Data.ERPRByTargetingID[targetingID].FillRate
 			}
 
+			adTag.SelectionWeight = adTag.FillRate
 			adTagsWithFillRate[adTagsWithFillRateCounter] = adTag
 			adTagsWithFillRateCounter++
 			totalFillRate += adTag.FillRate
 
 		} else if adTag.Data.ERPRByTargetingID[targetingID].Requests <= studyRequests {
+			adTag.IsPeriodOfStudy = true
 			adTagsForStudy[adTagsForStudyCounter] = adTag
 			adTagsForStudyCounter++
 		}
@@ -417,7 +341,7 @@ func selectAdTagByDomainFillRate(adTags []*AdTagContext, targetingID string, dom
 	adTagsForStudy = adTagsForStudy[:adTagsForStudyCounter]
 
 	if adTagsForStudyCounter > 0 {
-		i := rand.Intn(adTagsForStudyCounter)
+		i := random.Intn(adTagsForStudyCounter)
 		adTag := adTagsForStudy[i]
 		return adTag
 	} else if adTagsWithFillRateCounter > 0 {
@@ -436,7 +360,7 @@ func selectAdTagByDomainFillRate(adTags []*AdTagContext, targetingID string, dom
 			i++
 		}
 
-		randomWeight := rand.Float64() * totalIntervalsWeight
+		randomWeight := random.Float64() * totalIntervalsWeight
 
 		for _, interval := range fillRateIntervals {
 			if interval.weight >= randomWeight && randomWeight >= interval.prevWeight {
@@ -448,7 +372,7 @@ func selectAdTagByDomainFillRate(adTags []*AdTagContext, targetingID string, dom
 	return nil
 }
 
-func selectAdTagByFillRate(adTags []*AdTagContext, targetingID string, studyRequests int64) *AdTagContext {
+func selectAdTagByFillRate(random *rand.Rand, adTags []*AdTagContext, targetingID string, studyRequests int64) *AdTagContext {
 	adTagsForStudy := make([]*AdTagContext, len(adTags))
 	adTagsWithFillRate := make([]*AdTagContext, len(adTags))
 	var adTagsForStudyCounter, adTagsWithFillRateCounter int
@@ -457,11 +381,13 @@ func selectAdTagByFillRate(adTags []*AdTagContext, targetingID string, studyRequ
 	for _, adTag := range adTags {
 		if adTag.Data.ERPRByTargetingID[targetingID].FillRate > .0 {
 			adTag.FillRate = adTag.Data.ERPRByTargetingID[targetingID].FillRate
+			adTag.SelectionWeight = adTag.FillRate
 			adTagsWithFillRate[adTagsWithFillRateCounter] = adTag
 			adTagsWithFillRateCounter++
 			totalFillRate += adTag.FillRate
 
 		} else if adTag.Data.ERPRByTargetingID[targetingID].Requests <= studyRequests {
+			adTag.IsPeriodOfStudy = true
 			adTagsForStudy[adTagsForStudyCounter] = adTag
 			adTagsForStudyCounter++
 		}
@@ -471,7 +397,7 @@ func selectAdTagByFillRate(adTags []*AdTagContext, targetingID string, studyRequ
 	adTagsForStudy = adTagsForStudy[:adTagsForStudyCounter]
 
 	if adTagsForStudyCounter > 0 {
-		i := rand.Intn(adTagsForStudyCounter)
+		i := random.Intn(adTagsForStudyCounter)
 		adTag := adTagsForStudy[i]
 		return adTag
 	} else if adTagsWithFillRateCounter > 0 {
@@ -490,7 +416,7 @@ func selectAdTagByFillRate(adTags []*AdTagContext, targetingID string, studyRequ
 			i++
 		}
 
-		randomWeight := rand.Float64() * totalIntervalsWeight
+		randomWeight := random.Float64() * totalIntervalsWeight
 
 		for _, interval := range fillRateIntervals {
 			if interval.weight >= randomWeight && randomWeight >= interval.prevWeight {
@@ -502,7 +428,7 @@ func selectAdTagByFillRate(adTags []*AdTagContext, targetingID string, studyRequ
 	return nil
 }
 
-func selectAdTagByERPRV3(adTags []*AdTagContext, targetingID string, studyRequests int64) *AdTagContext {
+func selectAdTagByERPRV3(random *rand.Rand, adTags []*AdTagContext, targetingID string, studyRequests int64) *AdTagContext {
 	adTagsForStudy := make([]*AdTagContext, len(adTags))
 	adTagsWithERPR := make([]*AdTagContext, len(adTags))
 	var adTagsForStudyCounter, adTagsWithERPRCounter int
@@ -510,10 +436,12 @@ func selectAdTagByERPRV3(adTags []*AdTagContext, targetingID string, studyReques
 	var totalERPR float64
 	for _, adTag := range adTags {
 		if adTag.Data.ERPRByTargetingID[targetingID].ERPR > 0 {
+			adTag.SelectionWeight = adTag.Data.ERPRByTargetingID[targetingID].ERPR
 			adTagsWithERPR[adTagsWithERPRCounter] = adTag
 			adTagsWithERPRCounter++
 			totalERPR += adTag.Data.ERPRByTargetingID[targetingID].ERPR
 		} else if adTag.Data.ERPRByTargetingID[targetingID].Requests <= studyRequests {
+			adTag.IsPeriodOfStudy = true
 			adTagsForStudy[adTagsForStudyCounter] = adTag
 			adTagsForStudyCounter++
 		}
@@ -523,7 +451,7 @@ func selectAdTagByERPRV3(adTags []*AdTagContext, targetingID string, studyReques
 	adTagsForStudy = adTagsForStudy[:adTagsForStudyCounter]
 
 	if adTagsForStudyCounter > 0 {
-		i := rand.Intn(adTagsForStudyCounter)
+		i := random.Intn(adTagsForStudyCounter)
 		adTag := adTagsForStudy[i]
 		return adTag
 	} else if adTagsWithERPRCounter > 0 {
@@ -542,7 +470,7 @@ func selectAdTagByERPRV3(adTags []*AdTagContext, targetingID string, studyReques
 			i++
 		}
 
-		randomWeight := rand.Float64() * totalIntervalsWeight
+		randomWeight := random.Float64() * totalIntervalsWeight
 
 		for _, interval := range erprIntervals {
 			if interval.weight >= randomWeight && randomWeight >= interval.prevWeight {
@@ -554,7 +482,7 @@ func selectAdTagByERPRV3(adTags []*AdTagContext, targetingID string, studyReques
 	return nil
 }
 
-func selectAdTagByERPRV2(adTags []*AdTagContext, targetingID string) *AdTagContext {
+func selectAdTagByERPRV2(random *rand.Rand, adTags []*AdTagContext, targetingID string) *AdTagContext {
 	adTagsWithoutERPR := make([]*AdTagContext, len(adTags))
 	adTagsWithERPR := make([]*AdTagContext, len(adTags))
 	var adTagsWithoutERPRCounter, adTagsWithERPRCounter int
@@ -581,11 +509,11 @@ func selectAdTagByERPRV2(adTags []*AdTagContext, targetingID string) *AdTagConte
 		adTagsWithoutERPRChance = 30
 	}
 
-	chanceToWin := rand.Intn(100)
+	chanceToWin := random.Intn(100)
 
 	if adTagsWithoutERPRCounter > 0 && (adTagsWithoutERPRChance > chanceToWin || adTagsWithoutERPRCounter == len(adTags) || adTagsWithERPRCounter == 0) {
 		// Ad tags without erpr won and we trying to select one
-		i := rand.Intn(adTagsWithoutERPRCounter)
+		i := random.Intn(adTagsWithoutERPRCounter)
 		adTag := adTagsWithoutERPR[i]
 		return adTag
 	} else {
@@ -604,7 +532,7 @@ func selectAdTagByERPRV2(adTags []*AdTagContext, targetingID string) *AdTagConte
 			i++
 		}
 
-		randomWeight := rand.Float64() * totalIntervalsWeight
+		randomWeight := random.Float64() * totalIntervalsWeight
 
 		for _, interval := range erprIntervals {
 			if interval.weight >= randomWeight && randomWeight >= interval.prevWeight {
@@ -615,86 +543,6 @@ func selectAdTagByERPRV2(adTags []*AdTagContext, targetingID string) *AdTagConte
 	return nil
 }
 
-func filterAdTagsByPriceV2(r request_context.RequestContext, adTags []*AdTagContext) {
-	if r.UseOriginPrice {
-		// If we use origin price - skip this check
-		return
-	}
-
-	if r.PublisherPrice == 0 {
-		// we do not pay publisher for traffic
-		return
-	}
-
-	for _, adTag := range adTags {
-		if !(adTag.Data.Price > 0 && adTag.Data.Price >= r.PublisherPrice) {
-			adTag.AllChecksPassed = false
-		}
-	}
-}
-
-func filterAdTagsByRequiredParameters(r request_context.RequestContext, adTags []*AdTagContext) {
-	for _, adTag := range adTags {
-		if adTag.AllChecksPassed == false {
-			continue
-		}
-
-		parametersMapping, err := data.ServingData.GetParametersMapByID(adTag.Data.AdvertiserPlatformTypeID)
-		if err != nil {
-			log.WithField("ad_tag_id", adTag.ID).WithError(err).Warn()
-			continue
-		}
-
-		for _, parameter := range parametersMapping {
-			if parameter[r.RequestPlatform].IsRequired {
-				valueFromRequest := r.Request.URL.Query().Get(parameter[r.RequestPlatform].OriginalShortcut)
-				if valueFromRequest == "" || valueFromRequest == parameter[r.RequestPlatform].OriginalMacros {
-					adTag.AllChecksPassed = false
-					break
-				}
-			}
-		}
-	}
-}
-
-func filterAdTagsByDomainLists(r request_context.RequestContext, adTags []*AdTagContext) {
-	for _, adTag := range adTags {
-		if adTag.AllChecksPassed == false {
-			continue
-		}
-		if adTag.Data.DomainsListID > 0 {
-			if r.Domain == "" {
-				adTag.AllChecksPassed = false
-				continue
-			}
-
-			domainsListItem, err := redis_handler.RedisConnection.HGet(fmt.Sprintf("domains:%d", adTag.Data.DomainsListID), r.Domain).Result()
-
-			if adTag.Data.DomainsListType == "white" && !(err == nil && domainsListItem == "white") {
-				// White list activated. Domain is not in the list
-				adTag.AllChecksPassed = false
-				continue
-			} else if adTag.Data.DomainsListType == "black" && err == nil && domainsListItem == "black" {
-				// Black list activated. Domain is in the list
-				adTag.AllChecksPassed = false
-				continue
-			}
-		}
-	}
-}
-
-func filterAdTagsByDeviceTypeV2(r request_context.RequestContext, adTags []*AdTagContext) {
-	if r.User.UserAgent.DeviceType == "undefined" {
-		return
-	}
-
-	for _, adTag := range adTags {
-		if adTag.Data.Targeting.DeviceType != r.User.UserAgent.DeviceType {
-			adTag.AllChecksPassed = false
-		}
-	}
-}
-
 func filterAdTagsByGeoV2(r request_context.RequestContext, adTags []*AdTagContext) {
 	for _, adTag := range adTags {
 		if adTag.AllChecksPassed == false {
@@ -729,44 +577,3 @@ func filterAdTagsByGeoV2(r request_context.RequestContext, adTags []*AdTagContex
 		}
 	}
 }
-
-func filterAdTagsByGeoV3(r request_context.RequestContext, adTags []*AdTagContext) {
-	for _, adTag := range adTags {
-		if adTag.AllChecksPassed == false {
-			continue
-		}
-		adTag.GeoConfig.IsSetUpGeo = false
-		for _, ISOCode := range adTag.Data.Targeting.Geo {
-			if ISOCode == "O1" {
-				// It means WW targeting
-				adTag.GeoConfig.IsWorldWide = true
-				break
-			}
-			if r.User.Geo.Country.ISOCode != "" && ISOCode == r.User.Geo.Country.ISOCode {
-				adTag.GeoConfig.IsSetUpGeo = true
-				break
-			}
-		}
-
-		if !adTag.GeoConfig.IsWorldWide && !adTag.GeoConfig.IsSetUpGeo {
-			adTag.GeoCheckFailed = true
-			adTag.AllChecksPassed = false
-		}
-
-		//if !adTag.GeoConfig.IsWorldWide && !adTag.GeoConfig.IsSetUpGeo {
-		//	_, historicGeo := adTag.Data.ERPRByGeoForLastWeek[r.User.Geo.Country.ISOCode]
-		//
-		//	if !historicGeo {
-		//		if adTag.Data.ERPRByTargetingID[r.PublisherTargetingID].Requests <= 10000 {
-		//			adTag.IsPeriodOfStudy = true
-		//			adTag.StudyLeft = 10000 - adTag.Data.ERPRByTargetingID[r.PublisherTargetingID].Requests
-		//		} else {
-		//			adTag.IsPeriodOfStudyPassed = true
-		//			adTag.AllChecksPassed = false
-		//		}
-		//	} else {
-		//		adTag.GeoConfig.IsHistoricalGeo = true
-		//	}
-		//}
-	}
-}
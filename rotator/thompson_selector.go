@@ -0,0 +1,172 @@
+package rotator
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/request_context"
+)
+
+func init() {
+	RegisterSelector(strategyThompson, thompsonSelector{feedback: Feedback})
+}
+
+// thompsonSelector samples fill rate of every ad tag from its Beta posterior and picks the best sample.
+// Prior is built from synced historical stats, decaying live feedback counters of all instances are added to it,
+// so exploration of ad tags with few trials decays smoothly.
+//
+// Params: prior_weight (default 1) scales historical counts, prior_max_trials (default 1000)
+// caps historical trials, so live outcomes could move the posterior, revenue_weighted (default 1)
+// multiplies sampled fill rate by ad tag margin, by_geo and by_domain (default 0) keep separate
+// posteriors per user country or request domain, max_ad_tags (default 10) limits ranked selection,
+// which is used for VPAID waterfalls only with rank_by_optimization param.
+type thompsonSelector struct {
+	feedback *LiveFeedback
+}
+
+func (s thompsonSelector) withFeedback(feedback *LiveFeedback) Selector {
+	return thompsonSelector{feedback: feedback}
+}
+
+type thompsonArm struct {
+	adTag *AdTagContext
+	alpha float64
+	beta  float64
+	value float64
+	score float64
+}
+
+func (s thompsonSelector) Select(r request_context.RequestContext, adTags []*AdTagContext, params SelectorParams) *AdTagContext {
+	arms := s.sample(r, adTags, params)
+	if len(arms) == 0 {
+		return nil
+	}
+	best := arms[0]
+	for _, arm := range arms[1:] {
+		if arm.score > best.score {
+			best = arm
+		}
+	}
+	return best.adTag
+}
+
+func (s thompsonSelector) Rank(r request_context.RequestContext, adTags []*AdTagContext, params SelectorParams) []*AdTagContext {
+	arms := s.sample(r, adTags, params)
+	sort.SliceStable(arms, func(i, j int) bool {
+		return arms[i].score > arms[j].score
+	})
+
+	maxAdTags := int(params.Get("max_ad_tags", defaultMaxRankedAdTags))
+	if len(arms) > maxAdTags {
+		arms = arms[:maxAdTags]
+	}
+	ranked := make([]*AdTagContext, len(arms))
+	for i, arm := range arms {
+		ranked[i] = arm.adTag
+	}
+	return ranked
+}
+
+func (s thompsonSelector) sample(r request_context.RequestContext, adTags []*AdTagContext, params SelectorParams) []thompsonArm {
+	priorWeight := params.Get("prior_weight", 1)
+	priorMaxTrials := params.Get("prior_max_trials", 1000)
+	revenueWeighted := params.Get("revenue_weighted", 1) > 0
+	segment := feedbackSegment(r, params)
+
+	arms := make([]thompsonArm, len(adTags))
+	for i, adTag := range adTags {
+		prior := banditPrior(r, adTag, params)
+		priorSuccesses := float64(prior.Impressions) * priorWeight
+		priorTrials := float64(prior.Requests) * priorWeight
+		if priorTrials > priorMaxTrials {
+			priorSuccesses *= priorMaxTrials / priorTrials
+			priorTrials = priorMaxTrials
+		}
+		if priorSuccesses > priorTrials {
+			priorSuccesses = priorTrials
+		}
+
+		segment.AdTagID = adTag.ID
+		// Impressions are counted only for recorded requests, so live successes never exceed trials
+		live := s.feedback.Get(segment)
+		liveSuccesses, liveTrials := live.Impressions, live.Requests
+
+		arm := thompsonArm{
+			adTag: adTag,
+			alpha: 1 + priorSuccesses + liveSuccesses,
+			beta:  1 + (priorTrials - priorSuccesses) + (liveTrials - liveSuccesses),
+			value: 1,
+		}
+		if revenueWeighted && prior.Margin > 0 {
+			arm.value = prior.Margin
+		}
+		arm.score = sampleBeta(r.Random, arm.alpha, arm.beta) * arm.value
+		arms[i] = arm
+
+		// Posterior mean is reported as the weight in decision traces
+		adTag.SelectionWeight = arm.alpha / (arm.alpha + arm.beta) * arm.value
+	}
+	return arms
+}
+
+// feedbackSegment returns live feedback key of the request according to by_geo and by_domain params, ad tag is not set
+func feedbackSegment(r request_context.RequestContext, params SelectorParams) FeedbackKey {
+	key := FeedbackKey{TargetingID: params.TargetingID}
+	if params.Get("by_geo", 0) > 0 {
+		key.Country = r.User.Geo.Country.ISOCode
+	}
+	if params.Get("by_domain", 0) > 0 {
+		key.Domain = r.Domain
+	}
+	return key
+}
+
+// banditPrior returns the most specific historical stats of the ad tag: by domain, by geo or by link
+func banditPrior(r request_context.RequestContext, adTag *AdTagContext, params SelectorParams) data.ERPRData {
+	if params.Get("by_domain", 0) > 0 {
+		if stats, exists := adTag.Data.FillRateByTargetingIDAndDomain[params.TargetingID][r.Domain]; exists {
+			return stats
+		}
+	}
+	if params.Get("by_geo", 0) > 0 {
+		if stats, exists := adTag.Data.ERPRByGeoForLastWeek[r.User.Geo.Country.ISOCode]; exists {
+			return stats
+		}
+	}
+	return adTag.Data.ERPRByTargetingID[params.TargetingID]
+}
+
+// sampleBeta samples Beta(alpha, beta) distribution as ratio of Gamma samples
+func sampleBeta(random *rand.Rand, alpha, beta float64) float64 {
+	x := sampleGamma(random, alpha)
+	y := sampleGamma(random, beta)
+	if x+y == 0 {
+		return 0
+	}
+	return x / (x + y)
+}
+
+// sampleGamma samples Gamma(shape, 1) distribution using Marsaglia and Tsang method
+func sampleGamma(random *rand.Rand, shape float64) float64 {
+	if shape < 1 {
+		// Gamma(a) = Gamma(a + 1) * U^(1/a)
+		return sampleGamma(random, shape+1) * math.Pow(random.Float64(), 1/shape)
+	}
+
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := random.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := random.Float64()
+		if u < 1-0.0331*x*x*x*x || math.Log(u) < 0.5*x*x+d*(1-v+math.Log(v)) {
+			return d * v
+		}
+	}
+}
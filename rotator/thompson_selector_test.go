@@ -0,0 +1,62 @@
+package rotator
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/data"
+	"bitbucket.org/tapgerine/traffic_rotator/rotator/request_context"
+)
+
+func TestThompsonSelectorPrefersBetterArm(t *testing.T) {
+	selector := thompsonSelector{feedback: NewLiveFeedback(time.Hour, time.Minute)}
+	requestContext := request_context.RequestContext{Decision: &request_context.Decision{}, Random: request_context.NewRandom(1)}
+	params := SelectorParams{TargetingID: "link", Params: map[string]float64{"revenue_weighted": 0}}
+
+	newAdTag := func(id string, impressions int64) *AdTagContext {
+		return &AdTagContext{ID: id, Data: data.AdTagData{
+			ERPRByTargetingID: map[string]data.ERPRData{"link": {Requests: 1000, Impressions: impressions}},
+		}}
+	}
+	adTags := []*AdTagContext{newAdTag("bad", 100), newAdTag("good", 300)}
+
+	// Live feedback shows that good ad tag stopped filling
+	now := time.Now()
+	for i := 0; i < 5000; i++ {
+		selector.feedback.RecordRequest(strconv.Itoa(i), FeedbackKey{TargetingID: "link", AdTagID: "good", Domain: "example.com"}, now)
+	}
+	selector.feedback.Sync(now)
+
+	var badSelected int
+	for i := 0; i < 1000; i++ {
+		if selector.Select(requestContext, adTags, params).ID == "bad" {
+			badSelected++
+		}
+	}
+	if badSelected < 950 {
+		t.Errorf("expected bad ad tag to win after live requests of good one were not filled, it won %d times", badSelected)
+	}
+}
+
+func TestThompsonSelectorIgnoresReplayedImpressions(t *testing.T) {
+	selector := thompsonSelector{feedback: NewLiveFeedback(time.Hour, time.Minute)}
+	requestContext := request_context.RequestContext{Decision: &request_context.Decision{}, Random: request_context.NewRandom(1)}
+	params := SelectorParams{TargetingID: "link"}
+	adTags := []*AdTagContext{{ID: "tag"}}
+	selector.feedback.HalfLife = 0
+
+	now := time.Now()
+	key := FeedbackKey{TargetingID: "link", AdTagID: "tag"}
+	selector.feedback.RecordRequest("request", key, now)
+	for i := 0; i < 100; i++ {
+		selector.feedback.RecordEvent(FeedbackEvent{RequestID: "request", AdTagID: "tag", Name: feedbackEventImpression, At: now})
+		selector.feedback.RecordEvent(FeedbackEvent{RequestID: "forged", AdTagID: "tag", Name: feedbackEventImpression, At: now})
+	}
+	selector.feedback.Sync(now)
+
+	arm := selector.sample(requestContext, adTags, params)[0]
+	if arm.alpha != 2 || arm.beta != 1 {
+		t.Errorf("expected one live success of one trial, got alpha %f beta %f", arm.alpha, arm.beta)
+	}
+}